@@ -24,14 +24,23 @@
 package app
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/didip/tollbooth"
 	"github.com/didip/tollbooth/thirdparty/tollbooth_negroni"
+	"github.com/dstroot/postgres-api/middleware/auth"
 	"github.com/dstroot/postgres-api/middleware/connlimit"
+	"github.com/dstroot/postgres-api/middleware/deadline"
+	"github.com/dstroot/postgres-api/middleware/requestid"
+	"github.com/dstroot/postgres-api/migrations"
+	"github.com/dstroot/postgres-api/models"
 	env "github.com/joeshaw/envdecode"
 	"github.com/thoas/stats"
 	"github.com/urfave/negroni"
@@ -43,33 +52,28 @@ import (
 	"github.com/pkg/errors"
 )
 
-// App struct holds the router, server, database
-// and configuration that the application uses.
+// App struct holds the router, server, database, product, idempotency
+// key, API key and role stores and configuration that the application
+// uses.
 type App struct {
-	Router *httprouter.Router
-	DB     *sql.DB
-	Server *http.Server
-	Stats  *stats.Stats
-	Cfg    config
-}
+	Router      *httprouter.Router
+	DB          *sql.DB
+	Store       model.ProductStore
+	Idempotency model.IdempotencyStore
+	Keys        *model.APIKeyCache
+	Roles       *model.RoleCache
+	Server      *http.Server
+	Stats       *stats.Stats
+	Cfg         config
 
-// config holds the system configuration
-type config struct {
-	HostName string
-	Debug    bool   `env:"DEBUG,default=true"`
-	Port     string `env:"PORT,default=8000"`
-
-	SQL struct {
-		Host     string `env:"SQL_HOST,default=localhost"`
-		Port     string `env:"SQL_PORT,default=5432"`
-		User     string `env:"SQL_USER,default=postgres"`
-		Password string `env:"SQL_PASSWORD,default=mysecretpassword"`
-		Database string `env:"SQL_DATABASE,default=products"`
-	}
+	// Settings is the configuration as the admin API reports it, with
+	// secrets masked.
+	Settings []Setting
 }
 
-// Initialize will populate the configuration, connect to the database,
-// and instantiate the router and server and then return an app.
+// Initialize will populate the configuration, set up the product store
+// (connecting to the database unless STORE=memory), and instantiate the
+// router and server and then return an app.
 func Initialize() (app App, err error) {
 
 	/**
@@ -85,31 +89,51 @@ func Initialize() (app App, err error) {
 	// configure hostame
 	app.Cfg.HostName, _ = os.Hostname()
 
+	// Without a configured secret cursors only work against this process
+	if app.Cfg.CursorSecret == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		app.Cfg.CursorSecret = hex.EncodeToString(b)
+		log.Printf("%s - CURSOR_SECRET not set, using a random one", app.Cfg.HostName)
+	}
+
+	app.Settings = app.Cfg.settings(readDotEnv())
+
 	/**
 	 * Database
 	 */
 
-	connString := "postgres://" + app.Cfg.SQL.User +
-		":" + app.Cfg.SQL.Password +
-		"@" + app.Cfg.SQL.Host +
-		":" + app.Cfg.SQL.Port +
-		"/" + app.Cfg.SQL.Database +
-		"?sslmode=disable"
+	// a request holding an Idempotency-Key is only given up for dead
+	// once it is past the longest deadline of any route
+	abandonAfter := app.Cfg.BatchDeadline() + time.Minute
 
-	// Connect to the database
-	app.DB, err = sql.Open("postgres", connString)
-	if err != nil {
-		return app, errors.Wrap(err, "database connection failed")
-	}
+	switch app.Cfg.Store {
+	case "memory":
+		// No database needed, products only live as long as the process
+		app.Store = model.NewMemoryStore()
+		app.Idempotency = model.NewMemoryIdempotencyStore(abandonAfter)
+		app.Keys = model.NewAPIKeyCache(model.NewMemoryAPIKeyStore(), app.Cfg.APIKeyCacheTTL)
+		app.Roles = model.NewRoleCache(model.NewMemoryRoleStore(), app.Cfg.RoleCacheTTL)
+	case "postgres":
+		err = app.connect()
+		if err != nil {
+			return app, err
+		}
 
-	// The first actual connection to the underlying datastore will be
-	// established lazily, when it's needed for the first time. If you want
-	// to check right away that the database is available and accessible
-	// (for example, check that you can establish a network connection and log
-	// in), use database.DB.Ping().
-	err = app.DB.Ping()
-	if err != nil {
-		return app, errors.Wrap(err, "error pinging database")
+		err = app.migrate()
+		if err != nil {
+			return app, err
+		}
+
+		// Our handlers talk to the database through the product store
+		store := model.NewPostgresStore(app.DB, app.Cfg.SQL.Timeout)
+		store.BatchTimeout = app.Cfg.SQL.BatchTimeout
+		app.Store = store
+		app.Idempotency = model.NewPostgresIdempotencyStore(app.DB, app.Cfg.SQL.Timeout, abandonAfter)
+		app.Keys = model.NewAPIKeyCache(model.NewPostgresAPIKeyStore(app.DB, app.Cfg.SQL.Timeout), app.Cfg.APIKeyCacheTTL)
+		app.Roles = model.NewRoleCache(model.NewPostgresRoleStore(app.DB, app.Cfg.SQL.Timeout), app.Cfg.RoleCacheTTL)
+	default:
+		return app, errors.Errorf("unknown store %q", app.Cfg.Store)
 	}
 
 	/**
@@ -127,6 +151,9 @@ func Initialize() (app App, err error) {
 	n.Use(negroni.NewRecovery())
 	n.Use(negroni.NewLogger())
 
+	// Tag each request with an id, error responses include it
+	n.Use(requestid.New())
+
 	// setup stats https://github.com/thoas/stats
 	app.Stats = stats.New()
 	n.Use(app.Stats)
@@ -139,6 +166,15 @@ func Initialize() (app App, err error) {
 	limiter := tollbooth.NewLimiter(50, time.Second)
 	n.Use(tollbooth_negroni.LimitHandler(limiter))
 
+	// Authentication, the admin API has its own token
+	if app.Cfg.Auth != "off" {
+		mw, err := app.authentication()
+		if err != nil {
+			return app, err
+		}
+		n.Use(mw)
+	}
+
 	n.UseHandler(app.Router)
 
 	/**
@@ -147,7 +183,7 @@ func Initialize() (app App, err error) {
 
 	app.Server = &http.Server{
 		Addr:           ":" + app.Cfg.Port,
-		Handler:        n, // pass in router
+		Handler:        deadline.Handler(n), // pass in router
 		ReadTimeout:    5 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		IdleTimeout:    120 * time.Second,
@@ -156,3 +192,104 @@ func Initialize() (app App, err error) {
 
 	return app, nil
 }
+
+// authentication returns the middleware that checks the credentials
+// listed in the AUTH setting.
+func (app *App) authentication() (negroni.Handler, error) {
+	var keys auth.KeyAuthenticator
+	var tokens *auth.TokenVerifier
+
+	for _, method := range strings.Split(app.Cfg.Auth, ",") {
+		switch strings.TrimSpace(method) {
+		case auth.MethodAPIKey:
+			if app.Cfg.AdminToken == "" {
+				log.Printf("%s - ADMIN_TOKEN not set, API keys can't be managed", app.Cfg.HostName)
+			}
+			keys = app.Keys
+		case auth.MethodJWT:
+			if app.Cfg.JWT.JWKS == "" {
+				return nil, errors.New("JWT_JWKS must be set to accept JWTs")
+			}
+			set, err := auth.NewKeySet(app.Cfg.JWT.JWKS, app.Cfg.JWT.RefreshJWKS)
+			if err != nil {
+				return nil, errors.Wrap(err, "loading JWKS failed")
+			}
+			tokens = &auth.TokenVerifier{
+				Keys:     set,
+				Issuer:   app.Cfg.JWT.Issuer,
+				Audience: app.Cfg.JWT.Audience,
+				Leeway:   app.Cfg.JWT.Leeway,
+			}
+		default:
+			return nil, errors.Errorf("unknown auth option %q", method)
+		}
+	}
+
+	return auth.New(keys, tokens, "/health", "/admin/"), nil
+}
+
+// connect opens and checks the connection to our Postgres database.
+func (app *App) connect() (err error) {
+	connString := "postgres://" + app.Cfg.SQL.User +
+		":" + app.Cfg.SQL.Password +
+		"@" + app.Cfg.SQL.Host +
+		":" + app.Cfg.SQL.Port +
+		"/" + app.Cfg.SQL.Database +
+		"?sslmode=disable"
+
+	// Connect to the database
+	app.DB, err = sql.Open("postgres", connString)
+	if err != nil {
+		return errors.Wrap(err, "database connection failed")
+	}
+
+	// The first actual connection to the underlying datastore will be
+	// established lazily, when it's needed for the first time. If you want
+	// to check right away that the database is available and accessible
+	// (for example, check that you can establish a network connection and log
+	// in), use database.DB.Ping().
+	err = app.DB.Ping()
+	if err != nil {
+		return errors.Wrap(err, "error pinging database")
+	}
+
+	return nil
+}
+
+// migrate brings the database schema up to date. Depending on the MIGRATE
+// setting we apply pending migrations (auto), refuse to start if there are
+// any (check), or leave the schema alone (off).
+func (app *App) migrate() error {
+	if app.Cfg.Migrate == "off" {
+		return nil
+	}
+
+	m, err := migrations.New(app.DB)
+	if err != nil {
+		return errors.Wrap(err, "loading migrations failed")
+	}
+
+	switch app.Cfg.Migrate {
+	case "auto":
+		done, err := m.Up()
+		if err != nil {
+			return errors.Wrap(err, "migration failed")
+		}
+		for _, mig := range done {
+			log.Printf("%s - Applied migration %04d_%s", app.Cfg.HostName, mig.Version, mig.Name)
+		}
+	case "check":
+		pending, err := m.Pending()
+		if err != nil {
+			return errors.Wrap(err, "migration check failed")
+		}
+		if len(pending) > 0 {
+			return errors.Errorf("database has %d pending migrations, starting with %04d_%s",
+				len(pending), pending[0].Version, pending[0].Name)
+		}
+	default:
+		return errors.Errorf("unknown migrate option %q", app.Cfg.Migrate)
+	}
+
+	return nil
+}
@@ -1,7 +1,12 @@
 package app
 
 import (
+	"context"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/dstroot/postgres-api/models"
 )
 
 func TestInitialize(t *testing.T) {
@@ -15,3 +20,154 @@ func TestInitialize(t *testing.T) {
 		t.Errorf("Expected error to be nil. Got '%s'", err)
 	}
 }
+
+func TestInitializeMemory(t *testing.T) {
+
+	// This test selects the in-memory store and ensures the app
+	// initializes without a database.
+	defer os.Setenv("STORE", os.Getenv("STORE"))
+	os.Setenv("STORE", "memory")
+
+	app, err := Initialize()
+	if err != nil {
+		t.Errorf("Expected error to be nil. Got '%s'", err)
+	}
+
+	if app.DB != nil {
+		t.Errorf("Expected no database connection. Got %v", app.DB)
+	}
+
+	if _, ok := app.Store.(*model.MemoryStore); !ok {
+		t.Errorf("Expected a memory store. Got %T", app.Store)
+	}
+}
+
+func TestInitializeUnknownStore(t *testing.T) {
+
+	// This test ensures an unknown store is rejected.
+	defer os.Setenv("STORE", os.Getenv("STORE"))
+	os.Setenv("STORE", "floppy")
+
+	_, err := Initialize()
+	if err == nil {
+		t.Errorf("Expected an error for an unknown store")
+	}
+}
+
+func TestInitializeAuth(t *testing.T) {
+
+	// This test ensures bad auth settings are rejected.
+	defer os.Setenv("STORE", os.Getenv("STORE"))
+	os.Setenv("STORE", "memory")
+	defer os.Setenv("AUTH", os.Getenv("AUTH"))
+	defer os.Setenv("JWT_JWKS", os.Getenv("JWT_JWKS"))
+	os.Setenv("JWT_JWKS", "")
+
+	for _, setting := range []string{"apikey,jwt", "password"} {
+		os.Setenv("AUTH", setting)
+		if _, err := Initialize(); err == nil {
+			t.Errorf("%s: expected an error", setting)
+		}
+	}
+
+	os.Setenv("AUTH", "off")
+	if _, err := Initialize(); err != nil {
+		t.Errorf("Expected error to be nil. Got '%s'", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+
+	// This test trashes products and checks only those older than the
+	// retention are purged.
+	ctx := context.Background()
+	app := App{Store: model.NewMemoryStore()}
+	app.Cfg.PurgeAfter = time.Hour
+
+	for i := 0; i < 3; i++ {
+		app.Store.Create(ctx, &model.Product{Name: "product"})
+	}
+	app.Store.Delete(ctx, 1, 0)
+
+	if n, err := app.purge(ctx); err != nil || n != 0 {
+		t.Errorf("Expected nothing to be purged yet. Got %v (%v)", n, err)
+	}
+
+	app.Cfg.PurgeAfter = -time.Hour
+	if n, err := app.purge(ctx); err != nil || n != 1 {
+		t.Errorf("Expected 1 product to be purged. Got %v (%v)", n, err)
+	}
+
+	if _, err := app.Store.Restore(ctx, 1); err != model.ErrNotFound {
+		t.Errorf("Expected the purged product to be gone. Got %v", err)
+	}
+
+	// the job returns once its context is done
+	app.Cfg.PurgeInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		app.Purge(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the purge job to stop")
+	}
+}
+
+func TestSettings(t *testing.T) {
+
+	// This test checks secrets are masked and each setting says where
+	// its value came from.
+	defer os.Setenv("PORT", os.Getenv("PORT"))
+	os.Setenv("PORT", "9000")
+	defer os.Setenv("SQL_USER", os.Getenv("SQL_USER"))
+	os.Setenv("SQL_USER", "me")
+	if timeout, ok := os.LookupEnv("SQL_TIMEOUT"); ok {
+		defer os.Setenv("SQL_TIMEOUT", timeout)
+	}
+	os.Unsetenv("SQL_TIMEOUT")
+
+	var cfg config
+	cfg.HostName = "box"
+	cfg.Port = "9000"
+	cfg.SQL.User = "me"
+	cfg.SQL.Password = "hunter2"
+	cfg.SQL.Timeout = 5 * time.Second
+
+	settings := map[string]Setting{}
+	for _, s := range cfg.settings(map[string]string{"PORT": "8000", "SQL_USER": "me"}) {
+		settings[s.Name] = s
+	}
+
+	for name, expected := range map[string]Setting{
+		"HostName":    {"HostName", "box", SourceSystem},
+		"PORT":        {"PORT", "9000", SourceEnvironment},
+		"SQL_USER":    {"SQL_USER", "me", SourceDotEnv},
+		"SQL_TIMEOUT": {"SQL_TIMEOUT", "5s", SourceDefault},
+	} {
+		if settings[name] != expected {
+			t.Errorf("Expected %+v. Got %+v", expected, settings[name])
+		}
+	}
+	if s := settings["SQL_PASSWORD"]; s.Value != mask {
+		t.Errorf("Expected the password to be masked. Got %+v", s)
+	}
+	if s := settings["CURSOR_SECRET"]; s.Value != "" {
+		t.Errorf("Expected an unset secret to be empty. Got %+v", s)
+	}
+
+	for _, c := range []struct{ value, secret, expected string }{
+		{"hunter2", "true", mask},
+		{"", "true", ""},
+		{"hunter2", "", "hunter2"},
+	} {
+		if v := redact(c.value, c.secret); v != c.expected {
+			t.Errorf("%s: expected %s. Got %s", c.value, c.expected, v)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// config holds the system configuration. Values that must not be shown
+// are tagged secret:"true".
+type config struct {
+	HostName string
+	Debug    bool   `env:"DEBUG,default=true"`
+	Port     string `env:"PORT,default=8000"`
+	Store    string `env:"STORE,default=postgres"` // postgres or memory
+	Migrate  string `env:"MIGRATE,default=auto"`   // auto, check or off
+
+	// CursorSecret signs pagination cursors. Replicas behind the same
+	// load balancer must share it.
+	CursorSecret string `env:"CURSOR_SECRET" secret:"true"`
+
+	// AdminToken is the bearer token for the /admin endpoints, which
+	// are turned off when it isn't set.
+	AdminToken string `env:"ADMIN_TOKEN" secret:"true"`
+
+	// Auth lists the credentials needed for everything but /health and
+	// the admin API: apikey, jwt or both, separated by a comma, or off.
+	// Keys are cached for APIKeyCacheTTL, so a key revoked on another
+	// replica works here until then.
+	Auth           string        `env:"AUTH,default=apikey"`
+	APIKeyCacheTTL time.Duration `env:"API_KEY_CACHE_TTL,default=1m"`
+
+	// Authenticated clients need a role for what they do. Each client's
+	// permissions are cached for RoleCacheTTL.
+	RoleCacheTTL time.Duration `env:"ROLE_CACHE_TTL,default=1m"`
+
+	// JWTs are checked against the keys in the JWKS file or URL, loaded
+	// again every RefreshJWKS. Issuer and Audience are only checked if
+	// they are set.
+	JWT struct {
+		JWKS        string        `env:"JWT_JWKS"`
+		RefreshJWKS time.Duration `env:"JWT_JWKS_REFRESH,default=1h"`
+		Issuer      string        `env:"JWT_ISSUER"`
+		Audience    string        `env:"JWT_AUDIENCE"`
+		Leeway      time.Duration `env:"JWT_LEEWAY,default=30s"`
+	}
+
+	// Deleted products are purged for good once they have been in the
+	// trash for PurgeAfter, checked every PurgeInterval. Zero turns
+	// purging off.
+	PurgeAfter    time.Duration `env:"PURGE_AFTER,default=720h"`
+	PurgeInterval time.Duration `env:"PURGE_INTERVAL,default=1h"`
+
+	// Responses to requests made with an Idempotency-Key are replayed
+	// to retries for IdempotencyTTL. Expired keys are deleted by the
+	// purge job.
+	IdempotencyTTL time.Duration `env:"IDEMPOTENCY_TTL,default=24h"`
+
+	SQL struct {
+		Host     string `env:"SQL_HOST,default=localhost"`
+		Port     string `env:"SQL_PORT,default=5432"`
+		User     string `env:"SQL_USER,default=postgres"`
+		Password string `env:"SQL_PASSWORD,default=mysecretpassword" secret:"true"`
+		Database string `env:"SQL_DATABASE,default=products"`
+
+		// Timeout bounds each query, it should be shorter than the
+		// server's WriteTimeout so we can still send a response.
+		Timeout time.Duration `env:"SQL_TIMEOUT,default=5s"`
+
+		// BatchTimeout bounds a bulk request or an import, which run in
+		// one transaction however many products they have. Their routes
+		// get a minute more to read the request and respond. Zero means
+		// Timeout applies.
+		BatchTimeout time.Duration `env:"SQL_BATCH_TIMEOUT,default=2m"`
+	}
+}
+
+// BatchDeadline is how long the bulk and import routes may take: the
+// batch transaction and a minute to read the request and respond.
+func (c config) BatchDeadline() time.Duration {
+	return c.SQL.BatchTimeout + time.Minute
+}
+
+// mask replaces secret values.
+const mask = "********"
+
+// Where a setting came from.
+const (
+	SourceDefault     = "default"
+	SourceDotEnv      = ".env"
+	SourceEnvironment = "environment"
+	SourceSystem      = "system" // worked out at startup, like HostName
+)
+
+// Setting is one configuration value, with secrets masked, as reported by
+// the admin API.
+type Setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// settings lists the configuration in the order it is declared. Settings
+// read from the environment are named by their variable, others by their
+// field. dotenv holds the variables in the .env file, which are only
+// loaded when the environment doesn't already set them.
+func (c config) settings(dotenv map[string]string) []Setting {
+	return appendSettings(nil, reflect.ValueOf(c), dotenv)
+}
+
+func appendSettings(settings []Setting, v reflect.Value, dotenv map[string]string) []Setting {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, value := t.Field(i), v.Field(i)
+		if f.Type.Kind() == reflect.Struct {
+			settings = appendSettings(settings, value, dotenv)
+			continue
+		}
+
+		s := Setting{Name: f.Name, Value: fmt.Sprint(value.Interface()), Source: SourceSystem}
+		if name := strings.Split(f.Tag.Get("env"), ",")[0]; name != "" {
+			s.Name, s.Source = name, source(name, dotenv)
+		}
+		s.Value = redact(s.Value, f.Tag.Get("secret"))
+
+		settings = append(settings, s)
+	}
+
+	return settings
+}
+
+// source tells where the environment variable name got its value.
+func source(name string, dotenv map[string]string) string {
+	v, ok := os.LookupEnv(name)
+	switch {
+	case !ok:
+		return SourceDefault
+	case dotenv[name] == v:
+		return SourceDotEnv
+	default:
+		return SourceEnvironment
+	}
+}
+
+// redact masks value if it has a secret tag. Empty values are left alone
+// so that it shows when a secret isn't set.
+func redact(value, secret string) string {
+	if value == "" || secret == "" {
+		return value
+	}
+
+	return mask
+}
+
+// readDotEnv returns the variables in the .env file, which godotenv's
+// autoload has already loaded, or nothing if there isn't one.
+func readDotEnv() map[string]string {
+	dotenv, err := godotenv.Read()
+	if err != nil {
+		return nil
+	}
+
+	return dotenv
+}
@@ -0,0 +1,80 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package app
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Purge runs the purge job until ctx is done. Every PURGE_INTERVAL it
+// permanently deletes the products that have been in the trash for longer
+// than PURGE_AFTER, and deletes expired idempotency keys. Every replica
+// can run it, purging twice is harmless.
+func (app *App) Purge(ctx context.Context) {
+	if app.Cfg.PurgeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(app.Cfg.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if app.Cfg.PurgeAfter > 0 {
+			app.purge(ctx)
+		}
+		if app.Idempotency != nil {
+			app.expireKeys(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purge runs the purge job once.
+func (app *App) purge(ctx context.Context) (int, error) {
+	n, err := app.Store.Purge(ctx, time.Now().Add(-app.Cfg.PurgeAfter))
+	switch {
+	case err != nil && ctx.Err() == nil:
+		log.Printf("%s - ERROR: purging deleted products: %+v", app.Cfg.HostName, err)
+	case n > 0:
+		log.Printf("%s - Purged %d deleted products", app.Cfg.HostName, n)
+	}
+
+	return n, err
+}
+
+// expireKeys deletes the expired idempotency keys once.
+func (app *App) expireKeys(ctx context.Context) (int, error) {
+	n, err := app.Idempotency.Expire(ctx)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("%s - ERROR: expiring idempotency keys: %+v", app.Cfg.HostName, err)
+	}
+
+	return n, err
+}
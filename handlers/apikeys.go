@@ -0,0 +1,187 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// NewAPIKey is a key as it is made, the only time the key itself is
+// shown.
+type NewAPIKey struct {
+	model.APIKey
+	Key string `json:"key"`
+}
+
+// keyRequest is the body of a request to create or rotate a key. The
+// durations are strings like "720h".
+type keyRequest struct {
+	Name      string `json:"name"`
+	ExpiresIn string `json:"expires_in"`
+	Grace     string `json:"grace"`
+}
+
+// ListAPIKeys responds with every API key, without the keys themselves.
+func ListAPIKeys(keys model.APIKeyStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		list, err := keys.List(r.Context())
+		if err != nil {
+			respondWithStoreError(w, r, err)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, list)
+	}
+}
+
+// CreateAPIKey makes a new API key with the name in the body, which
+// expires after expires_in if that is given. The response is the only
+// time the key is shown.
+func CreateAPIKey(keys model.APIKeyStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		req, expiresAt, ok := decodeKeyRequest(w, r, false)
+		if !ok {
+			return
+		}
+		if req.Name == "" {
+			respondWithError(w, r, http.StatusUnprocessableEntity, "name is required")
+			return
+		}
+
+		k, key, hash := model.NewAPIKey(req.Name, expiresAt)
+		if err := keys.Create(r.Context(), &k, hash); err != nil {
+			respondWithStoreError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Location", "/admin/keys/"+strconv.Itoa(k.ID))
+		respondWithJSON(w, http.StatusCreated, NewAPIKey{APIKey: k, Key: key})
+	}
+}
+
+// RotateAPIKey replaces the API key with the id in the URL with a new
+// one, which expires after expires_in if that is given. The old key keeps
+// working for the grace period in the body, so that clients can switch
+// over, and by default stops at once.
+func RotateAPIKey(keys model.APIKeyStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		id, err := strconv.Atoi(param.ByName("id"))
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, "Invalid API key ID")
+			return
+		}
+
+		req, expiresAt, ok := decodeKeyRequest(w, r, true)
+		if !ok {
+			return
+		}
+		grace, err := parseDuration(req.Grace)
+		if err != nil || grace < 0 {
+			respondWithError(w, r, http.StatusUnprocessableEntity, "grace must be a duration like 1h")
+			return
+		}
+
+		k, key, hash := model.NewAPIKey("", expiresAt)
+		if _, err := keys.Rotate(r.Context(), id, &k, hash, grace); err != nil {
+			switch err {
+			case model.ErrAPIKeyNotFound:
+				respondWithError(w, r, http.StatusNotFound, "API key not found, or expired or revoked")
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		w.Header().Set("Location", "/admin/keys/"+strconv.Itoa(k.ID))
+		respondWithJSON(w, http.StatusCreated, NewAPIKey{APIKey: k, Key: key})
+	}
+}
+
+// RevokeAPIKey stops the API key with the id in the URL from working, and
+// responds with it.
+func RevokeAPIKey(keys model.APIKeyStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		id, err := strconv.Atoi(param.ByName("id"))
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, "Invalid API key ID")
+			return
+		}
+
+		k, err := keys.Revoke(r.Context(), id)
+		if err != nil {
+			switch err {
+			case model.ErrAPIKeyNotFound:
+				respondWithError(w, r, http.StatusNotFound, "API key not found")
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, k)
+	}
+}
+
+// decodeKeyRequest reads a key request from the body, which may be empty
+// if optional is set, and works out when the key expires. If the body
+// isn't a key request it responds with a 400, or a 422 for a bad
+// expires_in, and returns false.
+func decodeKeyRequest(w http.ResponseWriter, r *http.Request, optional bool) (req keyRequest, expiresAt *time.Time, ok bool) {
+	defer r.Body.Close()
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil && !(optional && err == io.EOF) {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid request payload")
+		return req, nil, false
+	}
+
+	expiresIn, err := parseDuration(req.ExpiresIn)
+	if err != nil || expiresIn < 0 {
+		respondWithError(w, r, http.StatusUnprocessableEntity, "expires_in must be a duration like 720h")
+		return req, nil, false
+	}
+	if expiresIn > 0 {
+		t := time.Now().Add(expiresIn)
+		expiresAt = &t
+	}
+
+	return req, expiresAt, true
+}
+
+// parseDuration parses an optional duration, "" is zero.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,54 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/dstroot/postgres-api/middleware/auth"
+	"github.com/julienschmidt/httprouter"
+)
+
+// AdminOnly wraps the handlers of the admin API, which are only for
+// clients presenting token as a bearer token. If token is empty the admin
+// API is turned off and its routes answer 404.
+func AdminOnly(token string) func(httprouter.Handle) httprouter.Handle {
+	return func(next httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+			if token == "" {
+				respondWithError(w, r, http.StatusNotFound, "Not found")
+				return
+			}
+
+			presented, ok := auth.BearerToken(r)
+			if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				respondWithError(w, r, http.StatusUnauthorized, "A valid admin token is required")
+				return
+			}
+
+			next(w, r, param)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/dstroot/postgres-api/middleware/requestid"
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// maxBulkOps limits the number of operations in one bulk request.
+const maxBulkOps = 10000
+
+// maxBatchBody limits the size of the body of a bulk request or import.
+const maxBatchBody = 32 << 20
+
+// Media types for newline delimited JSON, one value per line.
+var ndjsonTypes = map[string]bool{
+	"application/x-ndjson": true,
+	"application/ndjson":   true,
+}
+
+// bulkOp is one operation of a bulk request as sent by the client.
+type bulkOp struct {
+	Op      string          `json:"op"`
+	ID      int             `json:"id,omitempty"`
+	Product json.RawMessage `json:"product,omitempty"`
+}
+
+// BulkItem reports the outcome of one operation of a bulk request. Status
+// is the status code the operation would have got as a request of its
+// own.
+type BulkItem struct {
+	Index   int                `json:"index"`
+	Op      string             `json:"op"`
+	ID      int                `json:"id,omitempty"`
+	Status  int                `json:"status"`
+	Product *model.Product     `json:"product,omitempty"`
+	Detail  string             `json:"detail,omitempty"`
+	Errors  []model.FieldError `json:"errors,omitempty"`
+}
+
+// BulkReport is the response to a bulk request.
+type BulkReport struct {
+	Succeeded int        `json:"succeeded"`
+	Failed    int        `json:"failed"`
+	Items     []BulkItem `json:"items"`
+}
+
+// BulkProducts creates, updates and deletes many products in one request.
+// The body is a JSON array of operations, or with a Content-Type of
+// application/x-ndjson one operation per line:
+//
+//	{"op":"create","product":{"name":"a","price":1.99}}
+//	{"op":"update","id":3,"product":{"name":"b","price":2.99}}
+//	{"op":"delete","id":4}
+//
+// With mode=atomic, the default, either every operation succeeds or none
+// are applied. If any fail it responds with a problem for the first
+// failure, listing the outcome of every operation in items; the rest are
+// reported with a 424. With mode=partial the operations that succeed are
+// applied regardless, and it responds with a BulkReport, with a 207 if
+// any operation failed.
+func BulkProducts(store model.ProductStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var atomic bool
+		switch r.URL.Query().Get("mode") {
+		case "", "atomic":
+			atomic = true
+		case "partial":
+		default:
+			respondWithError(w, r, http.StatusBadRequest, "mode must be atomic or partial")
+			return
+		}
+
+		ops, ok := decodeBulk(w, r)
+		if !ok {
+			return
+		}
+
+		// check every operation before running any
+		items := make([]BulkItem, len(ops))
+		var valid []model.BulkOp
+		var index []int
+		for i, op := range ops {
+			items[i] = BulkItem{Index: i, Op: op.Op, ID: op.ID}
+			p, ok := checkBulkOp(op, &items[i])
+			if ok {
+				valid = append(valid, model.BulkOp{Op: op.Op, Product: p})
+				index = append(index, i)
+			}
+		}
+
+		if atomic && len(valid) < len(ops) {
+			for _, i := range index {
+				items[i].Status, items[i].Detail = http.StatusFailedDependency, "Not applied, another operation failed"
+			}
+			respondWithBulkProblem(w, r, items)
+			return
+		}
+
+		results, err := store.Bulk(r.Context(), valid, atomic)
+		if err != nil {
+			respondWithStoreError(w, r, err)
+			return
+		}
+
+		for k, result := range results {
+			item := &items[index[k]]
+			item.Status, item.Detail = bulkStatus(r, item.Op, result.Err)
+			if result.Err == nil && item.Op != model.BulkDelete {
+				p := result.Product
+				item.Product = &p
+			}
+			item.ID = result.Product.ID
+		}
+
+		report := BulkReport{Items: items}
+		for _, item := range items {
+			if item.Status < 300 {
+				report.Succeeded++
+			} else {
+				report.Failed++
+			}
+		}
+
+		switch {
+		case report.Failed == 0:
+			respondWithJSON(w, http.StatusOK, report)
+		case atomic:
+			respondWithBulkProblem(w, r, items)
+		default:
+			respondWithJSON(w, http.StatusMultiStatus, report)
+		}
+	}
+}
+
+// decodeBulk reads the operations in the request body. If the body isn't
+// a list of operations it responds with a 400, a 413 if there are too
+// many or the body is too large, or a 415 if it isn't JSON or NDJSON,
+// and returns false.
+func decodeBulk(w http.ResponseWriter, r *http.Request) ([]bulkOp, bool) {
+	defer r.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ndjson := ndjsonTypes[mediaType]
+	if !ndjson && mediaType != "" && mediaType != "application/json" {
+		respondWithError(w, r, http.StatusUnsupportedMediaType,
+			"Content-Type must be application/json or application/x-ndjson")
+		return nil, false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody))
+	if !ndjson {
+		if t, err := decoder.Token(); err != nil || t != json.Delim('[') {
+			respondWithBodyError(w, r, err, maxBatchBody, "Invalid request payload, expected an array of operations")
+			return nil, false
+		}
+	}
+
+	var ops []bulkOp
+	for decoder.More() {
+		if len(ops) == maxBulkOps {
+			respondWithError(w, r, http.StatusRequestEntityTooLarge,
+				"Too many operations, the limit is "+strconv.Itoa(maxBulkOps))
+			return nil, false
+		}
+
+		var op bulkOp
+		if err := decoder.Decode(&op); err != nil {
+			respondWithBodyError(w, r, err, maxBatchBody,
+				"Invalid request payload, operation "+strconv.Itoa(len(ops))+" is not valid JSON")
+			return nil, false
+		}
+		ops = append(ops, op)
+	}
+
+	if !ndjson {
+		if _, err := decoder.Token(); err != nil {
+			respondWithBodyError(w, r, err, maxBatchBody, "Invalid request payload")
+			return nil, false
+		}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		respondWithBodyError(w, r, err, maxBatchBody, "Invalid request payload, unexpected data after the operations")
+		return nil, false
+	}
+
+	return ops, true
+}
+
+// checkBulkOp checks an operation and decodes and validates its product.
+// If the operation isn't valid it sets the item's status and returns
+// false.
+func checkBulkOp(op bulkOp, item *BulkItem) (p model.Product, ok bool) {
+	fail := func(status int, detail string) (model.Product, bool) {
+		item.Status, item.Detail = status, detail
+		return p, false
+	}
+
+	switch op.Op {
+	case model.BulkCreate:
+		if op.ID != 0 {
+			return fail(http.StatusBadRequest, "A product to create can't have an id")
+		}
+	case model.BulkUpdate, model.BulkDelete:
+		if op.ID <= 0 {
+			return fail(http.StatusBadRequest, "Invalid product ID")
+		}
+	default:
+		return fail(http.StatusBadRequest, "Unknown op, must be create, update or delete")
+	}
+
+	if op.Op == model.BulkDelete {
+		if len(op.Product) > 0 {
+			return fail(http.StatusBadRequest, "A delete can't have a product")
+		}
+		return model.Product{ID: op.ID}, true
+	}
+
+	if len(op.Product) == 0 {
+		return fail(http.StatusBadRequest, "Missing product")
+	}
+	violations, err := readProduct(bytes.NewReader(op.Product), &p)
+	if err != nil {
+		return fail(http.StatusBadRequest, "Invalid product")
+	}
+	if len(violations) > 0 {
+		item.Errors = violations
+		return fail(http.StatusUnprocessableEntity, "Product failed validation")
+	}
+	p.ID = op.ID
+
+	return p, true
+}
+
+// bulkStatus maps the result of an operation to the status code and
+// detail it would have got as a request of its own.
+func bulkStatus(r *http.Request, op string, err error) (int, string) {
+	switch err {
+	case nil:
+		if op == model.BulkCreate {
+			return http.StatusCreated, ""
+		}
+		return http.StatusOK, ""
+	case model.ErrNotFound:
+		return http.StatusNotFound, "Product not found"
+	case model.ErrVersionMismatch:
+		return http.StatusPreconditionFailed, errPreconditionFailed
+	case model.ErrDuplicateSKU:
+		return http.StatusConflict, "Another product has this SKU"
+	case model.ErrBulkAborted:
+		return http.StatusFailedDependency, "Not applied, another operation failed"
+	}
+
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok {
+		if code, detail, ok := sqlState(pqErr); ok {
+			return code, detail
+		}
+	}
+
+	log.Printf("ERROR: request %s %s %s: %+v",
+		requestid.FromContext(r.Context()), r.Method, r.URL.Path, err)
+	return http.StatusInternalServerError, "An internal error occurred"
+}
+
+// respondWithBulkProblem responds to a failed all-or-nothing bulk request
+// with a problem for its first failed operation, listing the outcome of
+// every operation.
+func respondWithBulkProblem(w http.ResponseWriter, r *http.Request, items []BulkItem) {
+	var p Problem
+	for _, item := range items {
+		if item.Status >= 300 && item.Status != http.StatusFailedDependency {
+			p = NewProblem(r, item.Status, "Nothing was applied, operation "+strconv.Itoa(item.Index)+
+				" failed: "+item.Detail)
+			break
+		}
+	}
+	p.Items = items
+
+	respondWithProblem(w, p)
+}
@@ -0,0 +1,150 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/pkg/errors"
+)
+
+// Cursors are handed to clients as opaque tokens: the base64 encoded JSON
+// of a model.Cursor followed by an HMAC-SHA256 signature, so a client
+// can't forge a position or tamper with the sort it was issued for.
+
+// errCursor is returned for any cursor we can't accept.
+var errCursor = errors.New("Invalid cursor")
+
+// encodeCursor signs c with secret and returns the token.
+func encodeCursor(c model.Cursor, secret []byte) string {
+	payload, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(sign(payload, secret))
+}
+
+// decodeCursor checks the signature on token and returns its cursor.
+func decodeCursor(token string, secret []byte) (*model.Cursor, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errCursor
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, sign(payload, secret)) {
+		return nil, errCursor
+	}
+
+	var c model.Cursor
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, errCursor
+	}
+
+	return &c, nil
+}
+
+// sign returns the HMAC-SHA256 of payload.
+func sign(payload, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// filterKey returns a canonical string for the filters in the querystring
+// so a cursor can be tied to the listing it came from.
+func filterKey(values url.Values) string {
+	filters := url.Values{}
+	for _, key := range []string{"name", "name_prefix", "min_price", "max_price", "updated_since", "include", "only"} {
+		if v := values.Get(key); v != "" {
+			filters.Set(key, v)
+		}
+	}
+
+	return filters.Encode()
+}
+
+// applyCursor positions q at the cursor in the querystring, if there is
+// one. The cursor must have been issued for the same filters and, if the
+// request names a sort, the same sort.
+func applyCursor(q *model.Query, values url.Values, secret []byte) error {
+	token := values.Get("cursor")
+	if token == "" {
+		return nil
+	}
+
+	c, err := decodeCursor(token, secret)
+	if err != nil {
+		return err
+	}
+
+	if c.Filter != filterKey(values) || values.Get("sort") != "" && !model.SameSort(c.Sort, q.Sort) {
+		return errors.New("Cursor does not match the query")
+	}
+
+	q.Sort = c.Sort
+	q.Cursor = c
+	q.Start = 0
+
+	return nil
+}
+
+// paginate trims the extra product fetched to find out whether there is
+// another page and returns the page with cursors for the pages either side
+// of it. A cursor is nil when there is no such page.
+func paginate(products []model.Product, q model.Query, count int, filter string) (page []model.Product, next, prev *model.Cursor) {
+	before := q.Cursor != nil && q.Cursor.Before
+	more := len(products) > count
+	if more {
+		if before {
+			// paging backwards the extra product is the earliest one
+			products = products[len(products)-count:]
+		} else {
+			products = products[:count]
+		}
+	}
+
+	if len(products) == 0 {
+		return products, nil, nil
+	}
+
+	if more && !before || before {
+		c := model.NewCursor(products[len(products)-1], q.Sort, false, filter)
+		next = &c
+	}
+	if more && before || !before && (q.Cursor != nil || q.Start > 0) {
+		c := model.NewCursor(products[0], q.Sort, true, filter)
+		prev = &c
+	}
+
+	return products, next, prev
+}
@@ -0,0 +1,114 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dstroot/postgres-api/models"
+)
+
+// errPreconditionFailed is the detail of a 412 response.
+const errPreconditionFailed = "Product has been modified"
+
+// etag returns the strong entity tag of a product, its quoted version.
+func etag(p model.Product) string {
+	return `"` + strconv.Itoa(p.Version) + `"`
+}
+
+// bodyETag returns a weak entity tag for a JSON payload, a hash of its
+// encoding. It's weak because it says nothing about the stored products,
+// only that the response is the same.
+func bodyETag(payload interface{}) string {
+	body, _ := json.Marshal(payload)
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// matchETag reports whether the comma separated list of entity tags in
+// header matches tag. "*" matches any tag. With strong set the RFC 7232
+// strong comparison is used, where weak tags never match, otherwise the
+// weak comparison.
+func matchETag(header, tag string, strong bool) bool {
+	if strong && strings.HasPrefix(tag, "W/") {
+		return false
+	}
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		switch {
+		case t == "*":
+			return true
+		case strong && strings.HasPrefix(t, "W/"):
+			continue
+		case strings.TrimPrefix(t, "W/") == strings.TrimPrefix(tag, "W/"):
+			return true
+		}
+	}
+
+	return false
+}
+
+// ifMatch reports whether the If-Match precondition of r holds for p. It
+// holds if there is no If-Match header.
+func ifMatch(r *http.Request, p model.Product) bool {
+	header := r.Header.Get("If-Match")
+	return header == "" || matchETag(header, etag(p), true)
+}
+
+// expectedVersion returns the version a request with an If-Match header
+// expects the product with the given id to be at, to make the change
+// conditional on it, or 0 if there is no If-Match header. It returns
+// ErrVersionMismatch if the product doesn't match, including when it
+// doesn't exist at all.
+func expectedVersion(r *http.Request, store model.ProductStore, id int) (int, error) {
+	if r.Header.Get("If-Match") == "" {
+		return 0, nil
+	}
+
+	p, err := store.Get(r.Context(), id)
+	if err == model.ErrNotFound || (err == nil && !ifMatch(r, p)) {
+		return 0, model.ErrVersionMismatch
+	}
+
+	return p.Version, err
+}
+
+// respondWithTaggedJSON responds with payload and its entity tag, or with
+// a 304 and no body if the If-None-Match header of r says the client has
+// it already.
+func respondWithTaggedJSON(w http.ResponseWriter, r *http.Request, payload interface{}, tag string) {
+	w.Header().Set("ETag", tag)
+
+	if header := r.Header.Get("If-None-Match"); header != "" && matchETag(header, tag, false) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, payload)
+}
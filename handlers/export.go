@@ -0,0 +1,232 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstroot/postgres-api/middleware/deadline"
+	"github.com/dstroot/postgres-api/middleware/requestid"
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Export formats and their media types.
+var exportTypes = map[string]string{
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv",
+}
+
+// exportFormats maps the media types a client can accept to a format.
+var exportFormats = map[string]string{
+	"application/x-ndjson": "ndjson",
+	"application/ndjson":   "ndjson",
+	"application/json":     "ndjson",
+	"text/csv":             "csv",
+	"*/*":                  "ndjson",
+	"application/*":        "ndjson",
+	"text/*":               "csv",
+}
+
+// csvHeader is the first row of a CSV export.
+var csvHeader = []string{"id", "sku", "name", "price", "currency", "created_at", "updated_at", "deleted_at"}
+
+// exportFlush is how many products are written between flushes.
+const exportFlush = 100
+
+// exportWriteTimeout is how long an export has to write the products
+// between flushes. It replaces the server's write timeout, which is too
+// short for a whole catalogue.
+const exportWriteTimeout = 30 * time.Second
+
+// ExportProducts streams every product matching the same filters and sort
+// as GetProducts, as NDJSON (one product per line) or as CSV. The format
+// is chosen with format=ndjson or format=csv, or else from the Accept
+// header, and defaults to NDJSON. Paging parameters are ignored.
+//
+// Products are written as they are read from the store and flushed every
+// so often, so memory use doesn't grow with the catalogue and clients can
+// start processing straight away. Once streaming has started errors can
+// no longer be reported with a status code, so they are logged and the
+// response is cut short. Each flush gives the export another
+// exportWriteTimeout, so it only times out if the client stops reading.
+//
+// Text cells of a CSV export that a spreadsheet would take for a formula
+// are prefixed with a quote.
+func ExportProducts(store model.ProductStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		values := r.URL.Query()
+		q, err := parseQuery(values)
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		format := values.Get("format")
+		switch {
+		case format == "":
+			if format = negotiate(r.Header.Get("Accept"), exportFormats); format == "" {
+				respondWithError(w, r, http.StatusNotAcceptable, "Export is available as application/x-ndjson or text/csv")
+				return
+			}
+		case exportTypes[format] == "":
+			respondWithError(w, r, http.StatusBadRequest, "format must be ndjson or csv")
+			return
+		}
+
+		w.Header().Set("Content-Type", exportTypes[format])
+		w.Header().Set("Content-Disposition", `attachment; filename="products.`+format+`"`)
+		w.Header().Add("Vary", "Accept")
+
+		var write func(p model.Product) error
+		var flush func() error
+		if format == "csv" {
+			cw := csv.NewWriter(w)
+			cw.Write(csvHeader)
+			write = func(p model.Product) error { return cw.Write(csvRecord(p)) }
+			flush = func() error { cw.Flush(); return cw.Error() }
+		} else {
+			encoder := json.NewEncoder(w)
+			write = func(p model.Product) error { return encoder.Encode(p) }
+			flush = func() error { return nil }
+		}
+
+		// ErrNotSupported means the server wasn't set up with
+		// deadline.Handler, and has no write timeout we could extend
+		deadline.Extend(r, exportWriteTimeout)
+
+		n := 0
+		err = store.Export(r.Context(), q, func(p model.Product) error {
+			if err := write(p); err != nil {
+				return err
+			}
+			if n++; n%exportFlush == 0 {
+				if err := flushExport(w, flush); err != nil {
+					return err
+				}
+				deadline.Extend(r, exportWriteTimeout)
+			}
+			return nil
+		})
+		if err == nil {
+			err = flushExport(w, flush)
+		}
+
+		if err != nil {
+			if n == 0 && r.Context().Err() == nil {
+				// nothing has been sent yet, so we can still say what
+				// went wrong
+				w.Header().Del("Content-Disposition")
+				respondWithStoreError(w, r, err)
+				return
+			}
+			log.Printf("ERROR: request %s %s %s: export cut short after %d products: %+v",
+				requestid.FromContext(r.Context()), r.Method, r.URL.Path, n, err)
+		}
+	}
+}
+
+// flushExport flushes the export's encoder and then the response, so
+// what has been written so far goes out to the client.
+func flushExport(w io.Writer, flush func() error) error {
+	if err := flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return nil
+}
+
+// negotiate picks a format from an Accept header, going by the q-values
+// of the media types, using formats to map media types to formats. An
+// empty header accepts anything. It returns "" if no format is
+// acceptable.
+func negotiate(accept string, formats map[string]string) string {
+	if strings.TrimSpace(accept) == "" {
+		return formats["*/*"]
+	}
+
+	format, best := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		if f, ok := formats[mediaType]; ok && q > best {
+			format, best = f, q
+		}
+	}
+
+	return format
+}
+
+// csvRecord formats a product as a row of a CSV export.
+func csvRecord(p model.Product) []string {
+	deleted := ""
+	if p.DeletedAt != nil {
+		deleted = p.DeletedAt.Format(time.RFC3339Nano)
+	}
+
+	return []string{
+		strconv.Itoa(p.ID),
+		csvText(p.SKU),
+		csvText(p.Name),
+		p.Price.String(),
+		p.Currency,
+		p.CreatedAt.Format(time.RFC3339Nano),
+		p.UpdatedAt.Format(time.RFC3339Nano),
+		deleted,
+	}
+}
+
+// csvText escapes text for a CSV cell. Spreadsheets run a cell starting
+// with =, +, - or @ as a formula, some after skipping a tab or carriage
+// return, so such a cell is prefixed with a quote to keep it text. That
+// way a product name can't run code when someone opens the export. A
+// cell that already starts with a quote gets another, so that the
+// escaping can be undone.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r'", rune(s[0])) {
+		return "'" + s
+	}
+
+	return s
+}
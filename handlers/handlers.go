@@ -25,140 +25,389 @@
 package handlers
 
 import (
-	"database/sql"
+	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/dstroot/postgres-api/models"
 	// Load environment vars
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/julienschmidt/httprouter"
-	// Postgres driver
-	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
 )
 
 // GetProduct retrieves the id of the product to be fetched from the requested
-// URL, and uses the getProduct method, created in the previous section, to
-// fetch the details of that product.
+// URL, and uses the store to fetch the details of that product.
 //
 // If the product is not found, the handler responds with a status code of 404,
 // indicating that the requested resource could not be found. If the product
-// is found, the handler responds with the product.
-func GetProduct(db *sql.DB) httprouter.Handle {
+// is found, the handler responds with the product and its version as the
+// ETag, or with a 304 if it matches If-None-Match.
+func GetProduct(store model.ProductStore) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
 		id, err := strconv.Atoi(param.ByName("id"))
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+			respondWithError(w, r, http.StatusBadRequest, "Invalid product ID")
 			return
 		}
 
-		p := model.Product{ID: id}
-		if err := p.Get(db); err != nil {
+		p, err := store.Get(r.Context(), id)
+		if err != nil {
 			switch err {
-			case sql.ErrNoRows:
-				respondWithError(w, http.StatusNotFound, "Product not found")
+			case model.ErrNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Product not found")
 			default:
-				respondWithError(w, http.StatusInternalServerError, err.Error())
+				respondWithStoreError(w, r, err)
 			}
 			return
 		}
 
-		respondWithJSON(w, http.StatusOK, p)
+		respondWithTaggedJSON(w, r, p, etag(p))
 	}
 }
 
 // GetProducts uses the count and start parameters from the querystring to
 // fetch count number of products, starting at position start in the database.
-// By default, start is set to 0 and count is set to 10. If these parameters
-// aren't provided, this handler will respond with the first 10 products.
-func GetProducts(db *sql.DB) httprouter.Handle {
+// By default, start is set to 0 and count is set to 50. If these parameters
+// aren't provided, this handler will respond with the first 50 products.
+//
+// The list can be filtered with name (a case-insensitive substring),
+// name_prefix, min_price, max_price and updated_since, and ordered with
+// sort, a comma separated list of columns each optionally followed by
+// :asc or :desc, e.g. sort=price:desc,name. Products are always ordered by
+// id last so paging is stable. Deleted products are left out,
+// include=deleted lists them along with the rest and only=deleted lists
+// just the trash.
+//
+// updated_since is an RFC 3339 time selecting the products changed since
+// then, for incremental syncs. Sync with sort=updated_at&include=deleted
+// to see deletes too, and start from a little before the newest
+// updated_at seen last time: it is the time the change's transaction
+// started, so a slow transaction can commit a change that looks older.
+//
+// Rather than counting with start, clients can page with the opaque
+// cursors returned in the X-Next-Cursor and X-Prev-Cursor headers by
+// passing them back as cursor. Cursors are signed with secret and keep
+// their place when products are added or removed. The Link header has
+// the URLs of the first, next and previous pages.
+//
+// The number of matching products is returned in X-Total-Count. With
+// total=estimate it is estimated from Postgres' statistics instead of
+// counted, which is much cheaper for big tables, and total=none skips it.
+// With envelope=true the products are wrapped in a Page along with the
+// total and paging links.
+//
+// The ETag is a hash of the response, so a client polling the list can
+// send it back in If-None-Match and get a 304 if nothing changed.
+func GetProducts(store model.ProductStore, secret []byte) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		queryValues := r.URL.Query()
-		count, _ := strconv.Atoi(queryValues.Get("count"))
-		start, _ := strconv.Atoi(queryValues.Get("start"))
-
-		if count > 50 || count < 1 {
-			count = 50
+		values := r.URL.Query()
+		q, err := parseQuery(values)
+		if err == nil {
+			err = applyCursor(&q, values, secret)
 		}
-		if start < 0 {
-			start = 0
+		envelope, total, err2 := parsePaging(values)
+		if err == nil {
+			err = err2
+		}
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, err.Error())
+			return
 		}
 
-		products, err := model.GetMany(db, start, count)
+		// fetch one extra product to find out if there's another page
+		count := q.Count
+		q.Count++
+
+		products, err := store.List(r.Context(), q)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+			respondWithStoreError(w, r, err)
 			return
 		}
 
-		respondWithJSON(w, http.StatusOK, products)
+		page := Page{Start: q.Start, Estimated: total == totalEstimate}
+		if total != totalNone {
+			n, err := store.Count(r.Context(), q, total == totalExact)
+			if err != nil {
+				respondWithStoreError(w, r, err)
+				return
+			}
+			page.Total = &n
+			w.Header().Set("X-Total-Count", strconv.Itoa(n))
+		}
+
+		products, next, prev := paginate(products, q, count, filterKey(values))
+		if next != nil {
+			token := encodeCursor(*next, secret)
+			w.Header().Set("X-Next-Cursor", token)
+			page.Next = pageURL(r, token)
+		}
+		if prev != nil {
+			token := encodeCursor(*prev, secret)
+			w.Header().Set("X-Prev-Cursor", token)
+			page.Prev = pageURL(r, token)
+		}
+		setLinks(w, pageURL(r, ""), page.Next, page.Prev)
+
+		if !envelope {
+			respondWithTaggedJSON(w, r, products, bodyETag(products))
+			return
+		}
+
+		page.Data = products
+		page.Count = len(products)
+		respondWithTaggedJSON(w, r, page, bodyETag(page))
 	}
 }
 
 // CreateProduct assumes that the request body is a JSON object containing the
 // details of the product to be created. It extracts that object into a product
-// and uses the createProduct method to create a product with these details.
-func CreateProduct(db *sql.DB) httprouter.Handle {
+// and uses the store to create a product with these details.
+func CreateProduct(store model.ProductStore) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		var p model.Product
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&p); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		if !decodeProduct(w, r, &p) {
 			return
 		}
-		defer r.Body.Close()
 
-		if err := p.Post(db); err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+		if err := store.Create(r.Context(), &p); err != nil {
+			respondWithStoreError(w, r, err)
 			return
 		}
 
+		w.Header().Set("ETag", etag(p))
 		respondWithJSON(w, http.StatusCreated, p)
 	}
 }
 
 // UpdateProduct extracts the product details from the request body. It also
 // extracts the id from the URL and uses the id and the body to update the
-// product in the database.
-func UpdateProduct(db *sql.DB) httprouter.Handle {
+// product in the database. It responds with the product as stored, or with
+// a 404 if there is no product with that id.
+//
+// With an If-Match header the product is only updated if its ETag still
+// matches, otherwise the handler responds with a 412. Clients should send
+// the ETag they got with the product so they don't overwrite changes made
+// by someone else in the meantime.
+func UpdateProduct(store model.ProductStore) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
 		id, err := strconv.Atoi(param.ByName("id"))
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+			respondWithError(w, r, http.StatusBadRequest, "Invalid product ID")
 			return
 		}
 
 		var p model.Product
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&p); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		if !decodeProduct(w, r, &p) {
 			return
 		}
-		defer r.Body.Close()
 		p.ID = id
 
-		if err := p.Put(db); err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+		p.Version, err = expectedVersion(r, store, id)
+		if err == nil {
+			err = store.Update(r.Context(), &p)
+		}
+		if err != nil {
+			switch err {
+			case model.ErrNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Product not found")
+			case model.ErrVersionMismatch:
+				respondWithError(w, r, http.StatusPreconditionFailed, errPreconditionFailed)
+			default:
+				respondWithStoreError(w, r, err)
+			}
 			return
 		}
 
+		w.Header().Set("ETag", etag(p))
 		respondWithJSON(w, http.StatusOK, p)
 	}
 }
 
-// DeleteProduct extracts the id from the requested URL and uses it to delete
-// the corresponding product from the database.
-func DeleteProduct(db *sql.DB) httprouter.Handle {
+// PatchProduct changes some of the fields of a product, leaving the rest
+// as they are. The body is either a JSON Merge Patch (RFC 7396) sent as
+// application/merge-patch+json, or a JSON Patch (RFC 6902) sent as
+// application/json-patch+json, applied to the product's JSON. The product
+// is read, patched and written back in one transaction.
+//
+// It responds with the patched product. Other media types get a 415, a
+// malformed patch a 400, and a patch that can't be applied or leaves the
+// product invalid a 422. A failed JSON Patch test operation is a 409, and
+// a failed If-Match a 412, as for UpdateProduct.
+func PatchProduct(store model.ProductStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		id, err := strconv.Atoi(param.ByName("id"))
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, "Invalid product ID")
+			return
+		}
+
+		apply, ok := decodePatch(w, r)
+		if !ok {
+			return
+		}
+
+		p, err := store.Patch(r.Context(), id, func(p *model.Product) error {
+			if !ifMatch(r, *p) {
+				return model.ErrVersionMismatch
+			}
+
+			doc, err := json.Marshal(p)
+			if err == nil {
+				doc, err = apply(doc)
+			}
+			if err != nil {
+				return patchError{err}
+			}
+
+			var patched model.Product
+			violations, err := readProduct(bytes.NewReader(doc), &patched)
+			if err != nil {
+				return patchError{errors.Wrap(err, "patched document is not a product")}
+			}
+			if patched.ID != p.ID {
+				violations = append(violations, model.FieldError{Field: "id", Rule: "readonly", Message: "cannot be changed"})
+			}
+			violations = append(violations, readonlyFields(*p, doc)...)
+			if len(violations) > 0 {
+				return violations
+			}
+
+			*p = patched
+			return nil
+		})
+
+		switch e := err.(type) {
+		case nil:
+			w.Header().Set("ETag", etag(p))
+			respondWithJSON(w, http.StatusOK, p)
+		case model.ValidationError:
+			respondWithValidationError(w, r, e)
+		case patchError:
+			if errors.Cause(e.error) == errTestFailed {
+				respondWithError(w, r, http.StatusConflict, e.Error())
+			} else {
+				respondWithError(w, r, http.StatusUnprocessableEntity, e.Error())
+			}
+		default:
+			switch {
+			case err == model.ErrNotFound && r.Header.Get("If-Match") != "":
+				respondWithError(w, r, http.StatusPreconditionFailed, errPreconditionFailed)
+			case err == model.ErrNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Product not found")
+			case err == model.ErrVersionMismatch:
+				respondWithError(w, r, http.StatusPreconditionFailed, errPreconditionFailed)
+			default:
+				respondWithStoreError(w, r, err)
+			}
+		}
+	}
+}
+
+// readonlyFields lists the timestamps of p that the patched document doc
+// changes, which only the store may do.
+func readonlyFields(p model.Product, doc []byte) model.ValidationError {
+	var before, after map[string]json.RawMessage
+	original, _ := json.Marshal(p)
+	json.Unmarshal(original, &before)
+	json.Unmarshal(doc, &after)
+
+	var violations model.ValidationError
+	for _, field := range []string{"created_at", "updated_at", "deleted_at"} {
+		if !bytes.Equal(before[field], after[field]) {
+			violations = append(violations, model.FieldError{Field: field, Rule: "readonly", Message: "cannot be changed"})
+		}
+	}
+
+	return violations
+}
+
+// decodePatch reads the patch in the request body and returns a function
+// applying it to a JSON document. If the media type isn't a patch type it
+// responds with a 415, and if the patch is malformed with a 400, and
+// returns false.
+func decodePatch(w http.ResponseWriter, r *http.Request) (func([]byte) ([]byte, error), bool) {
+	defer r.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType {
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		respondWithError(w, r, http.StatusUnsupportedMediaType,
+			"Content-Type must be "+mergePatchType+" or "+jsonPatchType)
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid request payload")
+		return nil, false
+	}
+
+	if mediaType == mergePatchType {
+		patch, err := decodeJSON(body)
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, "Invalid request payload")
+			return nil, false
+		}
+
+		return func(doc []byte) ([]byte, error) {
+			target, err := decodeJSON(doc)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(mergePatch(target, patch))
+		}, true
+	}
+
+	patch, err := parseJSONPatch(body)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	return func(doc []byte) ([]byte, error) {
+		target, err := decodeJSON(doc)
+		if err != nil {
+			return nil, err
+		}
+		if target, err = patch.Apply(target); err != nil {
+			return nil, err
+		}
+		return json.Marshal(target)
+	}, true
+}
+
+// DeleteProduct extracts the id from the requested URL and uses it to move
+// the corresponding product to the trash, from where it can be restored
+// until it is purged. If there is no product with that id it responds
+// with a 404. If-Match is honoured as for UpdateProduct.
+func DeleteProduct(store model.ProductStore) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
 		id, err := strconv.Atoi(param.ByName("id"))
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+			respondWithError(w, r, http.StatusBadRequest, "Invalid product ID")
 			return
 		}
 
-		p := model.Product{ID: id}
-		if err := p.Delete(db); err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+		version, err := expectedVersion(r, store, id)
+		if err == nil {
+			err = store.Delete(r.Context(), id, version)
+		}
+		if err != nil {
+			switch err {
+			case model.ErrNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Product not found")
+			case model.ErrVersionMismatch:
+				respondWithError(w, r, http.StatusPreconditionFailed, errPreconditionFailed)
+			default:
+				respondWithStoreError(w, r, err)
+			}
 			return
 		}
 
@@ -166,19 +415,150 @@ func DeleteProduct(db *sql.DB) httprouter.Handle {
 	}
 }
 
-// GetConfig extracts the id from the requested URL and uses it to delete
-// the corresponding product from the database.
-func GetConfig(s []byte) httprouter.Handle {
+// RestoreProduct takes the product with the id in the URL out of the
+// trash and responds with it. If there is no such product in the trash,
+// because it was never deleted or has been purged, it responds with a
+// 404.
+func RestoreProduct(store model.ProductStore) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		id, err := strconv.Atoi(param.ByName("id"))
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, "Invalid product ID")
+			return
+		}
+
+		p, err := store.Restore(r.Context(), id)
+		if err != nil {
+			switch err {
+			case model.ErrNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Deleted product not found")
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		w.Header().Set("ETag", etag(p))
+		respondWithJSON(w, http.StatusOK, p)
+	}
+}
+
+// GetConfig responds with the configuration settings, which should have
+// their secrets masked already.
+func GetConfig(settings interface{}) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		respondWithJSON(w, http.StatusOK, settings)
+	}
+}
 
-		// prettyCfg, _ := json.MarshalIndent(app.Cfg, "", "  ")
+// parseQuery builds a product query from the querystring. Bad paging
+// values are clamped to their defaults, bad filters and sort keys are
+// reported as errors.
+func parseQuery(values url.Values) (q model.Query, err error) {
+	q.Count, _ = strconv.Atoi(values.Get("count"))
+	q.Start, _ = strconv.Atoi(values.Get("start"))
 
-		w.Write(s)
+	if q.Count > 50 || q.Count < 1 {
+		q.Count = 50
 	}
+	if q.Start < 0 {
+		q.Start = 0
+	}
+
+	q.NameContains = values.Get("name")
+	q.NamePrefix = values.Get("name_prefix")
+
+	if q.MinPrice, err = parsePrice(values, "min_price"); err != nil {
+		return q, err
+	}
+	if q.MaxPrice, err = parsePrice(values, "max_price"); err != nil {
+		return q, err
+	}
+	if v := values.Get("updated_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, errors.Errorf("invalid updated_since %q, must be an RFC 3339 time", v)
+		}
+		q.UpdatedSince = &t
+	}
+
+	switch {
+	case values.Get("include") == "deleted" && values.Get("only") == "deleted":
+		return q, errors.New("include and only are mutually exclusive")
+	case values.Get("include") == "deleted":
+		q.Deleted = model.IncludeDeleted
+	case values.Get("only") == "deleted":
+		q.Deleted = model.OnlyDeleted
+	case values.Get("include") != "":
+		return q, errors.Errorf("invalid include %q", values.Get("include"))
+	case values.Get("only") != "":
+		return q, errors.Errorf("invalid only %q", values.Get("only"))
+	}
+
+	q.Sort, err = model.ParseSort(values.Get("sort"))
+
+	return q, err
 }
 
-func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+// parsePrice parses an optional price from the querystring.
+func parsePrice(values url.Values, key string) (*model.Money, error) {
+	if values.Get(key) == "" {
+		return nil, nil
+	}
+
+	m, err := model.ParseMoney(values.Get(key))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid "+key)
+	}
+
+	return &m, nil
+}
+
+// decodeProduct decodes and validates the product in the request body. If
+// the body isn't a valid product it responds with a 400 for bad JSON or
+// unknown fields, or a 422 listing every validation failure, and returns
+// false.
+func decodeProduct(w http.ResponseWriter, r *http.Request, p *model.Product) bool {
+	defer r.Body.Close()
+
+	violations, err := readProduct(r.Body, p)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid request payload")
+		return false
+	}
+
+	if len(violations) > 0 {
+		respondWithValidationError(w, r, violations)
+		return false
+	}
+
+	return true
+}
+
+// readProduct decodes the product JSON in body into p, fills in its
+// defaults and validates it. The timestamps belong to the store, so any
+// the client sent are dropped. It returns an error if body isn't a
+// product at all, or the validation failures.
+func readProduct(body io.Reader, p *model.Product) (model.ValidationError, error) {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(p)
+	p.CreatedAt, p.UpdatedAt, p.DeletedAt = time.Time{}, time.Time{}, nil
+
+	// A price that Money can't hold exactly is a validation failure like
+	// any other, the decoder carries on with the remaining fields.
+	moneyErr, badPrice := err.(*model.MoneyError)
+	if err != nil && !badPrice {
+		return nil, err
+	}
+
+	p.SetDefaults()
+	violations, _ := p.Validate().(model.ValidationError)
+	if badPrice {
+		violations = append(violations, model.FieldError{Field: "price", Rule: "scale", Message: moneyErr.Reason})
+	}
+
+	return violations, nil
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
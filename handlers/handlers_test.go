@@ -2,36 +2,266 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dstroot/postgres-api/app"
+	"github.com/dstroot/postgres-api/middleware/auth"
+	"github.com/dstroot/postgres-api/middleware/requestid"
 	model "github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 )
 
 // https://elithrar.github.io/article/testing-http-handlers-go/
 // https://www.thepolyglotdeveloper.com/2017/02/unit-testing-golang-application-includes-http/
 
-// initialize will return an initialized app
+// errClosed is returned by the broken store
+var errClosed = errors.New("store is closed")
+
+// initialize will return an initialized app using an empty in-memory store
 func initialize() (a app.App) {
+	os.Setenv("STORE", "memory")
+
 	var err error
 	a, err = app.Initialize()
 	if err != nil {
 		log.Fatalf("Expected clean initialization. Got %s", err.Error())
 	}
 
-	a.Router.GET("/products", GetProducts(a.DB))
-	a.Router.POST("/product", CreateProduct(a.DB))
-	a.Router.GET("/product/:id", GetProduct(a.DB))
-	a.Router.PUT("/product/:id", UpdateProduct(a.DB))
-	a.Router.DELETE("/product/:id", DeleteProduct(a.DB))
+	addRoutes(a.Router, a.Store)
 
 	return a
 }
 
+// broken will return an app whose store fails every call with errClosed,
+// the same way a closed database connection would.
+func broken() (a app.App) {
+	a = app.App{Router: httprouter.New(), Store: fakeStore{err: errClosed}}
+	addRoutes(a.Router, a.Store)
+
+	return a
+}
+
+// addTestData is used to add one or more products into the store for
+// testing, the same way model.AddTestData does for a table.
+func addTestData(store model.ProductStore, count int) {
+	for i := 0; i < count; i++ {
+		p := model.Product{Name: "Product " + strconv.Itoa(i+1), Price: model.Money(199 * (i + 1)), Currency: model.DefaultCurrency}
+		store.Create(context.Background(), &p)
+	}
+}
+
+// addRoutes registers our product handlers on router using store.
+func addRoutes(router *httprouter.Router, store model.ProductStore) {
+	router.GET("/products", GetProducts(store, []byte("secret")))
+	router.GET("/products/export", ExportProducts(store))
+	router.GET("/products/search", SearchProducts(store))
+	router.POST("/products/bulk", BulkProducts(store))
+	router.POST("/products/import", ImportProducts(store))
+	router.POST("/product", CreateProduct(store))
+	router.GET("/product/:id", GetProduct(store))
+	router.PUT("/product/:id", UpdateProduct(store))
+	router.PATCH("/product/:id", PatchProduct(store))
+	router.DELETE("/product/:id", DeleteProduct(store))
+	router.POST("/product/:id/restore", RestoreProduct(store))
+	router.GET("/product/:id/:sku", GetProductBySKU(store))
+	router.PUT("/product/:id/:sku", PutProductBySKU(store))
+	router.DELETE("/product/:id/:sku", DeleteProductBySKU(store))
+}
+
+// fakeStore is a ProductStore that returns err from every call. It lets us
+// exercise the handlers without a database.
+type fakeStore struct {
+	err error
+}
+
+func (f fakeStore) Get(ctx context.Context, id int) (model.Product, error) {
+	return model.Product{}, f.err
+}
+func (f fakeStore) GetBySKU(ctx context.Context, sku string) (model.Product, error) {
+	return model.Product{}, f.err
+}
+func (f fakeStore) Upsert(ctx context.Context, p *model.Product) (bool, error) { return false, f.err }
+func (f fakeStore) List(ctx context.Context, q model.Query) ([]model.Product, error) {
+	return nil, f.err
+}
+func (f fakeStore) Export(ctx context.Context, q model.Query, fn func(p model.Product) error) error {
+	return f.err
+}
+func (f fakeStore) Search(ctx context.Context, q model.SearchQuery) ([]model.SearchResult, error) {
+	return nil, f.err
+}
+func (f fakeStore) Count(ctx context.Context, q model.Query, exact bool) (int, error) {
+	return 0, f.err
+}
+func (f fakeStore) Create(ctx context.Context, p *model.Product) error { return f.err }
+func (f fakeStore) Update(ctx context.Context, p *model.Product) error { return f.err }
+func (f fakeStore) Delete(ctx context.Context, id, version int) error  { return f.err }
+func (f fakeStore) Bulk(ctx context.Context, ops []model.BulkOp, atomic bool) ([]model.BulkResult, error) {
+	return nil, f.err
+}
+func (f fakeStore) Import(ctx context.Context, products []model.Product) ([]model.ImportResult, error) {
+	return nil, f.err
+}
+func (f fakeStore) Restore(ctx context.Context, id int) (model.Product, error) {
+	return model.Product{}, f.err
+}
+func (f fakeStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	return 0, f.err
+}
+func (f fakeStore) Patch(ctx context.Context, id int, patch func(p *model.Product) error) (model.Product, error) {
+	return model.Product{}, f.err
+}
+
+func TestFakeStore(t *testing.T) {
+
+	// This test wires the handlers to a fake store and checks that store
+	// errors are translated into the expected status codes.
+	a := app.App{Router: httprouter.New(), Store: fakeStore{err: model.ErrNotFound}}
+	addRoutes(a.Router, a.Store)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	res := executeRequest(a, req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	a = app.App{Router: httprouter.New(), Store: fakeStore{err: errors.New("boom")}}
+	addRoutes(a.Router, a.Store)
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	res = executeRequest(a, req)
+	checkResponseCode(t, http.StatusInternalServerError, res.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["detail"] == "boom" {
+		t.Errorf("Expected the internal error to be masked. Got '%s'", m["detail"])
+	}
+}
+
+func TestProblems(t *testing.T) {
+
+	// This test checks the shape of our problem+json error responses.
+	a := initialize()
+
+	req, _ := http.NewRequest("GET", "/product/11", nil)
+	req = req.WithContext(requestid.NewContext(req.Context(), "abc-123"))
+	res := executeRequest(a, req)
+
+	if ct := res.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Expected Content-Type 'application/problem+json'. Got '%s'", ct)
+	}
+
+	var p Problem
+	json.Unmarshal(res.Body.Bytes(), &p)
+
+	expected := Problem{
+		Type:      "/problems/not-found",
+		Title:     "Not Found",
+		Status:    http.StatusNotFound,
+		Detail:    "Product not found",
+		Instance:  "/product/11",
+		RequestID: "abc-123",
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expected %+v. Got %+v", expected, p)
+	}
+
+	// Postgres errors a client can act on are mapped to 4xx/503 codes
+	tests := []struct {
+		code pq.ErrorCode
+		want int
+	}{
+		{"23505", http.StatusConflict},            // unique_violation
+		{"23514", http.StatusUnprocessableEntity}, // check_violation
+		{"23502", http.StatusUnprocessableEntity}, // not_null_violation
+		{"40001", http.StatusServiceUnavailable},  // serialization_failure
+		{"42P01", http.StatusInternalServerError}, // undefined_table
+	}
+
+	for _, test := range tests {
+		a := app.App{Router: httprouter.New(), Store: fakeStore{err: &pq.Error{Code: test.code, Message: "secret"}}}
+		addRoutes(a.Router, a.Store)
+
+		payload := []byte(`{"name":"test product","price":11.22}`)
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(payload))
+		res := executeRequest(a, req)
+		checkResponseCode(t, test.want, res.Code)
+
+		if bytes.Contains(res.Body.Bytes(), []byte("secret")) {
+			t.Errorf("Expected the driver's message to be masked. Got %s", res.Body.String())
+		}
+	}
+}
+
+func TestSQLStateResource(t *testing.T) {
+
+	// This test checks that problem details name the resource in the
+	// table that failed, so admin API conflicts don't mention products.
+	tests := []struct {
+		table  string
+		detail string
+	}{
+		{"products", "Product conflicts with an existing one"},
+		{"api_keys", "API key conflicts with an existing one"},
+		{"role_bindings", "Role binding conflicts with an existing one"},
+		{"", "Resource conflicts with an existing one"},
+	}
+
+	for _, test := range tests {
+		_, detail, _ := sqlState(&pq.Error{Code: "23505", Table: test.table})
+		if detail != test.detail {
+			t.Errorf("Expected %q. Got %q", test.detail, detail)
+		}
+	}
+}
+
+func TestContextErrors(t *testing.T) {
+
+	// This test checks that canceled and timed out store calls are
+	// reported with their own status codes instead of a 500.
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{context.Canceled, StatusClientClosedRequest},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		a := app.App{Router: httprouter.New(), Store: fakeStore{err: test.err}}
+		addRoutes(a.Router, a.Store)
+
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			payload := []byte(`{"name":"test product","price":11.22}`)
+			req, _ := http.NewRequest(method, "/product/1", bytes.NewBuffer(payload))
+			res := executeRequest(a, req)
+			checkResponseCode(t, test.code, res.Code)
+		}
+
+		payload := []byte(`{"name":"test product","price":11.22}`)
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(payload))
+		res := executeRequest(a, req)
+		checkResponseCode(t, test.code, res.Code)
+
+		req, _ = http.NewRequest("GET", "/products", nil)
+		res = executeRequest(a, req)
+		checkResponseCode(t, test.code, res.Code)
+	}
+}
+
 func TestGetProducts(t *testing.T) {
 
 	// This test deletes all records from the products table and sends a GET
@@ -43,13 +273,6 @@ func TestGetProducts(t *testing.T) {
 
 	// Initialize the app
 	a := initialize()
-	defer a.DB.Close()
-
-	// define a product and use it's method to nake sure the table exists
-	// and it's clear.
-	p := model.Product{}
-	p.EnsureTableExists(a.DB)
-	p.ClearTable(a.DB)
 
 	// Create a request to pass to our handler. We don't have any
 	// parameters for now, so we'll pass 'nil' as the third parameter.
@@ -78,9 +301,9 @@ func TestGetProducts(t *testing.T) {
 
 	checkResponseCode(t, http.StatusOK, res.Code)
 
-	// This tests that accessing product with the database closed
+	// This tests that accessing products when the store fails
 	// returns the relevant error and status code 500.
-	a.DB.Close()
+	a = broken()
 
 	req, _ = http.NewRequest("GET", "/products", nil)
 
@@ -89,10 +312,691 @@ func TestGetProducts(t *testing.T) {
 
 	checkResponseCode(t, http.StatusInternalServerError, res.Code)
 
-	var m map[string]string
+	var m map[string]interface{}
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "sql: database is closed" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'sql: database is closed'. Got '%s'", m["error"])
+	if m["detail"] != "An internal error occurred" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'An internal error occurred'. Got '%s'", m["detail"])
+	}
+}
+
+func TestGetProductsQuery(t *testing.T) {
+
+	// This test filters and sorts the product list using the querystring.
+	a := initialize()
+	addTestData(a.Store, 12)
+
+	req, _ := http.NewRequest("GET", "/products?name=product%201&min_price=3&sort=price:desc", nil)
+	res := executeRequest(a, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// "Product 1" is too cheap, leaving 12, 11 and 10 by price descending
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	var names []string
+	for _, p := range products {
+		names = append(names, p.Name)
+	}
+	expected := []string{"Product 12", "Product 11", "Product 10"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v. Got %v", expected, names)
+	}
+
+	// Bad filters and sort keys are rejected
+	for _, query := range []string{"sort=colour", "sort=price:up", "min_price=cheap", "max_price=1.001"} {
+		req, _ := http.NewRequest("GET", "/products?"+query, nil)
+		res := executeRequest(a, req)
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+	}
+}
+
+func TestGetProductsUpdatedSince(t *testing.T) {
+
+	// This test lists the products changed since a point in time, the way
+	// an incremental sync would, deletes included.
+	a := initialize()
+	addTestData(a.Store, 3)
+
+	p, _ := a.Store.Get(context.Background(), 3)
+	since := p.UpdatedAt.Add(time.Microsecond)
+
+	time.Sleep(time.Millisecond)
+	a.Store.Delete(context.Background(), 1, 0)
+	p, _ = a.Store.Get(context.Background(), 2)
+	p.Name = "changed"
+	a.Store.Update(context.Background(), &p)
+
+	req, _ := http.NewRequest("GET", "/products?sort=updated_at&include=deleted&updated_since="+
+		url.QueryEscape(since.Format(time.RFC3339Nano)), nil)
+	res := executeRequest(a, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+	if len(products) != 2 || products[0].ID != 1 || products[0].DeletedAt == nil || products[1].Name != "changed" {
+		t.Errorf("Expected the delete of 1 and the update of 2. Got %+v", products)
+	}
+	if products[0].CreatedAt.IsZero() || products[0].UpdatedAt.IsZero() {
+		t.Errorf("Expected timestamps. Got %+v", products[0])
+	}
+
+	req, _ = http.NewRequest("GET", "/products?updated_since=yesterday", nil)
+	res = executeRequest(a, req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestGetProductsCursor(t *testing.T) {
+
+	// This test pages through the product list with cursors, forwards and
+	// then backwards, and checks tampered cursors are rejected.
+	a := initialize()
+	addTestData(a.Store, 5)
+
+	page := func(url string) (ids []int, next, prev string) {
+		req, _ := http.NewRequest("GET", url, nil)
+		res := executeRequest(a, req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+
+		var products []model.Product
+		json.Unmarshal(res.Body.Bytes(), &products)
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+
+		return ids, res.Header().Get("X-Next-Cursor"), res.Header().Get("X-Prev-Cursor")
+	}
+
+	ids, next, prev := page("/products?count=2&sort=price:desc")
+	if !reflect.DeepEqual(ids, []int{5, 4}) || next == "" || prev != "" {
+		t.Fatalf("Unexpected first page %v, next '%s', prev '%s'", ids, next, prev)
+	}
+
+	ids, next, _ = page("/products?count=2&cursor=" + next)
+	if !reflect.DeepEqual(ids, []int{3, 2}) || next == "" {
+		t.Fatalf("Unexpected second page %v, next '%s'", ids, next)
+	}
+
+	ids, next, prev = page("/products?count=2&cursor=" + next)
+	if !reflect.DeepEqual(ids, []int{1}) || next != "" || prev == "" {
+		t.Fatalf("Unexpected last page %v, next '%s', prev '%s'", ids, next, prev)
+	}
+
+	ids, _, _ = page("/products?count=2&cursor=" + prev)
+	if !reflect.DeepEqual(ids, []int{3, 2}) {
+		t.Errorf("Expected to page back to [3 2]. Got %v", ids)
+	}
+
+	// a tampered cursor, or one used with different filters, is rejected
+	tampered := "x" + prev[1:]
+	for _, url := range []string{
+		"/products?cursor=" + tampered,
+		"/products?cursor=garbage",
+		"/products?name=product&cursor=" + prev,
+		"/products?sort=name&cursor=" + prev,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		res := executeRequest(a, req)
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+	}
+}
+
+func TestGetProductsEnvelope(t *testing.T) {
+
+	// This test checks the total count and Link headers, and the envelope
+	// the products can be wrapped in.
+	a := initialize()
+	addTestData(a.Store, 5)
+
+	req, _ := http.NewRequest("GET", "/products?count=2&start=1", nil)
+	res := executeRequest(a, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	if total := res.Header().Get("X-Total-Count"); total != "5" {
+		t.Errorf("Expected X-Total-Count to be '5'. Got '%s'", total)
+	}
+
+	link := res.Header().Get("Link")
+	if !strings.Contains(link, `</products?count=2>; rel="first"`) ||
+		!strings.Contains(link, `rel="next"`) || !strings.Contains(link, `rel="prev"`) {
+		t.Errorf("Expected first, next and prev links. Got '%s'", link)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?count=2&envelope=true&total=estimate", nil)
+	res = executeRequest(a, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var page Page
+	json.Unmarshal(res.Body.Bytes(), &page)
+	if len(page.Data) != 2 || page.Count != 2 || page.Start != 0 {
+		t.Errorf("Expected the first 2 products. Got %+v", page)
+	}
+	if page.Total == nil || *page.Total != 5 || !page.Estimated {
+		t.Errorf("Expected an estimated total of 5. Got %+v", page)
+	}
+	if !strings.HasPrefix(page.Next, "/products?") || page.Prev != "" {
+		t.Errorf("Expected only a next page. Got next '%s', prev '%s'", page.Next, page.Prev)
+	}
+
+	// following next gets the rest
+	req, _ = http.NewRequest("GET", page.Next, nil)
+	res = executeRequest(a, req)
+	page = Page{}
+	json.Unmarshal(res.Body.Bytes(), &page)
+	if len(page.Data) != 2 || page.Data[0].ID != 3 || page.Prev == "" {
+		t.Errorf("Expected products 3 and 4. Got %+v", page)
+	}
+
+	// the total can be skipped
+	req, _ = http.NewRequest("GET", "/products?envelope=1&total=none", nil)
+	res = executeRequest(a, req)
+	page = Page{}
+	json.Unmarshal(res.Body.Bytes(), &page)
+	if page.Total != nil || res.Header().Get("X-Total-Count") != "" {
+		t.Errorf("Expected no total. Got %v", page.Total)
+	}
+
+	// bad parameters are rejected
+	for _, url := range []string{"/products?total=some", "/products?envelope=maybe"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		res := executeRequest(a, req)
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+	}
+}
+
+func TestExportProducts(t *testing.T) {
+
+	// This test exports products in both formats, checks the filters are
+	// honoured and that paging is ignored.
+	a := initialize()
+	addTestData(a.Store, 3)
+	a.Store.Delete(context.Background(), 2, 0)
+
+	export := func(url, accept string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return executeRequest(a, req)
+	}
+
+	// NDJSON by default, one product per line
+	res := export("/products/export?count=1", "")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if ct := res.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected NDJSON. Got '%s'", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 products. Got %d", len(lines))
+	}
+	var p model.Product
+	json.Unmarshal([]byte(lines[1]), &p)
+	if p.ID != 3 || p.Name != "Product 3" {
+		t.Errorf("Expected product 3. Got %+v", p)
+	}
+
+	// CSV by Accept header, with the list filters applied
+	res = export("/products/export?include=deleted&sort=id:desc", "text/csv;q=0.9, application/xml")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	records, err := csv.NewReader(res.Body).ReadAll()
+	if err != nil || len(records) != 4 {
+		t.Fatalf("Expected a header and 3 products. Got %v %v", records, err)
+	}
+	if !reflect.DeepEqual(records[0], csvHeader) {
+		t.Errorf("Expected the CSV header. Got %v", records[0])
+	}
+	if records[1][0] != "3" || records[2][2] != "Product 2" || records[2][4] != "USD" || records[2][7] == "" || records[1][7] != "" {
+		t.Errorf("Expected products 3, 2 and 1 with 2 deleted. Got %v", records[1:])
+	}
+
+	// format overrides Accept
+	res = export("/products/export?format=csv&name_prefix=Product+1", "application/x-ndjson")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if records, _ := csv.NewReader(res.Body).ReadAll(); len(records) != 2 || records[1][3] != "1.99" {
+		t.Errorf("Expected product 1. Got %v", records)
+	}
+
+	// names a spreadsheet would run as a formula stay text
+	formula := model.Product{Name: "=HYPERLINK(\"http://evil\")", Price: 100, Currency: "USD"}
+	a.Store.Create(context.Background(), &formula)
+	res = export("/products/export?format=csv&name_prefix=%3D", "")
+	if records, _ := csv.NewReader(res.Body).ReadAll(); len(records) != 2 || records[1][2] != "'"+formula.Name {
+		t.Errorf("Expected the formula to be escaped. Got %v", records)
+	}
+
+	res = export("/products/export?format=xml", "")
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	res = export("/products/export", "application/xml")
+	checkResponseCode(t, http.StatusNotAcceptable, res.Code)
+
+	res = export("/products/export?min_price=abc", "")
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestSearchProducts(t *testing.T) {
+
+	a := initialize()
+	for _, name := range []string{"Red wool jumper", "Blue wool socks", "Woollen hat", "Red socks"} {
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(`{"name":"`+name+`","price":1}`))
+		executeRequest(a, req)
+	}
+
+	search := func(url string) []model.SearchResult {
+		req, _ := http.NewRequest("GET", url, nil)
+		res := executeRequest(a, req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+		var results []model.SearchResult
+		if err := json.Unmarshal(res.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return results
+	}
+
+	results := search("/products/search?q=red+socks")
+	if len(results) != 1 || results[0].ID != 4 || results[0].Snippet != "<mark>Red</mark> <mark>socks</mark>" {
+		t.Errorf("Expected product 4 with a snippet. Got %+v", results)
+	}
+
+	// a phrase must match in order, a prefix matches longer words
+	if results = search(`/products/search?q="wool+socks"`); len(results) != 1 || results[0].ID != 2 {
+		t.Errorf("Expected product 2. Got %+v", results)
+	}
+	if results = search("/products/search?q=wool*&count=2"); len(results) != 2 {
+		t.Errorf("Expected 2 of 3 products. Got %+v", results)
+	}
+
+	// a word one typo away matches too
+	results = search("/products/search?q=jumpr")
+	if len(results) != 1 || results[0].ID != 1 {
+		t.Errorf("Expected product 1 despite the typo. Got %+v", results)
+	}
+
+	for _, url := range []string{"/products/search", "/products/search?q=%22%22", "/products/search?q=+-+"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		res := executeRequest(a, req)
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+
+	router := httprouter.New()
+	router.GET("/admin/config", AdminOnly("s3cret")(GetConfig([]string{"ok"})))
+	router.GET("/admin/off", AdminOnly("")(GetConfig([]string{"ok"})))
+
+	for _, c := range []struct {
+		url, auth string
+		code      int
+	}{
+		{"/admin/config", "Bearer s3cret", http.StatusOK},
+		{"/admin/config", "bearer s3cret", http.StatusOK},
+		{"/admin/config", "", http.StatusUnauthorized},
+		{"/admin/config", "Bearer s3cre", http.StatusUnauthorized},
+		{"/admin/config", "Basic s3cret", http.StatusUnauthorized},
+		{"/admin/off", "Bearer ", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		checkResponseCode(t, c.code, res.Code)
+
+		if c.code == http.StatusUnauthorized && res.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Expected a WWW-Authenticate header")
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+
+	// This test creates, lists, rotates and revokes API keys.
+	keys := model.NewAPIKeyCache(model.NewMemoryAPIKeyStore(), time.Hour)
+	router := httprouter.New()
+	router.GET("/admin/keys", ListAPIKeys(keys))
+	router.POST("/admin/keys", CreateAPIKey(keys))
+	router.POST("/admin/keys/:id/rotate", RotateAPIKey(keys))
+	router.DELETE("/admin/keys/:id", RevokeAPIKey(keys))
+
+	request := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := request("POST", "/admin/keys", `{"name":"ci","expires_in":"720h"}`)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+	var k NewAPIKey
+	json.Unmarshal(res.Body.Bytes(), &k)
+	if k.ID != 1 || k.Name != "ci" || k.ExpiresAt == nil || res.Header().Get("Location") != "/admin/keys/1" {
+		t.Errorf("Expected key 1. Got %+v", k)
+	}
+	if _, err := keys.Authenticate(context.Background(), k.Key); err != nil {
+		t.Errorf("Expected the new key to work. Got %v", err)
+	}
+
+	// rotating without a grace period stops the old key at once
+	old := k.Key
+	res = request("POST", "/admin/keys/1/rotate", "")
+	checkResponseCode(t, http.StatusCreated, res.Code)
+	json.Unmarshal(res.Body.Bytes(), &k)
+	if k.ID != 2 || k.Name != "ci" || k.Key == old {
+		t.Errorf("Expected key 2. Got %+v", k)
+	}
+	if _, err := keys.Authenticate(context.Background(), old); err != model.ErrInvalidAPIKey {
+		t.Errorf("Expected the old key to stop working. Got %v", err)
+	}
+
+	res = request("DELETE", "/admin/keys/2", "")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if _, err := keys.Authenticate(context.Background(), k.Key); err != model.ErrInvalidAPIKey {
+		t.Errorf("Expected the revoked key to stop working. Got %v", err)
+	}
+
+	// the list never has the keys themselves
+	res = request("GET", "/admin/keys", "")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if strings.Contains(res.Body.String(), old) || strings.Count(res.Body.String(), `"prefix"`) != 2 {
+		t.Errorf("Expected 2 keys without secrets. Got %s", res.Body)
+	}
+
+	for _, c := range []struct {
+		method, url, payload string
+		code                 int
+	}{
+		{"POST", "/admin/keys", `{}`, http.StatusUnprocessableEntity},
+		{"POST", "/admin/keys", `{"name":"ci","expires_in":"soon"}`, http.StatusUnprocessableEntity},
+		{"POST", "/admin/keys", `{"name":"ci","scopes":[]}`, http.StatusBadRequest},
+		{"POST", "/admin/keys/2/rotate", `{}`, http.StatusNotFound},
+		{"POST", "/admin/keys/x/rotate", `{}`, http.StatusBadRequest},
+		{"POST", "/admin/keys/1/rotate", `{"grace":"-1h"}`, http.StatusUnprocessableEntity},
+		{"DELETE", "/admin/keys/9", "", http.StatusNotFound},
+	} {
+		res = request(c.method, c.url, c.payload)
+		checkResponseCode(t, c.code, res.Code)
+	}
+}
+
+func TestRoles(t *testing.T) {
+
+	// This test creates a role, binds a subject to it and deletes it.
+	roles := model.NewRoleCache(model.NewMemoryRoleStore(), time.Hour)
+	router := httprouter.New()
+	router.GET("/admin/roles", ListRoles(roles))
+	router.PUT("/admin/roles/:name", PutRole(roles))
+	router.DELETE("/admin/roles/:name", DeleteRole(roles))
+	router.GET("/admin/subjects/:subject/roles", GetSubjectRoles(roles))
+	router.PUT("/admin/subjects/:subject/roles/:role", BindRole(roles))
+	router.DELETE("/admin/subjects/:subject/roles/:role", UnbindRole(roles))
+
+	request := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := request("PUT", "/admin/roles/partner", `{"description":"Partners","permissions":["products:read"]}`)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+	res = request("PUT", "/admin/roles/partner", `{"name":"partner","permissions":["products:read","reports:*"]}`)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	res = request("GET", "/admin/roles", "")
+	var list []model.Role
+	json.Unmarshal(res.Body.Bytes(), &list)
+	if len(list) != 4 || list[2].Name != "partner" || len(list[2].Permissions) != 2 {
+		t.Errorf("Expected 4 roles. Got %+v", list)
+	}
+
+	res = request("PUT", "/admin/subjects/apikey:acme/roles/partner", "")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	res = request("GET", "/admin/subjects/apikey:acme/roles", "")
+	var s SubjectRoles
+	json.Unmarshal(res.Body.Bytes(), &s)
+	if s.Subject != "apikey:acme" || len(s.Roles) != 1 || !model.Allows(s.Permissions, "reports:read") {
+		t.Errorf("Expected the partner role. Got %+v", s)
+	}
+
+	res = request("DELETE", "/admin/roles/partner", "")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if p, _ := roles.Permissions(context.Background(), "apikey:acme"); model.Allows(p, "reports:read") {
+		t.Errorf("Expected the partner's permissions to be gone. Got %v", p)
+	}
+
+	for _, c := range []struct {
+		method, url, payload string
+		code                 int
+	}{
+		{"PUT", "/admin/roles/Bad%20Name", `{}`, http.StatusBadRequest},
+		{"PUT", "/admin/roles/partner", `{"permissions":["everything"]}`, http.StatusUnprocessableEntity},
+		{"PUT", "/admin/roles/partner", `{"name":"other"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/admin/roles/partner", `{"admin":true}`, http.StatusBadRequest},
+		{"DELETE", "/admin/roles/partner", "", http.StatusNotFound},
+		{"PUT", "/admin/subjects/apikey:acme/roles/partner", "", http.StatusNotFound},
+		{"DELETE", "/admin/subjects/apikey:acme/roles/reader", "", http.StatusNotFound},
+	} {
+		res = request(c.method, c.url, c.payload)
+		checkResponseCode(t, c.code, res.Code)
+	}
+}
+
+func TestBulkProducts(t *testing.T) {
+
+	// This test runs bulk requests in both modes and checks the report
+	// and what was stored.
+	a := initialize()
+	addTestData(a.Store, 2)
+
+	bulk := func(url, contentType, payload string) (*httptest.ResponseRecorder, BulkReport) {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", contentType)
+		res := executeRequest(a, req)
+
+		var report BulkReport
+		json.Unmarshal(res.Body.Bytes(), &report)
+		return res, report
+	}
+	statuses := func(items []BulkItem) (s []int) {
+		for _, item := range items {
+			s = append(s, item.Status)
+		}
+		return s
+	}
+
+	// all good, as a JSON array
+	res, report := bulk("/products/bulk", "application/json", `[
+		{"op":"create","product":{"name":"three","price":3}},
+		{"op":"create","product":{"name":"four","price":4}},
+		{"op":"update","id":1,"product":{"name":"one","price":1}},
+		{"op":"delete","id":2}
+	]`)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if !reflect.DeepEqual(statuses(report.Items), []int{201, 201, 200, 200}) || report.Succeeded != 4 {
+		t.Errorf("Expected every operation to succeed. Got %+v", report)
+	}
+	if report.Items[1].ID != 4 || report.Items[1].Product.Name != "four" {
+		t.Errorf("Expected product 4 to be created. Got %+v", report.Items[1])
+	}
+
+	// a failure in atomic mode applies nothing
+	res, _ = bulk("/products/bulk", "application/x-ndjson",
+		`{"op":"create","product":{"name":"five","price":5}}`+"\n"+`{"op":"delete","id":2}`+"\n")
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	var problem Problem
+	json.Unmarshal(res.Body.Bytes(), &problem)
+	if !reflect.DeepEqual(statuses(problem.Items), []int{424, 404}) {
+		t.Errorf("Expected the delete to fail and the create to be aborted. Got %+v", problem.Items)
+	}
+	if _, err := a.Store.Get(context.Background(), 5); err != model.ErrNotFound {
+		t.Errorf("Expected nothing to be created. Got %v", err)
+	}
+
+	// so does an invalid operation
+	res, _ = bulk("/products/bulk", "application/json",
+		`[{"op":"create","product":{"name":"five","price":5}},{"op":"create","product":{"price":-1}}]`)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+
+	// in partial mode the rest carry on
+	res, report = bulk("/products/bulk?mode=partial", "application/x-ndjson", `{"op":"create","product":{"name":"five","price":5}}
+{"op":"delete","id":2}
+{"op":"update","id":3,"product":{"name":""}}
+{"op":"frob","id":3}
+{"op":"update","id":3,"product":{"name":"THREE","price":3}}`)
+	checkResponseCode(t, http.StatusMultiStatus, res.Code)
+	if !reflect.DeepEqual(statuses(report.Items), []int{201, 404, 422, 400, 200}) || report.Failed != 3 {
+		t.Errorf("Expected 2 operations to succeed. Got %+v", report)
+	}
+	if p, _ := a.Store.Get(context.Background(), 3); p.Name != "THREE" {
+		t.Errorf("Expected product 3 to be updated. Got %+v", p)
+	}
+
+	for _, c := range []struct {
+		url, contentType, payload string
+		code                      int
+	}{
+		{"/products/bulk", "text/csv", `op,id`, http.StatusUnsupportedMediaType},
+		{"/products/bulk", "application/json", `{"op":"delete","id":1}`, http.StatusBadRequest},
+		{"/products/bulk", "application/json", `[{"op":"delete","id":1}`, http.StatusBadRequest},
+		{"/products/bulk", "application/x-ndjson", `{"op":"delete","id":1} nope`, http.StatusBadRequest},
+		{"/products/bulk?mode=some", "application/json", `[]`, http.StatusBadRequest},
+		{"/products/bulk", "application/json", `[` + strings.Repeat(`{"op":"delete","id":1},`, maxBulkOps) + `{}]`, http.StatusRequestEntityTooLarge},
+		{"/products/bulk", "application/json", `[` + strings.Repeat(" ", maxBatchBody) + `]`, http.StatusRequestEntityTooLarge},
+	} {
+		res, _ = bulk(c.url, c.contentType, c.payload)
+		checkResponseCode(t, c.code, res.Code)
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+
+	// This test exports names that need escaping as CSV and imports them
+	// into an empty store, which must end up with the same names.
+	a, b := initialize(), initialize()
+	names := []string{"-foo", "'-foo", "''=x", "'quoted", "'", "=1+1", "plain"}
+	for _, name := range names {
+		p := model.Product{Name: name, Price: 100, Currency: "USD"}
+		a.Store.Create(context.Background(), &p)
+	}
+
+	req, _ := http.NewRequest("GET", "/products/export?format=csv", nil)
+	res := executeRequest(a, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("POST", "/products/import", res.Body)
+	req.Header.Set("Content-Type", "text/csv")
+	res = executeRequest(b, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	for i, name := range names {
+		if p, err := b.Store.Get(context.Background(), i+1); err != nil || p.Name != name {
+			t.Errorf("Expected %q to survive the round trip. Got %q (%v)", name, p.Name, err)
+		}
+	}
+}
+
+func TestImportProducts(t *testing.T) {
+
+	// This test imports a CSV and an NDJSON file and checks the report and
+	// what was stored.
+	a := initialize()
+	addTestData(a.Store, 2)
+
+	upload := func(url, contentType, accept, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", contentType)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return executeRequest(a, req)
+	}
+	statuses := func(items []ImportItem) (s []string) {
+		for _, item := range items {
+			s = append(s, item.Status+":"+strconv.Itoa(item.Line))
+		}
+		return s
+	}
+
+	// a CSV with extra columns, as exported, and some bad rows
+	res := upload("/products/import", "text/csv", "", "\ufeffID,Name,Price,Currency,created_at\n"+
+		"1,Product 1,2.50,USD,x\n"+
+		"2,Product 2,3.98,,x\n"+
+		",New,1,EUR,x\n"+
+		",\"\",1,USD,x\n"+
+		",Bad,1.999,usd,x\n"+
+		",Short\n"+
+		",New,2,EUR,x\n")
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var report ImportReport
+	json.Unmarshal(res.Body.Bytes(), &report)
+	expected := []string{"updated:2", "unchanged:3", "created:4", "rejected:5", "rejected:6", "rejected:7", "rejected:8"}
+	if !reflect.DeepEqual(statuses(report.Items), expected) {
+		t.Errorf("Expected %v. Got %v", expected, statuses(report.Items))
+	}
+	if report.Created != 1 || report.Updated != 1 || report.Unchanged != 1 || report.Rejected != 4 {
+		t.Errorf("Expected 1 created, updated and unchanged and 4 rejected. Got %+v", report)
+	}
+	if len(report.Items[4].Errors) != 2 || report.Items[6].Reason != model.ImportDuplicate {
+		t.Errorf("Expected the rejected rows to say why. Got %+v", report.Items[4:])
+	}
+	if p, _ := a.Store.Get(context.Background(), 1); p.Price != 250 || p.Version != 2 {
+		t.Errorf("Expected product 1 to be updated. Got %+v", p)
+	}
+	if p, _ := a.Store.Get(context.Background(), 3); p.Name != "New" || p.Currency != "EUR" || report.Items[2].ID != 3 {
+		t.Errorf("Expected product 3 to be created. Got %+v", p)
+	}
+
+	// rows with a sku are matched by it, and exported names that were
+	// escaped for spreadsheets come back as they were
+	res = upload("/products/import", "text/csv", "", "sku,name,price\n"+
+		"A-1,'=1+1,1\n"+
+		"A-1,Again,1\n")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	report = ImportReport{}
+	json.Unmarshal(res.Body.Bytes(), &report)
+	if p, err := a.Store.GetBySKU(context.Background(), "A-1"); err != nil || p.Name != "=1+1" || report.Items[1].Reason != model.ImportDuplicateSKU {
+		t.Errorf("Expected the product to be created with its sku. Got %+v %+v", p, report)
+	}
+	res = upload("/products/import", "text/csv", "", "sku,name,price\nA-1,Renamed,1\n")
+	if p, _ := a.Store.GetBySKU(context.Background(), "A-1"); p.Name != "Renamed" {
+		t.Errorf("Expected the product to be renamed. Got %+v", p)
+	}
+
+	// NDJSON, with a CSV report
+	res = upload("/products/import", "application/x-ndjson", "text/csv",
+		`{"id":7,"name":"New","price":1,"currency":"EUR","created_at":"2017-01-01T00:00:00Z"}`+"\n\n"+
+			`{"name":"Newer","price":5}`+"\n"+
+			`{"name":"Newer",`+"\n")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if ct := res.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Expected a CSV report. Got '%s'", ct)
+	}
+	records, _ := csv.NewReader(res.Body).ReadAll()
+	if len(records) != 4 || records[1][1] != "unchanged" || records[1][2] != "3" || records[2][1] != "created" ||
+		records[3][0] != "4" || records[3][1] != "rejected" {
+		t.Errorf("Expected New unchanged, Newer created and line 4 rejected. Got %v", records)
+	}
+
+	for _, c := range []struct {
+		url, contentType, accept, payload string
+		code                              int
+	}{
+		{"/products/import", "application/json", "", `[]`, http.StatusUnsupportedMediaType},
+		{"/products/import", "text/csv", "", ``, http.StatusBadRequest},
+		{"/products/import", "text/csv", "", "name,cost\nx,1\n", http.StatusBadRequest},
+		{"/products/import", "text/csv", "", "name,price\n\"x,1\n", http.StatusBadRequest},
+		{"/products/import", "text/csv", "", "name,price\n" + strings.Repeat("x,1\n", maxImportRows+1), http.StatusRequestEntityTooLarge},
+		{"/products/import", "text/csv", "", "name,price\n" + strings.Repeat("\n", maxBatchBody), http.StatusRequestEntityTooLarge},
+		{"/products/import", "application/x-ndjson", "", strings.Repeat("\n", maxBatchBody+1), http.StatusRequestEntityTooLarge},
+		{"/products/import?format=xml", "text/csv", "", "name,price\n", http.StatusBadRequest},
+		{"/products/import", "text/csv", "application/xml", "name,price\n", http.StatusNotAcceptable},
+	} {
+		res = upload(c.url, c.contentType, c.accept, c.payload)
+		checkResponseCode(t, c.code, res.Code)
 	}
 }
 
@@ -104,11 +1008,6 @@ func TestGetProduct(t *testing.T) {
 
 	// Initialize app
 	a := initialize()
-	defer a.DB.Close()
-
-	p := model.Product{}
-
-	p.ClearTable(a.DB)
 
 	req, _ := http.NewRequest("GET", "/product/11", nil)
 
@@ -117,18 +1016,17 @@ func TestGetProduct(t *testing.T) {
 
 	checkResponseCode(t, http.StatusNotFound, res.Code)
 
-	var m map[string]string
+	var m map[string]interface{}
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "Product not found" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Product not found'. Got '%s'", m["error"])
+	if m["detail"] != "Product not found" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Product not found'. Got '%s'", m["detail"])
 	}
 
 	// This test simply adds a product to the table and tests that accessing
 	// the relevant endpoint results in an HTTP response that denotes
 	// success with status code 200.
 
-	p.ClearTable(a.DB)
-	p.AddTestData(a.DB, 1)
+	addTestData(a.Store, 1)
 
 	req, _ = http.NewRequest("GET", "/product/1", nil)
 
@@ -148,13 +1046,13 @@ func TestGetProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, res.Code)
 
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "Invalid product ID" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Invalid product ID'. Got '%s'", m["error"])
+	if m["detail"] != "Invalid product ID" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Invalid product ID'. Got '%s'", m["detail"])
 	}
 
-	// This tests that accessing product with the database closed returns
+	// This tests that accessing product when the store fails returns
 	// the relevant error and status code 500.
-	a.DB.Close()
+	a = broken()
 
 	req, _ = http.NewRequest("GET", "/product/1", nil)
 
@@ -164,8 +1062,8 @@ func TestGetProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusInternalServerError, res.Code)
 
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "sql: database is closed" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'sql: database is closed'. Got '%s'", m["error"])
+	if m["detail"] != "An internal error occurred" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'An internal error occurred'. Got '%s'", m["detail"])
 	}
 }
 
@@ -178,11 +1076,6 @@ func TestCreateProduct(t *testing.T) {
 
 	// Initialize app
 	a := initialize()
-	defer a.DB.Close()
-
-	p := model.Product{}
-	p.EnsureTableExists(a.DB)
-	p.ClearTable(a.DB)
 
 	payload := []byte(`{"name":"test product","price":11.22}`)
 
@@ -225,13 +1118,13 @@ func TestCreateProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, res.Code)
 
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "Invalid request payload" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Invalid request payload'. Got '%s'", m["error"])
+	if m["detail"] != "Invalid request payload" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Invalid request payload'. Got '%s'", m["detail"])
 	}
 
-	// This tests that accessing product with the database closed returns
+	// This tests that accessing product when the store fails returns
 	// the relevant error and status code 500.
-	a.DB.Close()
+	a = broken()
 
 	payload = []byte(`{"name":"test product","price":11.22}`)
 
@@ -243,12 +1136,202 @@ func TestCreateProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusInternalServerError, res.Code)
 
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "sql: database is closed" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'sql: database is closed'. Got '%s'", m["error"])
+	if m["detail"] != "An internal error occurred" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'An internal error occurred'. Got '%s'", m["detail"])
 	}
 
 }
 
+func TestIdempotent(t *testing.T) {
+
+	// This test retries requests with an Idempotency-Key and checks that
+	// each is only handled once.
+	a := initialize()
+	a.Router = httprouter.New()
+	idempotent := Idempotent(model.NewMemoryIdempotencyStore(time.Minute), time.Hour)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	calls := 0
+	a.Router.POST("/product", idempotent(CreateProduct(a.Store)))
+	a.Router.POST("/slow", idempotent(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	a.Router.POST("/fail", idempotent(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		calls++
+		respondWithError(w, r, http.StatusServiceUnavailable, "Try again")
+	}))
+
+	post := func(url, key, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(payload))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		return executeRequest(a, req)
+	}
+	count := func() int {
+		n, _ := a.Store.Count(context.Background(), model.Query{}, true)
+		return n
+	}
+
+	// a retry gets the first response back without creating another product
+	first := post("/product", "one", `{"name":"test product","price":11.22}`)
+	checkResponseCode(t, http.StatusCreated, first.Code)
+	retry := post("/product", "one", `{"name":"test product","price":11.22}`)
+	checkResponseCode(t, http.StatusCreated, retry.Code)
+	if retry.Body.String() != first.Body.String() || retry.Header().Get("ETag") != first.Header().Get("ETag") {
+		t.Errorf("Expected the first response. Got %v %s", retry.Header(), retry.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Expected only the retry to be marked as replayed")
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected 1 product. Got %v", n)
+	}
+
+	// the key can't be used for a different request
+	res := post("/product", "one", `{"name":"another product","price":11.22}`)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+
+	// requests without a key are handled every time
+	post("/product", "", `{"name":"test product","price":11.22}`)
+	post("/product", "", `{"name":"test product","price":11.22}`)
+	if n := count(); n != 3 {
+		t.Errorf("Expected 3 products. Got %v", n)
+	}
+
+	// a retry while the request is in flight is a conflict
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- post("/slow", "two", "") }()
+	<-started
+	res = post("/slow", "two", "")
+	checkResponseCode(t, http.StatusConflict, res.Code)
+	if res.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+	close(release)
+	checkResponseCode(t, http.StatusNoContent, (<-done).Code)
+	res = post("/slow", "two", "")
+	checkResponseCode(t, http.StatusNoContent, res.Code)
+	if res.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the response to be replayed")
+	}
+
+	// server errors aren't saved, so the request can be retried
+	post("/fail", "three", "")
+	res = post("/fail", "three", "")
+	checkResponseCode(t, http.StatusServiceUnavailable, res.Code)
+	if calls != 2 {
+		t.Errorf("Expected the request to be handled twice. Got %v", calls)
+	}
+
+	res = post("/product", strings.Repeat("k", maxIdempotencyKey+1), `{"name":"test product","price":11.22}`)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	// a body too large to hold in memory is refused
+	res = post("/product", "four", strings.Repeat(" ", maxIdempotentBody+1))
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, res.Code)
+
+	// clients using the same key don't see each other's responses
+	as := func(subject, key, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(payload))
+		req.Header.Set("Idempotency-Key", key)
+		req = req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: subject}))
+		return executeRequest(a, req)
+	}
+	res = as("apikey:ci", "five", `{"name":"test product","price":11.22}`)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+	res = as("apikey:web", "five", `{"name":"another product","price":11.22}`)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+	if res.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Expected another client's response not to be replayed")
+	}
+	res = as("apikey:ci", "five", `{"name":"test product","price":11.22}`)
+	if res.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the client's own response to be replayed")
+	}
+}
+
+func TestValidation(t *testing.T) {
+
+	// This test sends products that break several rules at once and checks
+	// that we get a 422 listing each violation, and that unknown fields
+	// are rejected with a 400.
+	a := initialize()
+
+	payload := []byte(`{"name":"  ","price":1.234,"currency":"usd"}`)
+
+	for _, method := range []string{"POST", "PUT"} {
+		url := "/product"
+		if method == "PUT" {
+			addTestData(a.Store, 1)
+			url = "/product/1"
+		}
+
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(payload))
+		res := executeRequest(a, req)
+		checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+
+		var p Problem
+		json.Unmarshal(res.Body.Bytes(), &p)
+
+		expected := []model.FieldError{
+			{Field: "name", Rule: "required", Message: "is required"},
+			{Field: "currency", Rule: "currency", Message: "must be a three letter ISO 4217 currency code"},
+			{Field: "price", Rule: "scale", Message: "must have at most 2 decimal places"},
+		}
+		if !reflect.DeepEqual(p.Errors, expected) {
+			t.Errorf("Expected errors %+v. Got %+v", expected, p.Errors)
+		}
+	}
+
+	payload = []byte(`{"name":"test product","price":11.22,"colour":"red"}`)
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(payload))
+	res := executeRequest(a, req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestServerTimestamps(t *testing.T) {
+
+	// This test checks that the timestamps a client sends are dropped, so
+	// a product can't be created already in the trash or backdated.
+	a := initialize()
+	addTestData(a.Store, 1)
+
+	past := "2001-01-01T00:00:00Z"
+	for _, field := range []string{"created_at", "updated_at", "deleted_at"} {
+		payload := `{"name":"test product","price":11.22,"` + field + `":"` + past + `"}`
+
+		for _, method := range []string{"POST", "PUT"} {
+			url := "/product"
+			if method == "PUT" {
+				url = "/product/1"
+			}
+
+			req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+			res := executeRequest(a, req)
+			if res.Code != http.StatusCreated && res.Code != http.StatusOK {
+				t.Fatalf("%s %s with %s: expected success. Got %d", method, url, field, res.Code)
+			}
+			if bytes.Contains(res.Body.Bytes(), []byte(past)) {
+				t.Errorf("%s %s: expected %s to be ignored. Got %s", method, url, field, res.Body.String())
+			}
+
+			var p model.Product
+			json.Unmarshal(res.Body.Bytes(), &p)
+			stored, err := a.Store.Get(context.Background(), p.ID)
+			if err != nil {
+				t.Errorf("%s %s with %s: expected the product to be live. Got %v", method, url, field, err)
+			}
+			if stored.CreatedAt.Year() == 2001 || stored.UpdatedAt.Year() == 2001 || stored.DeletedAt != nil {
+				t.Errorf("%s %s: expected the store to keep its own timestamps. Got %+v", method, url, stored)
+			}
+		}
+	}
+}
+
 func TestUpdateProduct(t *testing.T) {
 
 	// This test begins by adding a product to the database directly. It then uses
@@ -259,12 +1342,8 @@ func TestUpdateProduct(t *testing.T) {
 
 	// Initialize app
 	a := initialize()
-	defer a.DB.Close()
 
-	p := model.Product{}
-	p.EnsureTableExists(a.DB)
-	p.ClearTable(a.DB)
-	p.AddTestData(a.DB, 1)
+	addTestData(a.Store, 1)
 
 	req, _ := http.NewRequest("GET", "/product/1", nil)
 
@@ -298,6 +1377,21 @@ func TestUpdateProduct(t *testing.T) {
 		t.Errorf("Expected the price to change from '%v' to '%v'. Got '%v'", originalProduct["price"], m["price"], m["price"])
 	}
 
+	// This tests that updating a product that does not exist returns
+	// status code 404 rather than pretending it succeeded.
+
+	req, _ = http.NewRequest("PUT", "/product/11", bytes.NewBuffer(payload))
+
+	// Run the request and get the response
+	res = executeRequest(a, req)
+
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["detail"] != "Product not found" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Product not found'. Got '%s'", m["detail"])
+	}
+
 	// This tests that updating product with an invalid id returns
 	// the relevant error and bad request with status code 400.
 
@@ -309,8 +1403,8 @@ func TestUpdateProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, res.Code)
 
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "Invalid product ID" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Invalid product ID'. Got '%s'", m["error"])
+	if m["detail"] != "Invalid product ID" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Invalid product ID'. Got '%s'", m["detail"])
 	}
 
 	// In this test, we test sending bad data.  We test the following things:
@@ -328,13 +1422,13 @@ func TestUpdateProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, res.Code)
 
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "Invalid request payload" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Invalid request payload'. Got '%s'", m["error"])
+	if m["detail"] != "Invalid request payload" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Invalid request payload'. Got '%s'", m["detail"])
 	}
 
-	// This tests that accessing product with the database closed returns
+	// This tests that accessing product when the store fails returns
 	// the relevant error and status code 500.
-	a.DB.Close()
+	a = broken()
 
 	payload = []byte(`{"name":"test product","price":11.22}`)
 
@@ -346,10 +1440,173 @@ func TestUpdateProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusInternalServerError, res.Code)
 
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "sql: database is closed" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'sql: database is closed'. Got '%s'", m["error"])
+	if m["detail"] != "An internal error occurred" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'An internal error occurred'. Got '%s'", m["detail"])
+	}
+
+}
+
+func TestPatchProduct(t *testing.T) {
+
+	// This test patches a product with both patch formats and checks that
+	// only the fields in the patch change.
+	a := initialize()
+	addTestData(a.Store, 1)
+
+	patch := func(contentType, payload string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req, _ := http.NewRequest("PATCH", "/product/1", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", contentType)
+		res := executeRequest(a, req)
+
+		var m map[string]interface{}
+		json.Unmarshal(res.Body.Bytes(), &m)
+		return res, m
+	}
+
+	res, m := patch("application/merge-patch+json", `{"name":"merged"}`)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if m["name"] != "merged" || m["price"] != 1.99 || m["currency"] != "USD" {
+		t.Errorf("Expected only the name to change. Got %v", m)
+	}
+
+	res, m = patch("application/json-patch+json",
+		`[{"op":"test","path":"/name","value":"merged"},{"op":"replace","path":"/price","value":"2.50"}]`)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if m["name"] != "merged" || m["price"] != 2.5 {
+		t.Errorf("Expected only the price to change. Got %v", m)
+	}
+
+	// a failed test leaves the product alone
+	res, m = patch("application/json-patch+json",
+		`[{"op":"replace","path":"/name","value":"nope"},{"op":"test","path":"/price","value":1}]`)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	p, _ := a.Store.Get(context.Background(), 1)
+	if p.Name != "merged" {
+		t.Errorf("Expected the failed patch to be discarded. Got '%s'", p.Name)
+	}
+
+	// an invalid result is reported field by field
+	res, m = patch("application/merge-patch+json", `{"name":null,"id":2}`)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+	if errs, _ := m["errors"].([]interface{}); len(errs) != 2 {
+		t.Errorf("Expected 2 field errors. Got %v", m["errors"])
+	}
+
+	// the timestamps belong to the store
+	for _, c := range []struct{ contentType, payload string }{
+		{"application/merge-patch+json", `{"deleted_at":"2001-01-01T00:00:00Z"}`},
+		{"application/merge-patch+json", `{"created_at":"2001-01-01T00:00:00Z"}`},
+		{"application/json-patch+json", `[{"op":"replace","path":"/updated_at","value":"2001-01-01T00:00:00Z"}]`},
+		{"application/json-patch+json", `[{"op":"add","path":"/deleted_at","value":"2001-01-01T00:00:00Z"}]`},
+	} {
+		res, m = patch(c.contentType, c.payload)
+		checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+		if errs, _ := m["errors"].([]interface{}); len(errs) != 1 {
+			t.Errorf("%s: expected a readonly field error. Got %v", c.payload, m["errors"])
+		}
+	}
+	if _, err := a.Store.Get(context.Background(), 1); err != nil {
+		t.Errorf("Expected the product not to be trashed. Got %v", err)
+	}
+
+	for _, c := range []struct {
+		contentType, payload string
+		code                 int
+	}{
+		{"application/json", `{"name":"x"}`, http.StatusUnsupportedMediaType},
+		{"application/merge-patch+json", `{"name":`, http.StatusBadRequest},
+		{"application/json-patch+json", `{"op":"add"}`, http.StatusBadRequest},
+		{"application/json-patch+json", `[{"op":"jump","path":"/name"}]`, http.StatusBadRequest},
+		{"application/json-patch+json", `[{"op":"remove","path":"/nope"}]`, http.StatusUnprocessableEntity},
+		{"application/merge-patch+json", `{"colour":"red"}`, http.StatusUnprocessableEntity},
+	} {
+		res, _ = patch(c.contentType, c.payload)
+		checkResponseCode(t, c.code, res.Code)
 	}
 
+	// patching a product that does not exist returns 404
+	req, _ := http.NewRequest("PATCH", "/product/11", bytes.NewBufferString(`{"name":"x"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	res = executeRequest(a, req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestETags(t *testing.T) {
+
+	// This test checks conditional requests: reads can be revalidated with
+	// If-None-Match, and writes with a stale If-Match are refused.
+	a := initialize()
+	addTestData(a.Store, 2)
+
+	request := func(method, url, body string, header ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		return executeRequest(a, req)
+	}
+
+	res := request("GET", "/product/1", "")
+	tag := res.Header().Get("ETag")
+	if tag != `"1"` {
+		t.Errorf(`Expected the ETag to be "1". Got '%s'`, tag)
+	}
+
+	res = request("GET", "/product/1", "", "If-None-Match", tag)
+	checkResponseCode(t, http.StatusNotModified, res.Code)
+	if res.Body.Len() != 0 {
+		t.Errorf("Expected an empty body. Got '%s'", res.Body.String())
+	}
+
+	res = request("GET", "/products", "")
+	list := res.Header().Get("ETag")
+	res = request("GET", "/products", "", "If-None-Match", `"x", `+list)
+	checkResponseCode(t, http.StatusNotModified, res.Code)
+
+	// an update with the current ETag succeeds and bumps the version
+	res = request("PUT", "/product/1", `{"name":"one","price":1}`, "If-Match", tag)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if res.Header().Get("ETag") != `"2"` {
+		t.Errorf(`Expected the ETag to be "2". Got '%s'`, res.Header().Get("ETag"))
+	}
+
+	// the list has changed too
+	res = request("GET", "/products", "", "If-None-Match", list)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// writes with the old ETag are refused
+	res = request("PUT", "/product/1", `{"name":"stale","price":1}`, "If-Match", tag)
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
+
+	res = request("PATCH", "/product/1", `{"name":"stale"}`,
+		"If-Match", tag, "Content-Type", "application/merge-patch+json")
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
+
+	res = request("DELETE", "/product/1", "", "If-Match", tag)
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
+
+	res = request("GET", "/product/1", "")
+	var m map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["name"] != "one" {
+		t.Errorf("Expected the stale writes to be refused. Got '%v'", m["name"])
+	}
+
+	// weak tags never match If-Match, "*" matches any version, and a
+	// product that doesn't exist never matches
+	res = request("DELETE", "/product/1", "", "If-Match", `W/"2"`)
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
+
+	res = request("PATCH", "/product/1", `{"name":"two"}`,
+		"If-Match", `"2"`, "Content-Type", "application/merge-patch+json")
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	res = request("DELETE", "/product/1", "", "If-Match", "*")
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	res = request("PUT", "/product/1", `{"name":"gone","price":1}`, "If-Match", "*")
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
 }
 
 func TestDeleteProduct(t *testing.T) {
@@ -360,12 +1617,8 @@ func TestDeleteProduct(t *testing.T) {
 
 	// Initialize app
 	a := initialize()
-	defer a.DB.Close()
 
-	p := model.Product{}
-	p.EnsureTableExists(a.DB)
-	p.ClearTable(a.DB)
-	p.AddTestData(a.DB, 1)
+	addTestData(a.Store, 1)
 
 	req, _ := http.NewRequest("GET", "/product/1", nil)
 	// Run the request and get the response
@@ -382,6 +1635,12 @@ func TestDeleteProduct(t *testing.T) {
 	res = executeRequest(a, req)
 	checkResponseCode(t, http.StatusNotFound, res.Code)
 
+	// Deleting it again returns status code 404.
+	req, _ = http.NewRequest("DELETE", "/product/1", nil)
+	// Run the request and get the response
+	res = executeRequest(a, req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
 	// This tests that deleting product with an invalid id returns
 	// the relevant error and bad request with status code 400.
 
@@ -392,13 +1651,13 @@ func TestDeleteProduct(t *testing.T) {
 
 	var m map[string]interface{}
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "Invalid product ID" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Invalid product ID'. Got '%s'", m["error"])
+	if m["detail"] != "Invalid product ID" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Invalid product ID'. Got '%s'", m["detail"])
 	}
 
-	// This tests that accessing product with the database closed returns
+	// This tests that accessing product when the store fails returns
 	// the relevant error and status code 500.
-	a.DB.Close()
+	a = broken()
 
 	req, _ = http.NewRequest("DELETE", "/product/1", nil)
 	// Run the request and get the response
@@ -406,8 +1665,138 @@ func TestDeleteProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusInternalServerError, res.Code)
 
 	json.Unmarshal(res.Body.Bytes(), &m)
-	if m["error"] != "sql: database is closed" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'sql: database is closed'. Got '%s'", m["error"])
+	if m["detail"] != "An internal error occurred" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'An internal error occurred'. Got '%s'", m["detail"])
+	}
+}
+
+func TestProductBySKU(t *testing.T) {
+
+	// This test creates, replaces, gets and deletes a product by its sku.
+	a := initialize()
+
+	request := func(method, url, payload string, header ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		return executeRequest(a, req)
+	}
+
+	res := request("PUT", "/product/sku/ABC-1", `{"name":"one","price":1}`)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+	if res.Header().Get("Location") != "/product/sku/ABC-1" || res.Header().Get("ETag") != `"1"` {
+		t.Errorf("Expected the location and ETag of the product. Got %v", res.Header())
+	}
+
+	res = request("PUT", "/product/sku/ABC-1", `{"sku":"ABC-1","name":"uno","price":1}`)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	res = request("GET", "/product/sku/ABC-1", "")
+	checkResponseCode(t, http.StatusOK, res.Code)
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.ID != 1 || p.SKU != "ABC-1" || p.Name != "uno" {
+		t.Errorf("Expected product 1. Got %+v", p)
+	}
+
+	// the product is the same one by id
+	res = request("GET", "/product/1", "")
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.SKU != "ABC-1" {
+		t.Errorf("Expected product 1 to have the sku. Got %+v", p)
+	}
+
+	// another product can't take the sku
+	res = request("POST", "/product", `{"sku":"ABC-1","name":"two","price":2}`)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	// If-Match is honoured
+	res = request("PUT", "/product/sku/ABC-1", `{"name":"eins","price":1}`, "If-Match", `"1"`)
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
+	res = request("PUT", "/product/sku/NEW", `{"name":"new","price":1}`, "If-Match", `"1"`)
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
+	res = request("DELETE", "/product/sku/ABC-1", "", "If-Match", `"1"`)
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
+
+	res = request("DELETE", "/product/sku/ABC-1", "", "If-Match", `"2"`)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	res = request("GET", "/product/sku/ABC-1", "")
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+	res = request("DELETE", "/product/sku/ABC-1", "")
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	for _, c := range []struct {
+		method, url, payload string
+		code                 int
+	}{
+		{"GET", "/product/skus/ABC-1", "", http.StatusNotFound},
+		{"GET", "/product/sku/-nope", "", http.StatusBadRequest},
+		{"PUT", "/product/sku/ABC-1", `{"sku":"ABC-2","name":"one","price":1}`, http.StatusUnprocessableEntity},
+		{"PUT", "/product/sku/ABC-1", `{"name":"","price":1}`, http.StatusUnprocessableEntity},
+		{"POST", "/product", `{"sku":"a b","name":"one","price":1}`, http.StatusUnprocessableEntity},
+	} {
+		res = request(c.method, c.url, c.payload)
+		checkResponseCode(t, c.code, res.Code)
+	}
+}
+
+func TestRestoreProduct(t *testing.T) {
+
+	// This test deletes a product, finds it in the trash listing and
+	// restores it.
+	a := initialize()
+	addTestData(a.Store, 3)
+
+	list := func(url string) (ids []int) {
+		req, _ := http.NewRequest("GET", url, nil)
+		res := executeRequest(a, req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+
+		var products []model.Product
+		json.Unmarshal(res.Body.Bytes(), &products)
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	req, _ := http.NewRequest("DELETE", "/product/2", nil)
+	executeRequest(a, req)
+
+	if ids := list("/products"); !reflect.DeepEqual(ids, []int{1, 3}) {
+		t.Errorf("Expected the deleted product to be left out. Got %v", ids)
+	}
+	if ids := list("/products?include=deleted"); !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Errorf("Expected all products. Got %v", ids)
+	}
+	if ids := list("/products?only=deleted"); !reflect.DeepEqual(ids, []int{2}) {
+		t.Errorf("Expected only the deleted product. Got %v", ids)
+	}
+
+	req, _ = http.NewRequest("POST", "/product/2/restore", nil)
+	res := executeRequest(a, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["name"] != "Product 2" || m["deleted_at"] != nil {
+		t.Errorf("Expected the restored product. Got %v", m)
+	}
+
+	if ids := list("/products"); !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Errorf("Expected the restored product to be listed. Got %v", ids)
+	}
+
+	// only deleted products can be restored
+	req, _ = http.NewRequest("POST", "/product/2/restore", nil)
+	res = executeRequest(a, req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	for _, url := range []string{"/products?include=everything", "/products?only=live", "/products?include=deleted&only=deleted"} {
+		req, _ = http.NewRequest("GET", url, nil)
+		res = executeRequest(a, req)
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
 	}
 }
 
@@ -0,0 +1,194 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/dstroot/postgres-api/middleware/auth"
+	"github.com/dstroot/postgres-api/middleware/requestid"
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxIdempotencyKey limits the length of an Idempotency-Key.
+const maxIdempotencyKey = 255
+
+// maxIdempotentBody limits the size of the body of a request with an
+// Idempotency-Key, which has to be read into memory to identify it. It is
+// large enough for the biggest bulk request or import.
+const maxIdempotentBody = maxBatchBody
+
+// Idempotent returns a wrapper that makes a handler safe to retry. A
+// request with an Idempotency-Key header is handled once: the response is
+// saved for ttl and replayed, with an Idempotent-Replayed header, to any
+// retry of the same request (the same method, URL, Content-Type and body)
+// with the same key. Reusing a key for a different request gets a 422 and
+// a retry while the first request is still being handled a 409. Keys
+// belong to the client that sent them, so clients can't see each other's
+// responses by picking the same key.
+//
+// Server errors aren't saved, so a request that failed with one can be
+// retried with the same key. Requests without the header are handled as
+// usual.
+func Idempotent(keys model.IdempotencyStore, ttl time.Duration) func(httprouter.Handle) httprouter.Handle {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				h(w, r, ps)
+				return
+			}
+			if len(key) > maxIdempotencyKey {
+				respondWithError(w, r, http.StatusBadRequest, "Idempotency-Key is too long")
+				return
+			}
+
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+			r.Body.Close()
+			if err != nil {
+				respondWithBodyError(w, r, err, maxIdempotentBody, "Invalid request payload")
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			key = scopedKey(r, key)
+			claim, saved, err := keys.Begin(r.Context(), key, requestHash(r, body), ttl)
+			switch err {
+			case nil:
+			case model.ErrKeyInFlight:
+				w.Header().Set("Retry-After", "1")
+				respondWithError(w, r, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+				return
+			case model.ErrKeyReused:
+				respondWithError(w, r, http.StatusUnprocessableEntity, "This Idempotency-Key was used for a different request")
+				return
+			default:
+				respondWithStoreError(w, r, err)
+				return
+			}
+
+			if saved != nil {
+				for k, v := range saved.Header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(saved.Status)
+				w.Write(saved.Body)
+				return
+			}
+
+			// The key is released if the handler panics, and saved or
+			// released even if the client has gone away.
+			rec := &recorder{ResponseWriter: w, before: cloneHeader(w.Header())}
+			finished := false
+			defer func() {
+				ctx := context.Background()
+				if !finished || rec.res.Status >= 500 || rec.res.Status == StatusClientClosedRequest {
+					err = keys.Release(ctx, key, claim)
+				} else {
+					err = keys.Finish(ctx, key, claim, rec.res)
+				}
+				if err != nil {
+					log.Printf("ERROR: request %s %s %s: saving the response for its Idempotency-Key: %+v",
+						requestid.FromContext(r.Context()), r.Method, r.URL.Path, err)
+				}
+			}()
+
+			h(rec, r, ps)
+			if rec.res.Status == 0 {
+				rec.WriteHeader(http.StatusOK)
+			}
+			finished = true
+		}
+	}
+}
+
+// scopedKey returns the key we store an Idempotency-Key under, prefixed
+// with the subject of the client that sent it. A header can't contain a
+// newline, so no client can pick a key that collides with another's.
+func scopedKey(r *http.Request, key string) string {
+	p, _ := auth.FromContext(r.Context())
+	return p.Subject + "\n" + key
+}
+
+// requestHash identifies a request for an idempotency key by its method,
+// URL, Content-Type and body.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n"+r.Header.Get("Content-Type")+"\n")
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder is a ResponseWriter that keeps a copy of the response. Only
+// the headers set by the handler are kept, the ones set before it ran,
+// such as X-Request-ID, belong to the original request.
+type recorder struct {
+	http.ResponseWriter
+	before http.Header
+	res    model.SavedResponse
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.res.Status == 0 {
+		rec.res.Status = code
+		rec.res.Header = make(map[string][]string)
+		for k, v := range rec.Header() {
+			if !reflect.DeepEqual(rec.before[k], v) {
+				rec.res.Header[k] = append([]string(nil), v...)
+			}
+		}
+	}
+
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.res.Status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.res.Body = append(rec.res.Body, b...)
+
+	return rec.ResponseWriter.Write(b)
+}
+
+// cloneHeader returns a copy of h.
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+
+	return c
+}
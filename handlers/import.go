@@ -0,0 +1,360 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// maxImportRows limits the number of rows in one import.
+const maxImportRows = 50000
+
+// maxImportLine limits the length of a line of an NDJSON import.
+const maxImportLine = 64 * 1024
+
+// errTooManyRows is returned when an import has more than maxImportRows.
+var errTooManyRows = errors.New("Too many rows, the limit is " + strconv.Itoa(maxImportRows))
+
+// Import report formats and their media types.
+var reportTypes = map[string]string{
+	"json": "application/json",
+	"csv":  "text/csv",
+}
+
+// reportFormats maps the media types a client can accept to a report
+// format.
+var reportFormats = map[string]string{
+	"application/json": "json",
+	"text/csv":         "csv",
+	"*/*":              "json",
+	"application/*":    "json",
+	"text/*":           "csv",
+}
+
+// importRow is a row of an import file, the product it holds or why it
+// can't be imported.
+type importRow struct {
+	line    int
+	product model.Product
+	reason  string
+	errors  []model.FieldError
+}
+
+// ImportItem reports the outcome of importing one row. Line is the line
+// of the file the row starts on.
+type ImportItem struct {
+	Line   int                `json:"line"`
+	Status string             `json:"status"`
+	ID     int                `json:"id,omitempty"`
+	Name   string             `json:"name,omitempty"`
+	Reason string             `json:"reason,omitempty"`
+	Errors []model.FieldError `json:"errors,omitempty"`
+}
+
+// ImportReport is the response to an import.
+type ImportReport struct {
+	Created   int          `json:"created"`
+	Updated   int          `json:"updated"`
+	Unchanged int          `json:"unchanged"`
+	Rejected  int          `json:"rejected"`
+	Items     []ImportItem `json:"items"`
+}
+
+// ImportProducts creates and updates products from a CSV or NDJSON file,
+// matching them to existing products by sku, or by name if they have no
+// sku. A CSV file (Content-Type text/csv) starts with a header naming its
+// columns: name and price are required, sku and currency are optional and
+// any other column is ignored, so a CSV export can be edited and imported
+// again. An NDJSON file (Content-Type application/x-ndjson) has a product
+// per line.
+//
+// Every row is validated and the valid ones are imported, whether or not
+// others are rejected. It responds with an ImportReport listing every row
+// as created, updated, unchanged or rejected, with the reason it was
+// rejected, as JSON or, with format=csv or an Accept header asking for
+// it, as CSV. The report is sent as an attachment to be downloaded.
+func ImportProducts(store model.ProductStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		format := r.URL.Query().Get("format")
+		switch {
+		case format == "":
+			if format = negotiate(r.Header.Get("Accept"), reportFormats); format == "" {
+				respondWithError(w, r, http.StatusNotAcceptable, "The import report is available as application/json or text/csv")
+				return
+			}
+		case reportTypes[format] == "":
+			respondWithError(w, r, http.StatusBadRequest, "format must be json or csv")
+			return
+		}
+
+		rows, ok := decodeImport(w, r)
+		if !ok {
+			return
+		}
+
+		items := make([]ImportItem, len(rows))
+		var products []model.Product
+		var index []int
+		for i, row := range rows {
+			items[i] = ImportItem{Line: row.line, Name: row.product.Name, Reason: row.reason, Errors: row.errors}
+			if row.reason != "" {
+				items[i].Status = model.ImportRejected
+				continue
+			}
+			products = append(products, row.product)
+			index = append(index, i)
+		}
+
+		if len(products) > 0 {
+			results, err := store.Import(r.Context(), products)
+			if err != nil {
+				respondWithStoreError(w, r, err)
+				return
+			}
+
+			for k, result := range results {
+				item := &items[index[k]]
+				item.Status, item.ID, item.Reason = result.Status, result.Product.ID, result.Reason
+			}
+		}
+
+		report := ImportReport{Items: items}
+		for _, item := range items {
+			switch item.Status {
+			case model.ImportCreated:
+				report.Created++
+			case model.ImportUpdated:
+				report.Updated++
+			case model.ImportUnchanged:
+				report.Unchanged++
+			default:
+				report.Rejected++
+			}
+		}
+
+		w.Header().Set("Content-Disposition", `attachment; filename="import-report.`+format+`"`)
+		w.Header().Add("Vary", "Accept")
+		if format == "csv" {
+			writeImportReport(w, report)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
+
+// decodeImport reads the rows of the import file in the request body. If
+// the file can't be read it responds with a 400, a 413 if it has too
+// many rows or is too large, or a 415 if it isn't CSV or NDJSON, and
+// returns false.
+func decodeImport(w http.ResponseWriter, r *http.Request) ([]importRow, bool) {
+	defer r.Body.Close()
+
+	var rows []importRow
+	var err error
+	body := http.MaxBytesReader(w, r.Body, maxBatchBody)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "text/csv":
+		rows, err = readImportCSV(body)
+	case ndjsonTypes[mediaType]:
+		rows, err = readImportNDJSON(body)
+	default:
+		respondWithError(w, r, http.StatusUnsupportedMediaType,
+			"Content-Type must be text/csv or application/x-ndjson")
+		return nil, false
+	}
+
+	switch {
+	case err == errTooManyRows:
+		respondWithError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		return nil, false
+	case err != nil:
+		respondWithBodyError(w, r, err, maxBatchBody, "Invalid import file, "+err.Error())
+		return nil, false
+	}
+
+	return rows, true
+}
+
+// readImportCSV reads the rows of a CSV import. A row with the wrong
+// number of fields is rejected, but a file that isn't valid CSV is an
+// error.
+func readImportCSV(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing the header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		// spreadsheets like to start a file with a byte order mark
+		name = strings.TrimPrefix(name, "\ufeff")
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"name", "price"} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.Errorf("the header has no %s column", name)
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == maxImportRows {
+			return nil, errTooManyRows
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := importRow{line: line}
+		if len(record) != len(header) {
+			row.reason = "Expected " + strconv.Itoa(len(header)) + " fields, got " + strconv.Itoa(len(record))
+			rows = append(rows, row)
+			continue
+		}
+
+		cell := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return record[i]
+			}
+			return ""
+		}
+
+		row.product = model.Product{
+			SKU:      csvUnescape(strings.TrimSpace(cell("sku"))),
+			Name:     csvUnescape(cell("name")),
+			Currency: strings.TrimSpace(cell("currency")),
+		}
+		var priceErr *model.FieldError
+		if price := cell("price"); strings.TrimSpace(price) == "" {
+			priceErr = &model.FieldError{Field: "price", Rule: "required", Message: "is required"}
+		} else if row.product.Price, err = model.ParseMoney(price); err != nil {
+			priceErr = &model.FieldError{Field: "price", Rule: "number", Message: err.(*model.MoneyError).Reason}
+		}
+
+		row.product.SetDefaults()
+		row.errors, _ = row.product.Validate().(model.ValidationError)
+		if priceErr != nil {
+			row.errors = append(row.errors, *priceErr)
+		}
+		if len(row.errors) > 0 {
+			row.reason = "Product failed validation"
+		}
+		rows = append(rows, row)
+	}
+}
+
+// csvUnescape undoes csvText, so an export can be imported again. Like a
+// spreadsheet, it takes a quote before a formula character or another
+// quote as an escape, so a name that really starts with one has to be
+// written with an extra quote, as the export does.
+func csvUnescape(s string) string {
+	if len(s) > 1 && s[0] == '\'' && csvText(s[1:]) == s {
+		return s[1:]
+	}
+
+	return s
+}
+
+// readImportNDJSON reads the rows of an NDJSON import, skipping blank
+// lines. A line that isn't a product is rejected.
+func readImportNDJSON(body io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxImportLine)
+
+	var rows []importRow
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if len(rows) == maxImportRows {
+			return nil, errTooManyRows
+		}
+
+		// only the fields a client can import are kept, an exported
+		// product carries its id and timestamps too
+		var p model.Product
+		row := importRow{line: line}
+		violations, err := readProduct(bytes.NewReader(text), &p)
+		switch {
+		case err != nil:
+			row.reason = "Invalid product, " + err.Error()
+		case len(violations) > 0:
+			row.reason, row.errors = "Product failed validation", violations
+		}
+		row.product = model.Product{SKU: p.SKU, Name: p.Name, Price: p.Price, Currency: p.Currency}
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return nil, errors.New("a line is longer than " + strconv.Itoa(maxImportLine) + " bytes")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// writeImportReport writes an import report as CSV, a row per row of
+// the import.
+func writeImportReport(w http.ResponseWriter, report ImportReport) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"line", "status", "id", "name", "reason"})
+	for _, item := range report.Items {
+		id, reason := "", item.Reason
+		if item.ID != 0 {
+			id = strconv.Itoa(item.ID)
+		}
+		if len(item.Errors) > 0 {
+			reason = model.ValidationError(item.Errors).Error()
+		}
+		cw.Write([]string{strconv.Itoa(item.Line), item.Status, id, csvText(item.Name), reason})
+	}
+	cw.Flush()
+}
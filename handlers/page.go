@@ -0,0 +1,102 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/pkg/errors"
+)
+
+// Page is the envelope GET /products responds with when called with
+// envelope=true. Next and Prev are the URLs of the neighbouring pages.
+type Page struct {
+	Data      []model.Product `json:"data"`
+	Total     *int            `json:"total,omitempty"`
+	Estimated bool            `json:"estimated,omitempty"`
+	Count     int             `json:"count"`
+	Start     int             `json:"start"`
+	Next      string          `json:"next,omitempty"`
+	Prev      string          `json:"prev,omitempty"`
+}
+
+// Total counting modes for the total parameter.
+const (
+	totalExact    = "exact"
+	totalEstimate = "estimate"
+	totalNone     = "none"
+)
+
+// parsePaging reads the envelope and total parameters.
+func parsePaging(values url.Values) (envelope bool, total string, err error) {
+	if v := values.Get("envelope"); v != "" {
+		envelope, err = strconv.ParseBool(v)
+		if err != nil {
+			return false, "", errors.Errorf("invalid envelope %q", v)
+		}
+	}
+
+	total = values.Get("total")
+	switch total {
+	case "":
+		total = totalExact
+	case totalExact, totalEstimate, totalNone:
+	default:
+		return false, "", errors.Errorf("invalid total %q, must be exact, estimate or none", total)
+	}
+
+	return envelope, total, nil
+}
+
+// pageURL returns the URL of the request with its cursor replaced by
+// token (or removed if token is empty) and its start removed.
+func pageURL(r *http.Request, token string) string {
+	values := r.URL.Query()
+	values.Del("start")
+	values.Del("cursor")
+	if token != "" {
+		values.Set("cursor", token)
+	}
+
+	u := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+	return u.String()
+}
+
+// setLinks sets an RFC 5988 Link header with the first, next and prev
+// pages. Empty URLs are left out.
+func setLinks(w http.ResponseWriter, first, next, prev string) {
+	var links []string
+	for _, l := range []struct{ url, rel string }{{first, "first"}, {next, "next"}, {prev, "prev"}} {
+		if l.url != "" {
+			links = append(links, "<"+l.url+`>; rel="`+l.rel+`"`)
+		}
+	}
+
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
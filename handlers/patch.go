@@ -0,0 +1,394 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Media types accepted by PATCH.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// errTestFailed is returned when a JSON Patch test operation fails.
+var errTestFailed = errors.New("test operation failed")
+
+// patchError is a patch that could not be applied to a product.
+type patchError struct{ error }
+
+// decodeJSON decodes data into a generic document, keeping numbers as
+// json.Number so that prices survive the round trip exactly.
+func decodeJSON(data []byte) (interface{}, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+
+	return doc, nil
+}
+
+// mergePatch applies an RFC 7396 JSON Merge Patch to target. Members of
+// patch replace those of target, recursively for objects, and null
+// members remove them.
+func mergePatch(target, patch interface{}) interface{} {
+	obj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range obj {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+
+	return t
+}
+
+// patchOp is one operation of an RFC 6902 JSON Patch.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// jsonPatch is an RFC 6902 JSON Patch.
+type jsonPatch []patchOp
+
+// parseJSONPatch decodes and checks a JSON Patch document, so that a
+// malformed patch can be rejected before anything is loaded.
+func parseJSONPatch(data []byte) (jsonPatch, error) {
+	var patch jsonPatch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, errors.New("a JSON Patch must be an array of operations")
+	}
+
+	for i, op := range patch {
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, errors.Errorf("operation %d (%s) has no value", i, op.Op)
+			}
+		case "move", "copy":
+			if _, err := pointer(op.From); err != nil {
+				return nil, errors.Wrapf(err, "operation %d (%s) from", i, op.Op)
+			}
+		case "remove":
+		default:
+			return nil, errors.Errorf("operation %d has unknown op %q", i, op.Op)
+		}
+
+		if _, err := pointer(op.Path); err != nil {
+			return nil, errors.Wrapf(err, "operation %d (%s) path", i, op.Op)
+		}
+	}
+
+	return patch, nil
+}
+
+// Apply applies the patch to doc, in order. If any operation fails the
+// error is returned and the patch as a whole must be discarded.
+func (patch jsonPatch) Apply(doc interface{}) (interface{}, error) {
+	for i, op := range patch {
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "operation %d (%s %s)", i, op.Op, op.Path)
+		}
+	}
+
+	return doc, nil
+}
+
+func (op patchOp) apply(doc interface{}) (interface{}, error) {
+	path, _ := pointer(op.Path)
+
+	var value interface{}
+	if len(op.Value) > 0 {
+		var err error
+		if value, err = decodeJSON(op.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return add(doc, path, value)
+	case "remove":
+		return remove(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, err := remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "move", "copy":
+		from, _ := pointer(op.From)
+		v, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			return add(doc, path, deepCopy(v))
+		}
+		if op.From != op.Path && strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, errors.New("cannot move a value into itself")
+		}
+		if doc, err = remove(doc, from); err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "test":
+		v, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(v, value) {
+			return nil, errTestFailed
+		}
+		return doc, nil
+	}
+
+	return nil, errors.Errorf("unknown op %q", op.Op)
+}
+
+// pointer splits an RFC 6901 JSON Pointer into its reference tokens.
+func pointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return nil, errors.Errorf("invalid JSON Pointer %q", path)
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex parses token as an index into an array of length n. With
+// end set "-" and n itself are allowed, meaning the end of the array.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, errors.Errorf("invalid array index %q", token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, errors.Errorf("array index %d out of range", i)
+	}
+
+	return i, nil
+}
+
+// get returns the value at path in doc.
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, errors.Errorf("member %q not found", t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, errors.Errorf("cannot index %q into a scalar", t)
+		}
+	}
+
+	return doc, nil
+}
+
+// update calls fn with the container holding the last token of path and
+// that token, and returns doc with the container replaced by the result.
+func update(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	parent, err := get(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err := update(parent, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		c[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(c), false)
+		c[i] = child
+	}
+
+	return doc, nil
+}
+
+// add adds value at path in doc, inserting into arrays and replacing
+// object members.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, errors.Errorf("cannot add %q to a scalar", token)
+	})
+}
+
+// remove removes the value at path from doc, which must exist.
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+
+	return update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, errors.Errorf("member %q not found", token)
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, errors.Errorf("cannot remove %q from a scalar", token)
+	})
+}
+
+// deepCopy copies a decoded JSON value so a copy and its original can be
+// patched independently.
+func deepCopy(v interface{}) interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(c))
+		for k, e := range c {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(c))
+		for i, e := range c {
+			a[i] = deepCopy(e)
+		}
+		return a
+	}
+
+	return v
+}
+
+// equal compares two decoded JSON values the way RFC 6902 test does,
+// numbers by value rather than by how they are written.
+func equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		m, ok1 := new(big.Rat).SetString(string(x))
+		n, ok2 := new(big.Rat).SetString(string(y))
+		return ok1 && ok2 && m.Cmp(n) == 0
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return a == b
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+
+	// Examples from RFC 7396 appendix A.
+	for _, c := range []struct{ target, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		target, _ := decodeJSON([]byte(c.target))
+		patch, _ := decodeJSON([]byte(c.patch))
+		result, _ := json.Marshal(mergePatch(target, patch))
+		if string(result) != c.result {
+			t.Errorf("Expected %s patched with %s to be %s. Got %s", c.target, c.patch, c.result, result)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+
+	// Mostly examples from RFC 6902 appendix A.
+	for _, c := range []struct{ doc, patch, result string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+		{`{"price":1.10}`, `[{"op":"replace","path":"","value":{"price":2.20}}]`, `{"price":2.20}`},
+	} {
+		patch, err := parseJSONPatch([]byte(c.patch))
+		if err != nil {
+			t.Errorf("Expected %s to parse. Got %s", c.patch, err)
+			continue
+		}
+
+		doc, _ := decodeJSON([]byte(c.doc))
+		doc, err = patch.Apply(doc)
+		result, _ := json.Marshal(doc)
+		if err != nil || string(result) != c.result {
+			t.Errorf("Expected %s patched with %s to be %s. Got %s (%v)", c.doc, c.patch, c.result, result, err)
+		}
+	}
+
+	// operations that can't be applied
+	for _, c := range []struct{ doc, patch string }{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/nope","value":1}]`},
+		{`{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/c"}]`},
+		{`{"a":1}`, `[{"op":"remove","path":""}]`},
+	} {
+		patch, _ := parseJSONPatch([]byte(c.patch))
+		doc, _ := decodeJSON([]byte(c.doc))
+		if _, err := patch.Apply(doc); err == nil {
+			t.Errorf("Expected %s to fail on %s", c.patch, c.doc)
+		}
+	}
+
+	// malformed patches are rejected up front
+	for _, patch := range []string{
+		`{"op":"add","path":"/a","value":1}`,
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"copy","from":"a","path":"/b"}]`,
+		`[{"op":"remove","path":"a"}]`,
+		`[{"op":"frob","path":"/a"}]`,
+	} {
+		if _, err := parseJSONPatch([]byte(patch)); err == nil {
+			t.Errorf("Expected %s to be rejected", patch)
+		}
+	}
+}
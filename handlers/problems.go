@@ -0,0 +1,202 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/dstroot/postgres-api/middleware/requestid"
+	"github.com/dstroot/postgres-api/models"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Problem is an RFC 7807 problem details object. Every error response
+// from the API is a Problem sent as application/problem+json.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// Errors lists field-level violations for validation problems.
+	Errors []model.FieldError `json:"errors,omitempty"`
+
+	// Items lists the outcome of every operation of a failed bulk
+	// request.
+	Items []BulkItem `json:"items,omitempty"`
+}
+
+// StatusClientClosedRequest is the non-standard status code (borrowed from
+// nginx) we log when the client went away before we could respond.
+const StatusClientClosedRequest = 499
+
+// problemTypes gives each status code we use a stable problem type that
+// clients can switch on. Other codes use about:blank.
+var problemTypes = map[int]string{
+	http.StatusBadRequest:            "/problems/bad-request",
+	http.StatusUnauthorized:          "/problems/unauthorized",
+	http.StatusForbidden:             "/problems/forbidden",
+	http.StatusNotFound:              "/problems/not-found",
+	http.StatusNotAcceptable:         "/problems/not-acceptable",
+	http.StatusConflict:              "/problems/conflict",
+	http.StatusPreconditionFailed:    "/problems/precondition-failed",
+	http.StatusRequestEntityTooLarge: "/problems/too-large",
+	http.StatusUnsupportedMediaType:  "/problems/unsupported-media-type",
+	http.StatusUnprocessableEntity:   "/problems/unprocessable",
+	StatusClientClosedRequest:        "/problems/canceled",
+	http.StatusInternalServerError:   "/problems/internal",
+	http.StatusServiceUnavailable:    "/problems/unavailable",
+}
+
+// NewProblem returns the Problem for code and detail, identifying the
+// request r.
+func NewProblem(r *http.Request, code int, detail string) Problem {
+	p := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(code),
+		Status:    code,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestid.FromContext(r.Context()),
+	}
+
+	if t, ok := problemTypes[code]; ok {
+		p.Type = t
+	}
+	if code == StatusClientClosedRequest {
+		p.Title = "Client Closed Request"
+	}
+
+	return p
+}
+
+// respondWithError sends a problem with the given status code and detail.
+func respondWithError(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	respondWithProblem(w, NewProblem(r, code, detail))
+}
+
+// respondWithProblem sends p as application/problem+json.
+func respondWithProblem(w http.ResponseWriter, p Problem) {
+	response, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(response)
+}
+
+// respondWithValidationError sends a 422 problem listing every field that
+// failed validation.
+func respondWithValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	p := NewProblem(r, http.StatusUnprocessableEntity, "Product failed validation")
+	if errs, ok := err.(model.ValidationError); ok {
+		p.Errors = errs
+	}
+
+	respondWithProblem(w, p)
+}
+
+// respondWithBodyError responds to an error reading the request body
+// with a 413 if the body is larger than limit, or a 400 with detail.
+func respondWithBodyError(w http.ResponseWriter, r *http.Request, err error, limit int, detail string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithError(w, r, http.StatusRequestEntityTooLarge,
+			"The request payload is too large, the limit is "+strconv.Itoa(limit)+" bytes")
+		return
+	}
+
+	respondWithError(w, r, http.StatusBadRequest, detail)
+}
+
+// respondWithStoreError responds to an unexpected error from the store.
+// Canceled and timed out queries and the Postgres errors a client can do
+// something about get their own status codes. Anything else is logged
+// with the request id and reported as a 500 without the error's text, so
+// we never leak driver messages to clients.
+func respondWithStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch errors.Cause(err) {
+	case model.ErrDuplicateSKU:
+		respondWithError(w, r, http.StatusConflict, "Another product has this SKU")
+		return
+	case context.Canceled:
+		respondWithError(w, r, StatusClientClosedRequest, "Request canceled")
+		return
+	case context.DeadlineExceeded:
+		respondWithError(w, r, http.StatusServiceUnavailable, "Request timed out")
+		return
+	}
+
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok {
+		if code, detail, ok := sqlState(pqErr); ok {
+			if code == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1")
+			}
+			respondWithError(w, r, code, detail)
+			return
+		}
+	}
+
+	log.Printf("ERROR: request %s %s %s: %+v",
+		requestid.FromContext(r.Context()), r.Method, r.URL.Path, err)
+	respondWithError(w, r, http.StatusInternalServerError, "An internal error occurred")
+}
+
+// resources names what the rows of each table are, for problem details.
+var resources = map[string]string{
+	"products":         "Product",
+	"api_keys":         "API key",
+	"roles":            "Role",
+	"role_permissions": "Role",
+	"role_bindings":    "Role binding",
+}
+
+// sqlState maps the Postgres SQLSTATE codes a client can act on to a
+// status code and a safe description of the resource in the table that
+// failed. See
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+func sqlState(err *pq.Error) (code int, detail string, ok bool) {
+	resource, ok := resources[err.Table]
+	if !ok {
+		resource = "Resource"
+	}
+
+	switch err.Code.Name() {
+	case "unique_violation":
+		return http.StatusConflict, resource + " conflicts with an existing one", true
+	case "check_violation":
+		return http.StatusUnprocessableEntity, resource + " violates a constraint: " + err.Constraint, true
+	case "not_null_violation":
+		return http.StatusUnprocessableEntity, resource + " is missing a required field: " + err.Column, true
+	case "serialization_failure", "deadlock_detected":
+		return http.StatusServiceUnavailable, resource + " was modified concurrently, please retry", true
+	}
+
+	return 0, "", false
+}
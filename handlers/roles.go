@@ -0,0 +1,171 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// SubjectRoles is a subject with its roles and the permissions they give
+// it, including those everyone has.
+type SubjectRoles struct {
+	Subject     string   `json:"subject"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// ListRoles responds with every role and its permissions.
+func ListRoles(roles model.RoleStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		list, err := roles.Roles(r.Context())
+		if err != nil {
+			respondWithStoreError(w, r, err)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, list)
+	}
+}
+
+// PutRole creates or replaces the role with the name in the URL, with the
+// description and permissions in the body, answering 201 or 200.
+func PutRole(roles model.RoleStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		name := param.ByName("name")
+		if !model.ValidRoleName(name) {
+			respondWithError(w, r, http.StatusBadRequest, "Invalid role name")
+			return
+		}
+
+		var role model.Role
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&role); err != nil {
+			respondWithError(w, r, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		r.Body.Close()
+
+		if role.Name != "" && role.Name != name {
+			respondWithError(w, r, http.StatusUnprocessableEntity, "name must match the URL")
+			return
+		}
+		role.Name = name
+		for _, p := range role.Permissions {
+			if !model.ValidPermission(p) {
+				respondWithError(w, r, http.StatusUnprocessableEntity,
+					"Invalid permission "+p+", permissions look like products:read, products:* or *")
+				return
+			}
+		}
+
+		created, err := roles.PutRole(r.Context(), role)
+		if err != nil {
+			respondWithStoreError(w, r, err)
+			return
+		}
+
+		if created {
+			w.Header().Set("Location", "/admin/roles/"+name)
+			respondWithJSON(w, http.StatusCreated, role)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, role)
+	}
+}
+
+// DeleteRole deletes the role with the name in the URL, taking it away
+// from everyone who had it.
+func DeleteRole(roles model.RoleStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		if err := roles.DeleteRole(r.Context(), param.ByName("name")); err != nil {
+			switch err {
+			case model.ErrRoleNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Role not found")
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// GetSubjectRoles responds with the roles of the subject in the URL, an
+// API key's apikey:<name> or a token's jwt:<sub>, and what they allow.
+func GetSubjectRoles(roles model.RoleStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		s := SubjectRoles{Subject: param.ByName("subject")}
+
+		var err error
+		s.Roles, err = roles.SubjectRoles(r.Context(), s.Subject)
+		if err == nil {
+			s.Permissions, err = roles.Permissions(r.Context(), s.Subject)
+		}
+		if err != nil {
+			respondWithStoreError(w, r, err)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, s)
+	}
+}
+
+// BindRole gives the subject in the URL the role in the URL.
+func BindRole(roles model.RoleStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		if err := roles.Bind(r.Context(), param.ByName("subject"), param.ByName("role")); err != nil {
+			switch err {
+			case model.ErrRoleNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Role not found")
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// UnbindRole takes the role in the URL away from the subject in the URL.
+func UnbindRole(roles model.RoleStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		if err := roles.Unbind(r.Context(), param.ByName("subject"), param.ByName("role")); err != nil {
+			switch err {
+			case model.ErrBindingNotFound:
+				respondWithError(w, r, http.StatusNotFound, "The subject doesn't have the role")
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,68 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// SearchProducts responds with the products matching the full-text search
+// in the q parameter, best matches first, each with its rank and a
+// snippet of its name with the matching words marked. Paging with start
+// and count works as it does for GetProducts.
+func SearchProducts(store model.ProductStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		values := r.URL.Query()
+		if values.Get("q") == "" {
+			respondWithError(w, r, http.StatusBadRequest, "q is required")
+			return
+		}
+
+		q, err := model.ParseSearch(values.Get("q"))
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		q.Count, _ = strconv.Atoi(values.Get("count"))
+		q.Start, _ = strconv.Atoi(values.Get("start"))
+		if q.Count > 50 || q.Count < 1 {
+			q.Count = 50
+		}
+		if q.Start < 0 {
+			q.Start = 0
+		}
+
+		results, err := store.Search(r.Context(), q)
+		if err != nil {
+			respondWithStoreError(w, r, err)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, results)
+	}
+}
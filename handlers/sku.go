@@ -0,0 +1,182 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The sku routes are registered as /product/:id/:sku because httprouter
+// won't have a static segment next to the :id wildcard, so skuParam
+// checks that the first segment really is "sku".
+
+// skuParam returns the sku in the URL of a /product/sku/:sku request. If
+// the URL is some other path it responds with a 404, and if the sku
+// isn't valid with a 400, and returns false.
+func skuParam(w http.ResponseWriter, r *http.Request, param httprouter.Params) (string, bool) {
+	if param.ByName("id") != "sku" {
+		respondWithError(w, r, http.StatusNotFound, "Not found")
+		return "", false
+	}
+
+	sku := param.ByName("sku")
+	if !model.ValidSKU(sku) {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid product SKU")
+		return "", false
+	}
+
+	return sku, true
+}
+
+// GetProductBySKU responds with the product with the sku in the URL, like
+// GetProduct does by id.
+func GetProductBySKU(store model.ProductStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		sku, ok := skuParam(w, r, param)
+		if !ok {
+			return
+		}
+
+		p, err := store.GetBySKU(r.Context(), sku)
+		if err != nil {
+			switch err {
+			case model.ErrNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Product not found")
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		respondWithTaggedJSON(w, r, p, etag(p))
+	}
+}
+
+// PutProductBySKU creates or replaces the product with the sku in the
+// URL, so that other systems can sync products using their own keys
+// rather than our ids. The body is a product as for UpdateProduct; its
+// sku may be left out but must otherwise match the URL. It responds with
+// the product as stored, with a 201 if it was created.
+//
+// With an If-Match header only an existing product whose ETag still
+// matches is replaced, otherwise it responds with a 412.
+func PutProductBySKU(store model.ProductStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		sku, ok := skuParam(w, r, param)
+		if !ok {
+			return
+		}
+
+		var p model.Product
+		if !decodeProduct(w, r, &p) {
+			return
+		}
+		if p.SKU != "" && p.SKU != sku {
+			respondWithValidationError(w, r, model.ValidationError{
+				{Field: "sku", Rule: "readonly", Message: "must match the sku in the URL"},
+			})
+			return
+		}
+		p.ID, p.SKU = 0, sku
+
+		var err error
+		p.Version, err = expectedSKUVersion(r, store, sku)
+		var created bool
+		if err == nil {
+			created, err = store.Upsert(r.Context(), &p)
+		}
+		if err != nil {
+			switch err {
+			case model.ErrNotFound, model.ErrVersionMismatch:
+				respondWithError(w, r, http.StatusPreconditionFailed, errPreconditionFailed)
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		w.Header().Set("ETag", etag(p))
+		if created {
+			w.Header().Set("Location", "/product/sku/"+sku)
+			respondWithJSON(w, http.StatusCreated, p)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, p)
+	}
+}
+
+// DeleteProductBySKU moves the product with the sku in the URL to the
+// trash, like DeleteProduct does by id.
+func DeleteProductBySKU(store model.ProductStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+		sku, ok := skuParam(w, r, param)
+		if !ok {
+			return
+		}
+
+		p, err := store.GetBySKU(r.Context(), sku)
+		if err == nil && !ifMatch(r, p) {
+			err = model.ErrVersionMismatch
+		}
+		if err == nil {
+			version := 0
+			if r.Header.Get("If-Match") != "" {
+				version = p.Version
+			}
+			err = store.Delete(r.Context(), p.ID, version)
+		}
+		if err != nil {
+			switch {
+			case err == model.ErrNotFound && r.Header.Get("If-Match") != "":
+				respondWithError(w, r, http.StatusPreconditionFailed, errPreconditionFailed)
+			case err == model.ErrNotFound:
+				respondWithError(w, r, http.StatusNotFound, "Product not found")
+			case err == model.ErrVersionMismatch:
+				respondWithError(w, r, http.StatusPreconditionFailed, errPreconditionFailed)
+			default:
+				respondWithStoreError(w, r, err)
+			}
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// expectedSKUVersion is expectedVersion for the product with the given
+// sku.
+func expectedSKUVersion(r *http.Request, store model.ProductStore, sku string) (int, error) {
+	if r.Header.Get("If-Match") == "" {
+		return 0, nil
+	}
+
+	p, err := store.GetBySKU(r.Context(), sku)
+	if err == model.ErrNotFound || (err == nil && !ifMatch(r, p)) {
+		return 0, model.ErrVersionMismatch
+	}
+
+	return p.Version, err
+}
@@ -44,11 +44,18 @@ func run() error {
 	if err != nil {
 		return errors.Wrap(err, "initialization error")
 	}
-	defer api.DB.Close()
+	if api.DB != nil {
+		defer api.DB.Close()
+	}
 
 	// Initialize our routes
 	routes.InitializeRoutes(api)
 
+	// Purge old deleted products in the background until we shut down
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+	go api.Purge(purgeCtx)
+
 	// App SIGINT or SIGTERM handling
 	// use a buffered channel or risk missing the signal
 	sigs := make(chan os.Signal, 1)
@@ -0,0 +1,183 @@
+// Package auth authenticates requests and keeps who made them in the
+// request's context.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dstroot/postgres-api/middleware/requestid"
+	"github.com/dstroot/postgres-api/models"
+	"github.com/urfave/negroni"
+)
+
+// APIKeyHeader is the header clients can send their API key in, instead
+// of as a bearer token.
+const APIKeyHeader = "X-API-Key"
+
+// How a request was authenticated.
+const (
+	MethodAPIKey = "apikey"
+	MethodJWT    = "jwt"
+)
+
+// Principal is who made a request.
+type Principal struct {
+	// Subject identifies the client, an API key is "apikey:<name>", so
+	// that it stays the same when the key is rotated, and a token
+	// "jwt:<sub>", so that a token can't pass itself off as an API key.
+	// Every token is signed by a key in our one key set, so sub claims
+	// don't collide, and leaving out the issuer's URL keeps subjects
+	// usable in admin API paths.
+	Subject string
+
+	// Name is a human readable name for the client.
+	Name string
+
+	// Method is how the request was authenticated.
+	Method string
+
+	// Scopes are the scopes granted by a token.
+	Scopes []string
+}
+
+// HasScope reports whether p may do what scope covers. API keys are for
+// our own services and aren't limited to scopes.
+func (p Principal) HasScope(scope string) bool {
+	return p.Method == MethodAPIKey || contains(p.Scopes, scope)
+}
+
+type key struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, key{}, p)
+}
+
+// FromContext returns the principal stored in ctx, and false if the
+// request wasn't authenticated.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(key{}).(Principal)
+	return p, ok
+}
+
+// KeyAuthenticator checks API keys, *model.APIKeyCache is one.
+type KeyAuthenticator interface {
+	Authenticate(ctx context.Context, key string) (model.APIKey, error)
+}
+
+// New returns middleware that only lets requests through that have a
+// valid API key, sent as a bearer token or in the X-API-Key header, or a
+// valid bearer JWT. Either keys or tokens can be nil to not accept that
+// kind of credential. Bearer tokens starting with the API key prefix are
+// API keys. Paths in public are let through without credentials; a
+// public path ending in a slash covers every path under it.
+func New(keys KeyAuthenticator, tokens *TokenVerifier, public ...string) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if isPublic(r.URL.Path, public) {
+			next(w, r)
+			return
+		}
+
+		presented, bearer := BearerToken(r)
+		if !bearer {
+			presented = r.Header.Get(APIKeyHeader)
+		}
+
+		var p Principal
+		switch {
+		case presented == "":
+			deny(w, r, http.StatusUnauthorized, "Credentials are required")
+			return
+		case keys != nil && (!bearer || strings.HasPrefix(presented, model.APIKeyPrefix)):
+			k, err := keys.Authenticate(r.Context(), presented)
+			switch {
+			case err == model.ErrInvalidAPIKey:
+				deny(w, r, http.StatusUnauthorized, "The API key is invalid, expired or revoked")
+				return
+			case err != nil:
+				deny(w, r, http.StatusServiceUnavailable, "API keys can't be checked right now")
+				return
+			}
+			p = Principal{Subject: "apikey:" + k.Name, Name: k.Name, Method: MethodAPIKey}
+		case tokens != nil && bearer:
+			claims, err := tokens.Verify(presented, time.Now())
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token", error_description="`+err.Error()+`"`)
+				deny(w, r, http.StatusUnauthorized, "The token is invalid: "+err.Error())
+				return
+			}
+			p = Principal{Subject: "jwt:" + claims.Subject, Name: claims.Subject, Method: MethodJWT, Scopes: claims.Scopes()}
+		default:
+			deny(w, r, http.StatusUnauthorized, "These credentials aren't accepted")
+			return
+		}
+
+		next(w, r.WithContext(NewContext(r.Context(), p)))
+	})
+}
+
+// isPublic reports whether path is one of the public paths.
+func isPublic(path string, public []string) bool {
+	for _, p := range public {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BearerToken returns the token in the request's Authorization header,
+// and false if it doesn't have one.
+func BearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(auth[7:])
+	return token, token != ""
+}
+
+// problem is the RFC 7807 problem this package responds with, in the same
+// shape as the handlers' problems.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// problemTypes are the problem types of the codes we deny requests with.
+var problemTypes = map[int]string{
+	http.StatusUnauthorized:       "/problems/unauthorized",
+	http.StatusForbidden:          "/problems/forbidden",
+	http.StatusServiceUnavailable: "/problems/unavailable",
+}
+
+// deny responds with a problem. A 401 tells the client how to
+// authenticate.
+func deny(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	if code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	}
+
+	p := problem{
+		Type:      problemTypes[code],
+		Title:     http.StatusText(code),
+		Status:    code,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestid.FromContext(r.Context()),
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(p)
+}
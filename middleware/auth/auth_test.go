@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/pkg/errors"
+)
+
+// apiKeys knows one API key, and fails for another.
+type apiKeys struct{}
+
+func (apiKeys) Authenticate(ctx context.Context, key string) (model.APIKey, error) {
+	switch key {
+	case "pk_good":
+		return model.APIKey{ID: 7, Name: "ci"}, nil
+	case "pk_down":
+		return model.APIKey{}, errors.New("connection refused")
+	}
+	return model.APIKey{}, model.ErrInvalidAPIKey
+}
+
+func TestNewAPIKeys(t *testing.T) {
+
+	var got Principal
+	var authenticated bool
+	next := func(w http.ResponseWriter, r *http.Request) {
+		got, authenticated = FromContext(r.Context())
+	}
+	mw := New(apiKeys{}, nil, "/health", "/admin/")
+
+	for _, c := range []struct {
+		path, header, value string
+		code                int
+		subject             string
+	}{
+		{"/products", "Authorization", "Bearer pk_good", http.StatusOK, "apikey:ci"},
+		{"/products", APIKeyHeader, "pk_good", http.StatusOK, "apikey:ci"},
+		{"/products", "Authorization", "Bearer pk_bad", http.StatusUnauthorized, ""},
+		{"/products", APIKeyHeader, "pk_down", http.StatusServiceUnavailable, ""},
+		{"/products", "", "", http.StatusUnauthorized, ""},
+		{"/health", "", "", http.StatusOK, ""},
+		{"/admin/keys", "", "", http.StatusOK, ""},
+		{"/administrator", "", "", http.StatusUnauthorized, ""},
+	} {
+		got, authenticated = Principal{}, false
+		req, _ := http.NewRequest("GET", c.path, nil)
+		if c.header != "" {
+			req.Header.Set(c.header, c.value)
+		}
+		res := httptest.NewRecorder()
+		mw(res, req, next)
+
+		if res.Code != c.code || got.Subject != c.subject || authenticated != (c.subject != "") {
+			t.Errorf("%s %s: expected %d for %q. Got %d for %+v", c.path, c.value, c.code, c.subject, res.Code, got)
+		}
+		if res.Code == http.StatusUnauthorized {
+			if res.Header().Get("WWW-Authenticate") == "" || res.Header().Get("Content-Type") != "application/problem+json" {
+				t.Errorf("%s: expected a problem with a WWW-Authenticate header. Got %v", c.path, res.Header())
+			}
+		}
+	}
+}
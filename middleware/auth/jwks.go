@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// refetchAfter is how long a KeySet waits before loading its keys again
+// to look for a key id it doesn't know, so that tokens with made up key
+// ids can't make us hammer the source.
+const refetchAfter = time.Minute
+
+// maxJWKS bounds the size of a JWKS document.
+const maxJWKS = 1 << 20
+
+// jwk is a public key from a JSON Web Key Set, RFC 7517. Only the fields
+// of RSA, P-256 and Ed25519 signing keys are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey is a parsed jwk, with the algorithm it verifies.
+type publicKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// KeySet is the set of public keys tokens are signed with, read from a
+// JWKS file or URL. The keys are loaded again every MaxAge, and when a
+// token names a key that isn't in the set, so that the issuer can rotate
+// its keys.
+type KeySet struct {
+	Source string
+	MaxAge time.Duration
+	Client *http.Client
+
+	mu     sync.Mutex
+	keys   []publicKey
+	loaded time.Time
+	// loading is closed when the keys being loaded are in, and is nil
+	// when they aren't being loaded
+	loading chan struct{}
+}
+
+// NewKeySet loads the keys at source, a file name or an http(s) URL, and
+// returns a KeySet that loads them again every maxAge.
+func NewKeySet(source string, maxAge time.Duration) (*KeySet, error) {
+	s := &KeySet{Source: source, MaxAge: maxAge, Client: &http.Client{Timeout: 5 * time.Second}}
+
+	keys, err := s.fetch()
+	if err != nil {
+		return nil, err
+	}
+	s.keys, s.loaded = keys, time.Now()
+
+	return s, nil
+}
+
+// lookup returns the keys that can verify a token signed with alg by the
+// key kid, which matches any key if it is empty. The keys are loaded
+// outside the lock, by one request at a time: the others go on with the
+// keys they have, or wait for the new ones if they have none.
+func (s *KeySet) lookup(kid, alg string) []publicKey {
+	s.mu.Lock()
+	found := s.find(kid, alg)
+	age := time.Since(s.loaded)
+	if age < s.MaxAge && (len(found) > 0 || age < refetchAfter) {
+		s.mu.Unlock()
+		return found
+	}
+	done := s.loading
+	if done == nil {
+		s.loading = make(chan struct{})
+	}
+	s.mu.Unlock()
+
+	if done == nil {
+		s.reload()
+	} else if len(found) > 0 {
+		// the keys we have are better than waiting
+		return found
+	} else {
+		<-done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.find(kid, alg)
+}
+
+// reload loads the keys and swaps them in, keeping the ones we have if
+// that fails, then lets the requests waiting for it go on.
+func (s *KeySet) reload() {
+	keys, err := s.fetch()
+	if err != nil {
+		log.Printf("Loading JWKS from %s failed: %v", s.Source, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		s.keys = keys
+	}
+	s.loaded = time.Now()
+	close(s.loading)
+	s.loading = nil
+}
+
+func (s *KeySet) find(kid, alg string) []publicKey {
+	var found []publicKey
+	for _, k := range s.keys {
+		if k.alg == alg && (kid == "" || k.kid == kid) {
+			found = append(found, k)
+		}
+	}
+
+	return found
+}
+
+// fetch reads and parses the key set. Keys that aren't for signatures
+// with an algorithm we support are skipped.
+func (s *KeySet) fetch() ([]publicKey, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(s.Source, "http://") || strings.HasPrefix(s.Source, "https://") {
+		res, err := s.Client.Get(s.Source)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching JWKS")
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, errors.Errorf("fetching JWKS: %s", res.Status)
+		}
+		r = res.Body
+	} else {
+		f, err := os.Open(s.Source)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading JWKS")
+		}
+		r = f
+	}
+	defer r.Close()
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r, maxJWKS)).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "decoding JWKS")
+	}
+
+	var keys []publicKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.parse()
+		if err != nil {
+			return nil, errors.Wrapf(err, "JWKS key %q", k.Kid)
+		}
+		if key.key != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// parse returns the public key k holds. A key of a type we don't use has
+// a nil key.
+func (k jwk) parse() (publicKey, error) {
+	key := publicKey{kid: k.Kid}
+
+	switch {
+	case k.Kty == "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return key, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return key, errors.New("bad RSA exponent")
+		}
+		if n.BitLen() < 2048 {
+			return key, errors.New("RSA keys must have at least 2048 bits")
+		}
+		key.alg, key.key = RS256, &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return key, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return key, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return key, errors.New("point is not on P-256")
+		}
+		key.alg, key.key = ES256, &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return key, errors.New("bad Ed25519 key")
+		}
+		key.alg, key.key = EdDSA, ed25519.PublicKey(x)
+	default:
+		return key, nil
+	}
+
+	if k.Alg != "" && k.Alg != key.alg {
+		return publicKey{}, nil
+	}
+
+	return key, nil
+}
+
+// decodeInt decodes a base64url big-endian integer.
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("bad base64url integer")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
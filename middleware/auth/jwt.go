@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The signature algorithms tokens can be signed with.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// Claims are the claims of a token that we use. Times are seconds since
+// the epoch.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+
+	// Scope is a space separated list of scopes, some issuers send a
+	// list in scp instead.
+	Scope string   `json:"scope"`
+	Scp   []string `json:"scp"`
+}
+
+// Scopes returns the scopes the token grants.
+func (c Claims) Scopes() []string {
+	return append(strings.Fields(c.Scope), c.Scp...)
+}
+
+// audience is the aud claim, which is a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(b, []byte(`"`)) {
+		var s string
+		err := json.Unmarshal(b, &s)
+		*a = audience{s}
+		return err
+	}
+
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// TokenVerifier checks JSON Web Tokens, RFC 7519, signed with one of the
+// keys in Keys. Tokens must have an expiry and, if they are set, be
+// issued by Issuer for Audience. Leeway allows for clock skew.
+type TokenVerifier struct {
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
+// Verify checks token and returns its claims, or an error saying what is
+// wrong with it.
+func (v *TokenVerifier) Verify(token string, now time.Time) (Claims, error) {
+	var claims Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("token is malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, errors.New("token header is malformed")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("token signature is malformed")
+	}
+
+	// the algorithm has to be one of ours, so "none" and HMAC with a
+	// public key are never accepted
+	switch header.Alg {
+	case RS256, ES256, EdDSA:
+	default:
+		return claims, errors.New("token algorithm is not accepted")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range v.Keys.lookup(header.Kid, header.Alg) {
+		if verify(k, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return claims, errors.New("token signature is invalid")
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, errors.New("token claims are malformed")
+	}
+
+	return claims, v.check(claims, now)
+}
+
+// check checks the time, issuer and audience claims.
+func (v *TokenVerifier) check(c Claims, now time.Time) error {
+	switch {
+	case c.ExpiresAt == nil:
+		return errors.New("token has no expiry")
+	case now.Add(-v.Leeway).After(unixTime(*c.ExpiresAt)):
+		return errors.New("token has expired")
+	case c.NotBefore != nil && now.Add(v.Leeway).Before(unixTime(*c.NotBefore)):
+		return errors.New("token is not valid yet")
+	case v.Issuer != "" && c.Issuer != v.Issuer:
+		return errors.New("token has the wrong issuer")
+	case v.Audience != "" && !contains(c.Audience, v.Audience):
+		return errors.New("token is not for this audience")
+	}
+
+	return nil
+}
+
+// verify checks sig is k's signature of signed.
+func verify(k publicKey, signed, sig []byte) bool {
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		h := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// the signature is r and s, 32 bytes each
+		if len(sig) != 64 {
+			return false
+		}
+		h := sha256.Sum256(signed)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, h[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, sig)
+	}
+
+	return false
+}
+
+// decodeSegment decodes a base64url JSON segment of a token into v.
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// unixTime converts seconds since the epoch to a time.
+func unixTime(secs float64) time.Time {
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
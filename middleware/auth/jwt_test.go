@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signer makes tokens signed with a fresh key of each algorithm, and
+// publishes the public keys as a JWKS.
+type signer struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	jwks    []byte
+	dropped bool
+}
+
+func newSigner(t *testing.T) *signer {
+	s := &signer{}
+	var err error
+	if s.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if s.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, s.ed, _ = ed25519.GenerateKey(rand.Reader)
+
+	s.jwks, _ = json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64.EncodeToString(s.rsa.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": pad32(s.ec.X), "y": pad32(s.ec.Y)},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64.EncodeToString(s.ed.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}})
+
+	return s
+}
+
+func pad32(n *big.Int) string {
+	b := make([]byte, 32)
+	return b64.EncodeToString(n.FillBytes(b))
+}
+
+// token returns a token with claims, signed with alg by the key kid.
+func (s *signer) token(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case RS256:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsa, crypto.SHA256, h[:])
+	case ES256:
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, s.ec, h[:])
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	case EdDSA:
+		sig = ed25519.Sign(s.ed, []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func TestTokenVerifier(t *testing.T) {
+
+	s := newSigner(t)
+	dir, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(file, s.jwks, 0600)
+
+	keys, err := NewKeySet(file, time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	v := &TokenVerifier{Keys: keys, Issuer: "https://issuer", Audience: "products", Leeway: time.Minute}
+
+	if _, err := NewKeySet(filepath.Join(dir, "nope.json"), time.Hour); err == nil {
+		t.Errorf("Expected an error for a missing JWKS")
+	}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://issuer", "sub": "user-1", "aud": []string{"other", "products"},
+			"exp": now.Add(time.Hour).Unix(), "nbf": now.Unix(), "scope": "products:read products:write",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	for _, alg := range []struct{ alg, kid string }{{RS256, "rsa"}, {ES256, "ec"}, {EdDSA, "ed"}, {EdDSA, ""}} {
+		got, err := v.Verify(s.token(t, alg.alg, alg.kid, claims(nil)), now)
+		if err != nil || got.Subject != "user-1" || len(got.Scopes()) != 2 {
+			t.Errorf("%s: expected a valid token. Got %+v (%v)", alg.alg, got, err)
+		}
+	}
+
+	for name, token := range map[string]string{
+		"expired":         s.token(t, RS256, "rsa", claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+		"no expiry":       s.token(t, RS256, "rsa", claims(map[string]interface{}{"exp": nil})),
+		"not yet valid":   s.token(t, RS256, "rsa", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		"wrong issuer":    s.token(t, RS256, "rsa", claims(map[string]interface{}{"iss": "https://evil"})),
+		"wrong audience":  s.token(t, RS256, "rsa", claims(map[string]interface{}{"aud": "other"})),
+		"wrong key":       s.token(t, ES256, "ed", claims(nil)),
+		"unknown key":     s.token(t, EdDSA, "nope", claims(nil)),
+		"none":            b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + b64.EncodeToString([]byte(`{"sub":"x"}`)) + ".",
+		"tampered claims": s.token(t, RS256, "rsa", claims(nil))[:10] + "x" + s.token(t, RS256, "rsa", claims(nil))[11:],
+		"malformed":       "abc",
+	} {
+		if _, err := v.Verify(token, now); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// the leeway allows for clock skew
+	token := s.token(t, EdDSA, "ed", claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix(), "aud": "products"}))
+	if _, err := v.Verify(token, now); err != nil {
+		t.Errorf("Expected a token within the leeway to be valid. Got %v", err)
+	}
+}
+
+func TestKeySetURL(t *testing.T) {
+
+	// the key set is loaded again when a token names a key it doesn't
+	// have, so the issuer can rotate keys
+	old, s := newSigner(t), newSigner(t)
+	jwks := old.jwks
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	keys, err := NewKeySet(server.URL, time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	v := &TokenVerifier{Keys: keys}
+	token := s.token(t, ES256, "ec2", map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+
+	jwks = bytes.Replace(s.jwks, []byte(`"kid":"ec"`), []byte(`"kid":"ec2"`), 1)
+	if _, err := v.Verify(token, time.Now()); err == nil {
+		t.Errorf("Expected the keys not to be loaded again so soon")
+	}
+	keys.loaded = time.Now().Add(-refetchAfter)
+	if _, err := v.Verify(token, time.Now()); err != nil {
+		t.Errorf("Expected the new key to be loaded. Got %v", err)
+	}
+
+	// a slow refresh doesn't hold up tokens signed with a key we have
+	release := make(chan struct{})
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write(jwks)
+	})
+	keys.loaded = time.Now().Add(-time.Hour)
+	unknown := s.token(t, EdDSA, "nope", map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+	refreshed := make(chan struct{})
+	go func() {
+		v.Verify(unknown, time.Now())
+		close(refreshed)
+	}()
+	for loading := false; !loading; time.Sleep(time.Millisecond) {
+		keys.mu.Lock()
+		loading = keys.loading != nil
+		keys.mu.Unlock()
+	}
+	if _, err := v.Verify(token, time.Now()); err != nil {
+		t.Errorf("Expected the cached key to be used during a refresh. Got %v", err)
+	}
+	close(release)
+	<-refreshed
+}
+
+func TestNewJWT(t *testing.T) {
+
+	s := newSigner(t)
+	dir, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(file, s.jwks, 0600)
+	keys, _ := NewKeySet(file, time.Hour)
+
+	router := httprouter.New()
+	ok := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+	policy := Policy{}
+	router.GET("/products", policy.Require("products:read")(ok))
+	router.POST("/product", policy.Require("products:write")(ok))
+	mw := New(apiKeys{}, &TokenVerifier{Keys: keys})
+
+	exp := time.Now().Add(time.Hour).Unix()
+	reader := s.token(t, RS256, "rsa", map[string]interface{}{"sub": "u", "exp": exp, "scp": []string{"products:read"}})
+	expired := s.token(t, RS256, "rsa", map[string]interface{}{"sub": "u", "exp": exp - 7200})
+
+	for _, c := range []struct {
+		method, path, auth string
+		code               int
+	}{
+		{"GET", "/products", "Bearer " + reader, http.StatusOK},
+		{"POST", "/product", "Bearer " + reader, http.StatusForbidden},
+		{"POST", "/product", "Bearer pk_good", http.StatusOK},
+		{"GET", "/products", "Bearer " + expired, http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest(c.method, c.path, nil)
+		req.Header.Set("Authorization", c.auth)
+		res := httptest.NewRecorder()
+		mw(res, req, router.ServeHTTP)
+
+		if res.Code != c.code {
+			t.Errorf("%s %s: expected %d. Got %d %s", c.method, c.path, c.code, res.Code, res.Body)
+		}
+		if c.code == http.StatusForbidden && res.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Expected an insufficient_scope challenge")
+		}
+	}
+
+	// a token's subject can't be mistaken for an API key's
+	var got Principal
+	spoof := s.token(t, RS256, "rsa", map[string]interface{}{"sub": "apikey:ci", "exp": exp})
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Authorization", "Bearer "+spoof)
+	mw(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) {
+		got, _ = FromContext(r.Context())
+	})
+	if got.Subject != "jwt:apikey:ci" || got.Method != MethodJWT {
+		t.Errorf("Expected the token's subject to be namespaced. Got %+v", got)
+	}
+
+	// without authentication scopes aren't checked
+	req, _ = http.NewRequest("POST", "/product", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected 200. Got %d", res.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dstroot/postgres-api/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// PermissionSource returns the permissions a subject's roles give it,
+// *model.RoleCache is one.
+type PermissionSource interface {
+	Permissions(ctx context.Context, subject string) ([]string, error)
+}
+
+// Policy decides what authenticated clients may do. A client needs a
+// role with the permission a route requires and, if it presented a
+// token, the scope of the same name as well. Without Roles only scopes
+// are checked.
+type Policy struct {
+	Roles PermissionSource
+}
+
+// Require wraps the handlers of routes that need permission. Requests
+// without it get a 403. Requests that weren't authenticated at all, which
+// only happens with authentication turned off, are let through.
+func (policy Policy) Require(permission string) func(httprouter.Handle) httprouter.Handle {
+	return func(next httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+			p, ok := FromContext(r.Context())
+			if !ok {
+				next(w, r, param)
+				return
+			}
+
+			if !p.HasScope(permission) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="insufficient_scope", scope="`+permission+`"`)
+				deny(w, r, http.StatusForbidden, "The token needs the "+permission+" scope")
+				return
+			}
+
+			if policy.Roles != nil {
+				granted, err := policy.Roles.Permissions(r.Context(), p.Subject)
+				switch {
+				case r.Context().Err() != nil:
+					// the client went away
+					return
+				case err != nil:
+					deny(w, r, http.StatusServiceUnavailable, "Permissions can't be checked right now")
+					return
+				case !model.Allows(granted, permission):
+					deny(w, r, http.StatusForbidden, p.Subject+" needs a role with the "+permission+" permission")
+					return
+				}
+			}
+
+			next(w, r, param)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// permissions gives subjects fixed permissions.
+type permissions map[string][]string
+
+func (p permissions) Permissions(ctx context.Context, subject string) ([]string, error) {
+	if subject == "down" {
+		return nil, errors.New("connection refused")
+	}
+	return p[subject], nil
+}
+
+func TestPolicy(t *testing.T) {
+
+	policy := Policy{Roles: permissions{
+		"apikey:partner": {"products:read"},
+		"apikey:editor":  {"products:*"},
+		"user-1":         {"*"},
+	}}
+	ok := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+	read, write := policy.Require("products:read")(ok), policy.Require("products:write")(ok)
+
+	for _, c := range []struct {
+		principal *Principal
+		handle    httprouter.Handle
+		code      int
+	}{
+		{&Principal{Subject: "apikey:partner", Method: MethodAPIKey}, read, http.StatusOK},
+		{&Principal{Subject: "apikey:partner", Method: MethodAPIKey}, write, http.StatusForbidden},
+		{&Principal{Subject: "apikey:editor", Method: MethodAPIKey}, write, http.StatusOK},
+		{&Principal{Subject: "apikey:nobody", Method: MethodAPIKey}, read, http.StatusForbidden},
+		{&Principal{Subject: "user-1", Method: MethodJWT, Scopes: []string{"products:read"}}, read, http.StatusOK},
+		{&Principal{Subject: "user-1", Method: MethodJWT, Scopes: []string{"products:read"}}, write, http.StatusForbidden},
+		{&Principal{Subject: "down", Method: MethodAPIKey}, read, http.StatusServiceUnavailable},
+		{nil, write, http.StatusOK},
+	} {
+		req, _ := http.NewRequest("DELETE", "/product/1", nil)
+		if c.principal != nil {
+			req = req.WithContext(NewContext(req.Context(), *c.principal))
+		}
+		res := httptest.NewRecorder()
+		c.handle(res, req, nil)
+
+		if res.Code != c.code {
+			t.Errorf("%+v: expected %d. Got %d", c.principal, c.code, res.Code)
+		}
+		if res.Code == http.StatusForbidden && res.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("Expected a problem. Got %v", res.Header())
+		}
+	}
+}
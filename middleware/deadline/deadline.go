@@ -0,0 +1,53 @@
+// Package deadline lets handlers that stream long responses, or take long
+// to handle a request, push back the server's timeouts. Negroni wraps the
+// ResponseWriter our handlers get in one that hides the connection's
+// deadlines, so the controller for the connection is put in the request's
+// context before any middleware runs.
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type key struct{}
+
+// Handler wraps the server's handler, h, so that Extend and Allow can
+// reach the connection of every request.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), key{}, rc)))
+	})
+}
+
+// Extend gives the response to r until d from now to be written. It
+// returns http.ErrNotSupported if r didn't come through Handler.
+func Extend(r *http.Request, d time.Duration) error {
+	rc, ok := r.Context().Value(key{}).(*http.ResponseController)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	return rc.SetWriteDeadline(time.Now().Add(d))
+}
+
+// Allow wraps the handler of a route that can take longer than the
+// server's timeouts, like a bulk request, giving it until d from when it
+// starts to read the request and write its response. Zero leaves the
+// server's timeouts alone.
+func Allow(d time.Duration) func(httprouter.Handle) httprouter.Handle {
+	return func(next httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, param httprouter.Params) {
+			if rc, ok := r.Context().Value(key{}).(*http.ResponseController); ok && d > 0 {
+				rc.SetReadDeadline(time.Now().Add(d))
+				rc.SetWriteDeadline(time.Now().Add(d))
+			}
+
+			next(w, r, param)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package deadline
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestDeadlines(t *testing.T) {
+
+	// Responses that take longer than the server's write timeout must
+	// still arrive whole when their deadline is pushed back.
+	router := httprouter.New()
+	router.GET("/extend", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if err := Extend(r, time.Second); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	router.GET("/allow", Allow(time.Second)(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+
+	s := httptest.NewUnstartedServer(Handler(router))
+	s.Config.WriteTimeout = 50 * time.Millisecond
+	s.Start()
+	defer s.Close()
+
+	for _, path := range []string{"/extend", "/allow"} {
+		res, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "done" {
+			t.Errorf("%s: expected the whole response. Got %q", path, body)
+		}
+	}
+
+	// without Handler there is nothing to extend
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := Extend(req, time.Second); err != http.ErrNotSupported {
+		t.Errorf("Expected ErrNotSupported. Got %v", err)
+	}
+}
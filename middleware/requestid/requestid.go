@@ -0,0 +1,55 @@
+// Package requestid tags every request with an id so that a problem
+// reported to a client can be matched with our logs.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/urfave/negroni"
+)
+
+// Header is the request and response header that carries the id.
+const Header = "X-Request-ID"
+
+// valid matches ids we are willing to accept from a client (or a proxy in
+// front of us). Anything else is replaced with one of our own.
+var valid = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type key struct{}
+
+// New returns middleware that reuses a valid incoming X-Request-ID or
+// generates a new one, echoes it in the response and stores it in the
+// request's context.
+func New() negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		id := r.Header.Get(Header)
+		if !valid.MatchString(id) {
+			id = generate()
+		}
+
+		w.Header().Set(Header, id)
+		next(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, key{}, id)
+}
+
+// FromContext returns the request id stored in ctx, or "" if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(key{}).(string)
+	return id
+}
+
+// generate returns a random 128 bit id.
+func generate() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
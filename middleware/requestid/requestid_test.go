@@ -0,0 +1,46 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+
+	var got string
+	next := func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}
+	mw := New()
+
+	// an id is generated when none is supplied
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	mw(res, req, next)
+
+	if len(got) != 32 {
+		t.Errorf("Expected a generated id. Got '%s'", got)
+	}
+	if res.Header().Get(Header) != got {
+		t.Errorf("Expected the id to be echoed. Got '%s'", res.Header().Get(Header))
+	}
+
+	// a valid incoming id is reused
+	req.Header.Set(Header, "abc-123")
+	res = httptest.NewRecorder()
+	mw(res, req, next)
+
+	if got != "abc-123" {
+		t.Errorf("Expected 'abc-123'. Got '%s'", got)
+	}
+
+	// an invalid incoming id is replaced
+	req.Header.Set(Header, "<script>")
+	res = httptest.NewRecorder()
+	mw(res, req, next)
+
+	if got == "<script>" || len(got) != 32 {
+		t.Errorf("Expected a generated id. Got '%s'", got)
+	}
+}
@@ -0,0 +1,321 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package migrations manages our database schema. Migrations are pairs of
+// SQL files embedded in the binary, named <version>_<name>.up.sql and
+// <version>_<name>.down.sql, and are applied in version order. Applied
+// versions are recorded in the schema_migrations table and a Postgres
+// advisory lock makes sure only one replica migrates at a time.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// lockID is the key we use with pg_advisory_lock. It is arbitrary but must
+// be the same for every replica.
+const lockID = 7233580187
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+version BIGINT NOT NULL,
+name TEXT NOT NULL,
+applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+)`
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Load reads the migrations in the root of fsys and returns them sorted by
+// version. Every migration must have both an up and a down file.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, errors.Wrap(err, "reading migrations")
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		match := fileName.FindStringSubmatch(e.Name())
+		if match == nil {
+			return nil, errors.Errorf("unexpected migration file %q", e.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "migration file %q", e.Name())
+		}
+
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading migration file %q", e.Name())
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, errors.Errorf("duplicate migration version %d", version)
+		}
+
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, errors.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// New returns a Migrator for db using the migrations embedded in the
+// binary.
+func New(db *sql.DB) (*Migrator, error) {
+	sub, err := fs.Sub(files, "sql")
+	if err != nil {
+		return nil, errors.Wrap(err, "reading migrations")
+	}
+
+	migrations, err := Load(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+// Version returns the highest applied migration version, or 0 if no
+// migrations have been applied.
+func (m *Migrator) Version() (int, error) {
+	applied, err := m.applied(m.DB)
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+
+	return version, nil
+}
+
+// Pending returns the migrations that have not been applied yet.
+func (m *Migrator) Pending() ([]Migration, error) {
+	applied, err := m.applied(m.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.pending(applied), nil
+}
+
+// Up applies every pending migration in version order and returns the
+// migrations it applied. Each migration runs in its own transaction.
+func (m *Migrator) Up() (done []Migration, err error) {
+	err = m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.pending(applied) {
+			err = run(ctx, conn, mig.Up,
+				"INSERT INTO schema_migrations(version, name) VALUES($1, $2)",
+				mig.Version, mig.Name)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d_%s up", mig.Version, mig.Name)
+			}
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down rolls back the most recently applied migration and returns it. It
+// returns a nil migration if there is nothing to roll back.
+func (m *Migrator) Down() (done *Migration, err error) {
+	err = m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.Migrations) - 1; i >= 0; i-- {
+			mig := m.Migrations[i]
+			if !applied[mig.Version] {
+				continue
+			}
+
+			err = run(ctx, conn, mig.Down,
+				"DELETE FROM schema_migrations WHERE version=$1",
+				mig.Version)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d_%s down", mig.Version, mig.Name)
+			}
+			done = &mig
+			return nil
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// pending returns the migrations whose versions are not in applied.
+func (m *Migrator) pending(applied map[int]bool) []Migration {
+	var pending []Migration
+	for _, mig := range m.Migrations {
+		if !applied[mig.Version] {
+			pending = append(pending, mig)
+		}
+	}
+
+	return pending
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Conn.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// applied returns the set of applied migration versions, which is empty
+// if the schema_migrations table does not exist yet. It is only created
+// by withLock, under the lock, so replicas starting together don't race.
+func (m *Migrator) applied(db queryer) (map[int]bool, error) {
+	ctx := context.Background()
+	applied := make(map[int]bool)
+
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading schema_migrations")
+	}
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, errors.Wrap(err, "reading schema_migrations")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+// withLock runs fn on a single connection while holding our advisory
+// lock, so that replicas starting together don't race each other. The
+// schema_migrations table is created first if it does not exist.
+func (m *Migrator) withLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "database connection failed")
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockID); err != nil {
+		return errors.Wrap(err, "acquiring migration lock")
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lockID)
+
+	if _, err := conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return errors.Wrap(err, "creating schema_migrations")
+	}
+
+	return fn(ctx, conn)
+}
+
+// run executes a migration script and the matching schema_migrations
+// bookkeeping statement in one transaction.
+func run(ctx context.Context, conn *sql.Conn, script, track string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, track, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,251 @@
+package migrations
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	// Load environment vars
+	_ "github.com/joho/godotenv/autoload"
+	// Postgres driver
+	_ "github.com/lib/pq"
+)
+
+// openDB connects to the Postgres database configured in our environment.
+// The test is skipped when the database can't be reached.
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("postgres", "postgres://"+os.Getenv("SQL_USER")+
+		":"+os.Getenv("SQL_PASSWORD")+
+		"@"+os.Getenv("SQL_HOST")+
+		":"+os.Getenv("SQL_PORT")+
+		"/"+os.Getenv("SQL_DATABASE")+
+		"?sslmode=disable")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skipf("Skipping, Postgres is not available: %s", err)
+	}
+
+	return db
+}
+
+func TestLoad(t *testing.T) {
+
+	// This test loads migrations out of order and checks they are
+	// sorted by version.
+	fsys := fstest.MapFS{
+		"0010_second.up.sql":   {Data: []byte("up 10")},
+		"0010_second.down.sql": {Data: []byte("down 10")},
+		"0002_first.up.sql":    {Data: []byte("up 2")},
+		"0002_first.down.sql":  {Data: []byte("down 2")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("Expected 2 migrations. Got %v", len(migrations))
+	}
+
+	first := migrations[0]
+	if first.Version != 2 || first.Name != "first" || first.Up != "up 2" || first.Down != "down 2" {
+		t.Errorf("Unexpected first migration %+v", first)
+	}
+
+	if migrations[1].Version != 10 {
+		t.Errorf("Expected version 10 second. Got %v", migrations[1].Version)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+
+	// Each of these sets of files is invalid and should be rejected.
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"0001_a.up.sql": {Data: []byte("up")},
+		},
+		"bad name": {
+			"create_table.sql": {Data: []byte("up")},
+		},
+		"duplicate version": {
+			"0001_a.up.sql":   {Data: []byte("up")},
+			"0001_a.down.sql": {Data: []byte("down")},
+			"0001_b.up.sql":   {Data: []byte("up")},
+			"0001_b.down.sql": {Data: []byte("down")},
+		},
+	}
+
+	for name, fsys := range tests {
+		if _, err := Load(fsys); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+
+	// The migrations compiled into the binary must be valid.
+	m, err := New(nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if len(m.Migrations) == 0 || m.Migrations[0].Version != 1 {
+		t.Errorf("Expected migrations to start at version 1. Got %+v", m.Migrations)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+
+	m, err := New(db)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// apply everything
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	pending, err := m.Pending()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending migrations. Got %v", len(pending))
+	}
+
+	latest := m.Migrations[len(m.Migrations)-1]
+	version, err := m.Version()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if version != latest.Version {
+		t.Errorf("Expected version %v. Got %v", latest.Version, version)
+	}
+
+	// roll back the latest and re-apply it
+	down, err := m.Down()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if down == nil || down.Version != latest.Version {
+		t.Errorf("Expected to roll back %v. Got %+v", latest.Version, down)
+	}
+
+	done, err := m.Up()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(done) != 1 || done[0].Version != latest.Version {
+		t.Errorf("Expected to re-apply %v. Got %+v", latest.Version, done)
+	}
+}
+
+func TestStatusReadOnly(t *testing.T) {
+
+	// Version and Pending don't take the lock, so they must not create
+	// schema_migrations on a database that has never been migrated.
+	db := openDB(t)
+	defer db.Close()
+
+	// a fresh schema on our only connection stands in for a new database
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE SCHEMA migrations_status"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer db.Exec("DROP SCHEMA migrations_status CASCADE")
+	if _, err := db.Exec("SET search_path TO migrations_status"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	m, err := New(db)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	version, err := m.Version()
+	if err != nil || version != 0 {
+		t.Errorf("Expected version 0. Got %v, %v", version, err)
+	}
+	pending, err := m.Pending()
+	if err != nil || len(pending) != len(m.Migrations) {
+		t.Errorf("Expected %v pending migrations. Got %v, %v", len(m.Migrations), len(pending), err)
+	}
+
+	var exists bool
+	db.QueryRow("SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if exists {
+		t.Errorf("Expected schema_migrations not to be created")
+	}
+}
+
+func TestRolesUpgrade(t *testing.T) {
+
+	// API keys that could change products before there were roles must
+	// keep doing so once the roles migration is applied, while everyone
+	// else can only read them.
+	db := openDB(t)
+	defer db.Close()
+
+	m, err := New(db)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// roll back to just before the roles migration and upgrade again
+	for {
+		version, err := m.Version()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if version < 10 {
+			break
+		}
+		if _, err := m.Down(); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	db.Exec("DELETE FROM api_keys WHERE name = 'existing'")
+	_, err = db.Exec("INSERT INTO api_keys (name, prefix, hash) VALUES ('existing', 'pk_test', 'upgrade')")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer db.Exec("DELETE FROM api_keys WHERE name = 'existing'")
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	permissions := func(subject string) []string {
+		var granted []string
+		rows, err := db.Query("SELECT DISTINCT permission FROM role_bindings JOIN role_permissions USING (role) "+
+			"WHERE subject IN ($1, '*') ORDER BY permission", subject)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var p string
+			rows.Scan(&p)
+			granted = append(granted, p)
+		}
+		return granted
+	}
+
+	if p := permissions("apikey:existing"); len(p) != 2 || p[0] != "products:read" || p[1] != "products:write" {
+		t.Errorf("Expected an existing key to keep reading and changing products. Got %v", p)
+	}
+	if p := permissions("apikey:partner"); len(p) != 1 || p[0] != "products:read" {
+		t.Errorf("Expected a new key to only read products. Got %v", p)
+	}
+}
@@ -0,0 +1,3 @@
+-- version is bumped by every update so that clients can detect concurrent
+-- changes, see the ETag and If-Match handling in the handlers package.
+ALTER TABLE products ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
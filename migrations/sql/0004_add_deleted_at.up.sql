@@ -0,0 +1,6 @@
+-- Deleted products are moved to the trash by setting deleted_at, and only
+-- purged for good once they have been there longer than the retention.
+ALTER TABLE products ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- the purge job scans for old trash, live rows are left out of the index
+CREATE INDEX products_deleted_at_idx ON products (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS products_updated_at_idx;
+DROP TRIGGER IF EXISTS products_set_updated_at ON products;
+DROP FUNCTION IF EXISTS products_set_updated_at();
+ALTER TABLE products DROP COLUMN IF EXISTS updated_at, DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,17 @@
+ALTER TABLE products
+ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- keep updated_at current however a row is changed, so that clients can
+-- sync incrementally with updated_since
+CREATE FUNCTION products_set_updated_at() RETURNS trigger AS $$
+BEGIN
+	NEW.updated_at = now();
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER products_set_updated_at BEFORE UPDATE ON products
+FOR EACH ROW EXECUTE PROCEDURE products_set_updated_at();
+
+CREATE INDEX products_updated_at_idx ON products (updated_at, id);
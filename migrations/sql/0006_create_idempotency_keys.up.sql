@@ -0,0 +1,16 @@
+-- the first response to a request made with an Idempotency-Key, replayed
+-- when the request is retried. status is NULL while the request is being
+-- handled.
+CREATE TABLE idempotency_keys
+(
+key TEXT NOT NULL,
+request_hash TEXT NOT NULL,
+status INTEGER,
+header JSONB,
+body BYTEA,
+created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+expires_at TIMESTAMPTZ NOT NULL,
+CONSTRAINT idempotency_keys_pkey PRIMARY KEY (key)
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
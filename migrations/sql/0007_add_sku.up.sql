@@ -0,0 +1,6 @@
+-- sku is a natural key that external systems can use instead of our id.
+-- It is optional, and only unique among the products that aren't in the
+-- trash, so a deleted product doesn't hold on to its sku.
+ALTER TABLE products ADD COLUMN sku TEXT;
+
+CREATE UNIQUE INDEX products_sku_key ON products (sku) WHERE deleted_at IS NULL;
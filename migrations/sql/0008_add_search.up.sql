@@ -0,0 +1,17 @@
+-- full-text search over the product name (add the description here once
+-- products have one). The generated column needs Postgres 12 or later.
+ALTER TABLE products ADD COLUMN search TSVECTOR
+GENERATED ALWAYS AS (to_tsvector('english', coalesce(name, ''))) STORED;
+
+CREATE INDEX products_search_idx ON products USING GIN (search);
+
+-- pg_trgm makes search tolerant of typos, but it is an extension that we
+-- may not be allowed to install; search works without it
+DO $$
+BEGIN
+	CREATE EXTENSION IF NOT EXISTS pg_trgm;
+	CREATE INDEX products_name_trgm_idx ON products USING GIN (name gin_trgm_ops);
+EXCEPTION WHEN OTHERS THEN
+	RAISE NOTICE 'pg_trgm is not available, search will not tolerate typos: %', SQLERRM;
+END;
+$$;
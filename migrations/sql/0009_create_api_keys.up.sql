@@ -0,0 +1,15 @@
+-- API keys are only stored as the SHA-256 hash of the key, the prefix is
+-- kept so that people can tell their keys apart.
+CREATE TABLE api_keys
+(
+id SERIAL,
+name TEXT NOT NULL,
+prefix TEXT NOT NULL,
+hash BYTEA NOT NULL,
+created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+expires_at TIMESTAMPTZ,
+revoked_at TIMESTAMPTZ,
+last_used_at TIMESTAMPTZ,
+CONSTRAINT api_keys_pkey PRIMARY KEY (id),
+CONSTRAINT api_keys_hash_key UNIQUE (hash)
+);
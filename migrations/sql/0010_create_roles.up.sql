@@ -0,0 +1,42 @@
+-- roles grant permissions, like products:write, to the subjects bound to
+-- them. A subject is an API key's "apikey:<name>" or a token's "jwt:<sub>".
+CREATE TABLE roles
+(
+name TEXT NOT NULL,
+description TEXT NOT NULL DEFAULT '',
+CONSTRAINT roles_pkey PRIMARY KEY (name)
+);
+
+CREATE TABLE role_permissions
+(
+role TEXT NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+permission TEXT NOT NULL,
+CONSTRAINT role_permissions_pkey PRIMARY KEY (role, permission)
+);
+
+CREATE TABLE role_bindings
+(
+subject TEXT NOT NULL,
+role TEXT NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+CONSTRAINT role_bindings_pkey PRIMARY KEY (subject, role)
+);
+
+-- owner has every permission, but the admin API still needs ADMIN_TOKEN
+INSERT INTO roles (name, description) VALUES
+('reader', 'Can read products'),
+('editor', 'Can read and change products'),
+('owner', 'Has every permission, except for the admin API');
+
+INSERT INTO role_permissions (role, permission) VALUES
+('reader', 'products:read'),
+('editor', 'products:read'),
+('editor', 'products:write'),
+('owner', '*');
+
+-- everyone can read products. Before roles every API key could change
+-- them too, so the keys we have are editors to keep working as they did.
+INSERT INTO role_bindings (subject, role) VALUES
+('*', 'reader');
+
+INSERT INTO role_bindings (subject, role)
+SELECT DISTINCT 'apikey:' || name, 'editor' FROM api_keys WHERE revoked_at IS NULL;
@@ -0,0 +1,4 @@
+-- claim identifies the request holding a key, so that a request whose key
+-- a retry has taken over can't save its response under the retry's claim
+-- or release it.
+ALTER TABLE idempotency_keys ADD COLUMN claim TEXT;
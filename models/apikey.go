@@ -0,0 +1,538 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrAPIKeyNotFound is returned by an APIKeyStore when the requested
+	// key does not exist.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+
+	// ErrInvalidAPIKey is returned by Authenticate when a key is unknown,
+	// expired or revoked.
+	ErrInvalidAPIKey = errors.New("invalid API key")
+)
+
+// APIKeyPrefix starts every API key, so that they can be told apart
+// from other bearer tokens.
+const APIKeyPrefix = "pk_"
+
+// APIKey is a key that clients authenticate with. The key itself is only
+// known when it is made, afterwards it is identified by its Prefix.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Valid reports whether the key can be used at now.
+func (k APIKey) Valid(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// NewAPIKey makes a key called name that expires at expiresAt, or never
+// if it is nil. It returns the key, which is only ever shown to the
+// client, and the hash of it to store.
+func NewAPIKey(name string, expiresAt *time.Time) (k APIKey, key string, hash []byte) {
+	b := make([]byte, 36)
+	rand.Read(b)
+
+	k = APIKey{Name: name, Prefix: APIKeyPrefix + hex.EncodeToString(b[:4]), ExpiresAt: expiresAt}
+	key = k.Prefix + "_" + base64.RawURLEncoding.EncodeToString(b[4:])
+
+	return k, key, HashAPIKey(key)
+}
+
+// HashAPIKey returns the hash an API key is stored and looked up by. Keys
+// are random, so a fast hash is as good as a slow one.
+func HashAPIKey(key string) []byte {
+	h := sha256.Sum256([]byte(key))
+	return h[:]
+}
+
+// APIKeyStore keeps the API keys, by the hash of the key.
+type APIKeyStore interface {
+	// Create stores k with the hash of its key and sets its ID and
+	// CreatedAt.
+	Create(ctx context.Context, k *APIKey, hash []byte) error
+
+	// Get returns the key with the given id, or ErrAPIKeyNotFound.
+	Get(ctx context.Context, id int) (APIKey, error)
+
+	// List returns every key, revoked and expired ones included, by id.
+	List(ctx context.Context) ([]APIKey, error)
+
+	// Lookup returns the key with the given hash, or ErrAPIKeyNotFound.
+	Lookup(ctx context.Context, hash []byte) (APIKey, error)
+
+	// Rotate replaces the key with the given id with k, which gets its
+	// name, and sets the old key to expire after grace unless it expires
+	// sooner. It returns the old key, or ErrAPIKeyNotFound if there is
+	// none or it can't be used any more.
+	Rotate(ctx context.Context, id int, k *APIKey, hash []byte, grace time.Duration) (APIKey, error)
+
+	// Revoke stops the key with the given id from being used and returns
+	// it, or ErrAPIKeyNotFound.
+	Revoke(ctx context.Context, id int) (APIKey, error)
+
+	// Touch records that the key with the given id was used at t.
+	Touch(ctx context.Context, id int, t time.Time) error
+}
+
+// PostgresAPIKeyStore is an APIKeyStore backed by the api_keys table.
+type PostgresAPIKeyStore struct {
+	DB *sql.DB
+
+	// Timeout bounds every query. Zero means queries are only bounded by
+	// the caller's context.
+	Timeout time.Duration
+}
+
+// NewPostgresAPIKeyStore returns a PostgresAPIKeyStore using db, with
+// each query limited to timeout.
+func NewPostgresAPIKeyStore(db *sql.DB, timeout time.Duration) *PostgresAPIKeyStore {
+	return &PostgresAPIKeyStore{DB: db, Timeout: timeout}
+}
+
+const apiKeyColumns = "id, name, prefix, created_at, expires_at, revoked_at, last_used_at"
+
+// scanAPIKey reads a row of apiKeyColumns into k.
+func scanAPIKey(row interface {
+	Scan(dest ...interface{}) error
+}, k *APIKey) error {
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.CreatedAt, &k.ExpiresAt, &k.RevokedAt, &k.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return ErrAPIKeyNotFound
+	}
+
+	return err
+}
+
+// Create stores a new key
+func (s *PostgresAPIKeyStore) Create(ctx context.Context, k *APIKey, hash []byte) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	err := createAPIKey(ctx, s.DB, k, hash)
+
+	return contextError(ctx, err)
+}
+
+func createAPIKey(ctx context.Context, db Querier, k *APIKey, hash []byte) error {
+	return db.QueryRowContext(ctx,
+		"INSERT INTO api_keys (name, prefix, hash, expires_at) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		k.Name, k.Prefix, hash, k.ExpiresAt).Scan(&k.ID, &k.CreatedAt)
+}
+
+// Get gets one key by id
+func (s *PostgresAPIKeyStore) Get(ctx context.Context, id int) (APIKey, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var k APIKey
+	err := scanAPIKey(s.DB.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id=$1", id), &k)
+
+	return k, contextError(ctx, err)
+}
+
+// List fetches every key
+func (s *PostgresAPIKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	keys, err := s.list(ctx)
+
+	return keys, contextError(ctx, err)
+}
+
+func (s *PostgresAPIKeyStore) list(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := scanAPIKey(rows, &k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// Lookup gets one key by the hash of the key
+func (s *PostgresAPIKeyStore) Lookup(ctx context.Context, hash []byte) (APIKey, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var k APIKey
+	err := scanAPIKey(s.DB.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE hash=$1", hash), &k)
+
+	return k, contextError(ctx, err)
+}
+
+// Rotate replaces a key with a new one, in a transaction
+func (s *PostgresAPIKeyStore) Rotate(ctx context.Context, id int, k *APIKey, hash []byte, grace time.Duration) (APIKey, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	old, err := s.rotate(ctx, id, k, hash, grace)
+
+	return old, contextError(ctx, err)
+}
+
+func (s *PostgresAPIKeyStore) rotate(ctx context.Context, id int, k *APIKey, hash []byte, grace time.Duration) (old APIKey, err error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return old, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = scanAPIKey(tx.QueryRowContext(ctx, "UPDATE api_keys "+
+		"SET expires_at = LEAST(expires_at, now() + $2::float8 * interval '1 second') "+
+		"WHERE id=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now()) "+
+		"RETURNING "+apiKeyColumns, id, grace.Seconds()), &old)
+	if err != nil {
+		return old, err
+	}
+
+	k.Name = old.Name
+	if err = createAPIKey(ctx, tx, k, hash); err != nil {
+		return old, err
+	}
+
+	return old, tx.Commit()
+}
+
+// Revoke revokes a key, a key that is already revoked stays as it was
+func (s *PostgresAPIKeyStore) Revoke(ctx context.Context, id int) (APIKey, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var k APIKey
+	err := scanAPIKey(s.DB.QueryRowContext(ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, now()) WHERE id=$1 RETURNING "+apiKeyColumns, id), &k)
+
+	return k, contextError(ctx, err)
+}
+
+// Touch records when a key was used
+func (s *PostgresAPIKeyStore) Touch(ctx context.Context, id int, t time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx,
+		"UPDATE api_keys SET last_used_at = $2 WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < $2)", id, t)
+
+	return contextError(ctx, err)
+}
+
+// withTimeout derives the context for a single query.
+func (s *PostgresAPIKeyStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return queryContext(ctx, s.Timeout)
+}
+
+// MemoryAPIKeyStore is a thread-safe APIKeyStore that keeps keys in
+// memory, for use with a MemoryStore.
+type MemoryAPIKeyStore struct {
+	mu     sync.Mutex
+	keys   map[int]APIKey
+	hashes map[string]int
+	nextID int
+}
+
+// NewMemoryAPIKeyStore returns an empty MemoryAPIKeyStore.
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: make(map[int]APIKey), hashes: make(map[string]int), nextID: 1}
+}
+
+// Create stores a new key
+func (s *MemoryAPIKeyStore) Create(ctx context.Context, k *APIKey, hash []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.create(k, hash)
+	return nil
+}
+
+func (s *MemoryAPIKeyStore) create(k *APIKey, hash []byte) {
+	k.ID, k.CreatedAt = s.nextID, time.Now()
+	k.RevokedAt, k.LastUsedAt = nil, nil
+	s.nextID++
+
+	s.keys[k.ID] = *k
+	s.hashes[string(hash)] = k.ID
+}
+
+// Get gets one key by id
+func (s *MemoryAPIKeyStore) Get(ctx context.Context, id int) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	return k, nil
+}
+
+// List fetches every key
+func (s *MemoryAPIKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []APIKey{}
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys, nil
+}
+
+// Lookup gets one key by the hash of the key
+func (s *MemoryAPIKeyStore) Lookup(ctx context.Context, hash []byte) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.hashes[string(hash)]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	return s.keys[id], nil
+}
+
+// Rotate replaces a key with a new one
+func (s *MemoryAPIKeyStore) Rotate(ctx context.Context, id int, k *APIKey, hash []byte, grace time.Duration) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	old, ok := s.keys[id]
+	if !ok || !old.Valid(now) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	if expires := now.Add(grace); old.ExpiresAt == nil || expires.Before(*old.ExpiresAt) {
+		old.ExpiresAt = &expires
+	}
+	s.keys[id] = old
+
+	k.Name = old.Name
+	s.create(k, hash)
+
+	return old, nil
+}
+
+// Revoke revokes a key, a key that is already revoked stays as it was
+func (s *MemoryAPIKeyStore) Revoke(ctx context.Context, id int) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if k.RevokedAt == nil {
+		now := time.Now()
+		k.RevokedAt = &now
+		s.keys[id] = k
+	}
+
+	return k, nil
+}
+
+// Touch records when a key was used
+func (s *MemoryAPIKeyStore) Touch(ctx context.Context, id int, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.keys[id]; ok && (k.LastUsedAt == nil || k.LastUsedAt.Before(t)) {
+		k.LastUsedAt = &t
+		s.keys[id] = k
+	}
+
+	return nil
+}
+
+// touchEvery is how often the last use of a key is written to the store,
+// so that a busy key doesn't cost a write per request.
+const touchEvery = time.Minute
+
+// maxCachedKeys bounds the size of an APIKeyCache, which also remembers
+// keys that don't exist, so that clients can't fill memory by making
+// them up.
+const maxCachedKeys = 10000
+
+// APIKeyCache is an APIKeyStore that remembers the keys it looked up for
+// TTL, so that authenticating a request doesn't cost a query. Keys
+// rotated or revoked through the cache are forgotten at once, but other
+// replicas only notice once their cached copy expires.
+type APIKeyCache struct {
+	APIKeyStore
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedKey
+}
+
+// cachedKey is a key, or ErrAPIKeyNotFound, as looked up at fetched.
+type cachedKey struct {
+	key     APIKey
+	err     error
+	fetched time.Time
+	touched time.Time
+}
+
+// NewAPIKeyCache returns an APIKeyCache in front of store.
+func NewAPIKeyCache(store APIKeyStore, ttl time.Duration) *APIKeyCache {
+	return &APIKeyCache{APIKeyStore: store, TTL: ttl, entries: make(map[string]cachedKey)}
+}
+
+// Authenticate returns the valid key that key is, or ErrInvalidAPIKey.
+// It records when the key was used, at most every minute.
+func (c *APIKeyCache) Authenticate(ctx context.Context, key string) (APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	hash := HashAPIKey(key)
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[string(hash)]
+	c.mu.Unlock()
+
+	if !ok || now.Sub(e.fetched) >= c.TTL {
+		k, err := c.APIKeyStore.Lookup(ctx, hash)
+		if err != nil && err != ErrAPIKeyNotFound {
+			return APIKey{}, err
+		}
+		e = cachedKey{key: k, err: err, fetched: now, touched: e.touched}
+	}
+
+	valid := e.err == nil && e.key.Valid(now)
+	touch := valid && now.Sub(e.touched) >= touchEvery
+	if touch {
+		e.touched = now
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxCachedKeys {
+		c.entries = make(map[string]cachedKey)
+	}
+	c.entries[string(hash)] = e
+	c.mu.Unlock()
+
+	if !valid {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	if touch {
+		// a failed write isn't worth failing the request for
+		if err := c.APIKeyStore.Touch(ctx, e.key.ID, now); err != nil {
+			log.Printf("Recording use of API key %d failed: %v", e.key.ID, err)
+		}
+	}
+
+	return e.key, nil
+}
+
+// Rotate replaces a key with a new one, and forgets the old one
+func (c *APIKeyCache) Rotate(ctx context.Context, id int, k *APIKey, hash []byte, grace time.Duration) (APIKey, error) {
+	old, err := c.APIKeyStore.Rotate(ctx, id, k, hash, grace)
+	c.forget(id)
+
+	return old, err
+}
+
+// Revoke revokes a key, and forgets it
+func (c *APIKeyCache) Revoke(ctx context.Context, id int) (APIKey, error) {
+	k, err := c.APIKeyStore.Revoke(ctx, id)
+	c.forget(id)
+
+	return k, err
+}
+
+// forget drops the key with the given id from the cache.
+func (c *APIKeyCache) forget(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for hash, e := range c.entries {
+		if e.err == nil && e.key.ID == id {
+			delete(c.entries, hash)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package model
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAPIKeyStore runs the same checks against any APIKeyStore.
+func testAPIKeyStore(t *testing.T, s APIKeyStore) {
+	ctx := context.Background()
+
+	k, key, hash := NewAPIKey("ci", nil)
+	if !strings.HasPrefix(key, k.Prefix+"_") || len(hash) != 32 {
+		t.Errorf("Expected a key starting with its prefix. Got %s, %s", key, k.Prefix)
+	}
+	if err := s.Create(ctx, &k, hash); err != nil || k.ID == 0 || k.CreatedAt.IsZero() {
+		t.Fatalf("Expected the key to be created. Got %+v (%v)", k, err)
+	}
+
+	found, err := s.Lookup(ctx, HashAPIKey(key))
+	if err != nil || found.ID != k.ID || found.Name != "ci" || !found.Valid(time.Now()) {
+		t.Errorf("Expected to look up the key. Got %+v (%v)", found, err)
+	}
+	if _, err = s.Lookup(ctx, HashAPIKey(key+"x")); err != ErrAPIKeyNotFound {
+		t.Errorf("Expected ErrAPIKeyNotFound. Got %v", err)
+	}
+
+	now := time.Now().Round(time.Millisecond)
+	s.Touch(ctx, k.ID, now)
+	s.Touch(ctx, k.ID, now.Add(-time.Minute))
+	if found, _ = s.Get(ctx, k.ID); found.LastUsedAt == nil || !found.LastUsedAt.Equal(now) {
+		t.Errorf("Expected the key to be last used at %v. Got %v", now, found.LastUsedAt)
+	}
+
+	// the rotated key keeps working for the grace period
+	next, _, nextHash := NewAPIKey("", nil)
+	old, err := s.Rotate(ctx, k.ID, &next, nextHash, time.Hour)
+	if err != nil || old.ExpiresAt == nil || !old.Valid(time.Now()) || old.Valid(time.Now().Add(2*time.Hour)) {
+		t.Errorf("Expected the old key to expire in an hour. Got %+v (%v)", old, err)
+	}
+	if next.ID == k.ID || next.Name != "ci" {
+		t.Errorf("Expected a new key with the old one's name. Got %+v", next)
+	}
+
+	// a revoked key can't be used or rotated
+	k, err = s.Revoke(ctx, k.ID)
+	if err != nil || k.RevokedAt == nil || k.Valid(time.Now()) {
+		t.Errorf("Expected the key to be revoked. Got %+v (%v)", k, err)
+	}
+	if _, err = s.Rotate(ctx, k.ID, &APIKey{}, []byte("x"), 0); err != ErrAPIKeyNotFound {
+		t.Errorf("Expected ErrAPIKeyNotFound. Got %v", err)
+	}
+	if _, err = s.Revoke(ctx, -1); err != ErrAPIKeyNotFound {
+		t.Errorf("Expected ErrAPIKeyNotFound. Got %v", err)
+	}
+
+	keys, err := s.List(ctx)
+	if err != nil || len(keys) != 2 || keys[0].ID != k.ID || keys[1].ID != next.ID {
+		t.Errorf("Expected both keys. Got %+v (%v)", keys, err)
+	}
+}
+
+func TestMemoryAPIKeyStore(t *testing.T) {
+	testAPIKeyStore(t, NewMemoryAPIKeyStore())
+}
+
+func TestPostgresAPIKeyStore(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	db.Exec("DELETE FROM api_keys")
+	testAPIKeyStore(t, NewPostgresAPIKeyStore(db, 0))
+	db.Exec("DELETE FROM api_keys")
+}
+
+// countingStore counts the lookups made through it.
+type countingStore struct {
+	*MemoryAPIKeyStore
+	lookups int
+}
+
+func (s *countingStore) Lookup(ctx context.Context, hash []byte) (APIKey, error) {
+	s.lookups++
+	return s.MemoryAPIKeyStore.Lookup(ctx, hash)
+}
+
+func TestAPIKeyCache(t *testing.T) {
+
+	ctx := context.Background()
+	store := &countingStore{MemoryAPIKeyStore: NewMemoryAPIKeyStore()}
+	c := NewAPIKeyCache(store, time.Hour)
+
+	k, key, hash := NewAPIKey("ci", nil)
+	c.Create(ctx, &k, hash)
+
+	// the key is only looked up once, and its use is recorded
+	for i := 0; i < 3; i++ {
+		if found, err := c.Authenticate(ctx, key); err != nil || found.ID != k.ID {
+			t.Errorf("Expected the key. Got %+v (%v)", found, err)
+		}
+	}
+	if store.lookups != 1 {
+		t.Errorf("Expected 1 lookup. Got %d", store.lookups)
+	}
+	if k, _ = c.Get(ctx, k.ID); k.LastUsedAt == nil {
+		t.Errorf("Expected the key's use to be recorded")
+	}
+
+	// unknown keys are remembered too, and keys from elsewhere ignored
+	for _, bad := range []string{key + "x", key + "x", "eyJhbGciOi"} {
+		if _, err := c.Authenticate(ctx, bad); err != ErrInvalidAPIKey {
+			t.Errorf("Expected ErrInvalidAPIKey. Got %v", err)
+		}
+	}
+	if store.lookups != 2 {
+		t.Errorf("Expected 2 lookups. Got %d", store.lookups)
+	}
+
+	// a key revoked through the cache stops working at once
+	c.Revoke(ctx, k.ID)
+	if _, err := c.Authenticate(ctx, key); err != ErrInvalidAPIKey {
+		t.Errorf("Expected ErrInvalidAPIKey. Got %v", err)
+	}
+
+	// an expired key doesn't work
+	expired := time.Now().Add(-time.Second)
+	k, key, hash = NewAPIKey("old", &expired)
+	c.Create(ctx, &k, hash)
+	if _, err := c.Authenticate(ctx, key); err != ErrInvalidAPIKey {
+		t.Errorf("Expected ErrInvalidAPIKey. Got %v", err)
+	}
+}
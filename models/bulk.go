@@ -0,0 +1,259 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// The operations a bulk request can run.
+const (
+	BulkCreate = "create"
+	BulkUpdate = "update"
+	BulkDelete = "delete"
+)
+
+// ErrBulkAborted is the result of the operations of an all-or-nothing
+// bulk request that were rolled back, or never run, because another
+// operation failed.
+var ErrBulkAborted = errors.New("not applied, another operation failed")
+
+// BulkOp is one operation of a bulk request: a product to create, or to
+// update or delete by its ID (and Version, if not zero).
+type BulkOp struct {
+	Op      string
+	Product Product
+}
+
+// BulkResult is the outcome of a BulkOp, the product as stored or the
+// reason the operation failed.
+type BulkResult struct {
+	Product Product
+	Err     error
+}
+
+// maxInsertRows bounds the rows of an INSERT of many products.
+const maxInsertRows = 1000
+
+// InsertMany creates products with a single INSERT and sets their IDs,
+// versions and timestamps. Postgres doesn't promise to return the rows of
+// an INSERT in any order, so each product is given its id up front and
+// matched back by it to its position in products.
+func InsertMany(ctx context.Context, db Querier, products []Product) error {
+	names := make([]string, len(products))
+	prices := make([]string, len(products))
+	currencies := make([]string, len(products))
+	skus := make([]string, len(products))
+	for i, p := range products {
+		names[i], prices[i], currencies[i], skus[i] = p.Name, p.Price.String(), p.Currency, p.SKU
+	}
+
+	rows, err := db.QueryContext(ctx, `WITH input AS (
+			SELECT nextval(pg_get_serial_sequence('products', 'id'))::int AS id, t.*
+			FROM unnest($1::text[], $2::numeric[], $3::text[], $4::text[])
+				WITH ORDINALITY AS t(name, price, currency, sku, n)
+		), inserted AS (
+			INSERT INTO products(id, name, price, currency, sku)
+			SELECT id, name, price, currency, NULLIF(sku, '') FROM input ORDER BY n
+			RETURNING id, version, created_at, updated_at
+		)
+		SELECT input.n, inserted.id, inserted.version, inserted.created_at, inserted.updated_at
+		FROM inserted JOIN input USING (id)`,
+		pq.Array(names), pq.Array(prices), pq.Array(currencies), pq.Array(skus))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	returned := 0
+	for rows.Next() {
+		var n int
+		var p Product
+		if err := rows.Scan(&n, &p.ID, &p.Version, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return err
+		}
+		if n < 1 || n > len(products) {
+			return errors.Errorf("INSERT returned an unknown row %d", n)
+		}
+		products[n-1].ID, products[n-1].Version = p.ID, p.Version
+		products[n-1].CreatedAt, products[n-1].UpdatedAt = p.CreatedAt, p.UpdatedAt
+		returned++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if returned != len(products) {
+		return errors.New("INSERT returned too few rows")
+	}
+
+	return nil
+}
+
+// Bulk runs ops in order in the transaction tx and returns the result of
+// each. Runs of consecutive creates are inserted together, with an INSERT
+// of many rows each.
+//
+// If atomic is set Bulk stops at the first operation that fails and marks
+// every other operation ErrBulkAborted, and the caller must roll tx back.
+// Otherwise each operation that fails is rolled back on its own, using a
+// savepoint, and the rest carry on. The error is only set if tx itself
+// failed.
+func Bulk(ctx context.Context, tx *sql.Tx, ops []BulkOp, atomic bool) ([]BulkResult, error) {
+	results := make([]BulkResult, len(ops))
+	for i := 0; i < len(ops); {
+		n := 1
+		if ops[i].Op == BulkCreate {
+			for i+n < len(ops) && n < maxInsertRows && ops[i+n].Op == BulkCreate {
+				n++
+			}
+		}
+
+		if err := runBulk(ctx, tx, ops[i:i+n], results[i:i+n], atomic); err != nil {
+			return nil, err
+		}
+
+		if atomic && BulkFailed(results[i:i+n]) {
+			for j := range results {
+				if results[j].Err == nil {
+					results[j] = BulkResult{Product: ops[j].Product, Err: ErrBulkAborted}
+				}
+			}
+			return results, nil
+		}
+
+		i += n
+	}
+
+	return results, nil
+}
+
+// BulkFailed reports whether any of the operations failed.
+func BulkFailed(results []BulkResult) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runBulk runs a single update or delete, or a run of creates.
+func runBulk(ctx context.Context, tx *sql.Tx, ops []BulkOp, results []BulkResult, atomic bool) error {
+	if len(ops) > 1 {
+		products := make([]Product, len(ops))
+		for i, op := range ops {
+			products[i] = op.Product
+		}
+
+		// Try all the creates at once. If that fails, go through them
+		// one at a time to find out which ones are to blame.
+		err := savepoint(ctx, tx, func() error { return InsertMany(ctx, tx, products) })
+		if err == nil {
+			for i := range products {
+				results[i] = BulkResult{Product: products[i]}
+			}
+			return nil
+		}
+		if !opError(err) {
+			return err
+		}
+	}
+
+	for i, op := range ops {
+		p := op.Product
+		run := func() error { return op.run(ctx, tx, &p) }
+
+		var err error
+		if atomic {
+			// the transaction is rolled back if anything fails
+			err = run()
+		} else {
+			err = savepoint(ctx, tx, run)
+		}
+		if err != nil && !opError(err) {
+			return err
+		}
+
+		results[i] = BulkResult{Product: p, Err: err}
+		if err != nil && atomic {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// run runs the operation on p.
+func (op BulkOp) run(ctx context.Context, db Querier, p *Product) error {
+	switch op.Op {
+	case BulkCreate:
+		return p.Post(ctx, db)
+	case BulkUpdate:
+		return p.Put(ctx, db)
+	case BulkDelete:
+		return p.Delete(ctx, db)
+	}
+
+	return errors.Errorf("unknown bulk operation %q", op.Op)
+}
+
+// opError reports whether err is the fault of an operation, rather than
+// of the transaction or the connection: the product wasn't found, or it
+// broke a constraint or had bad data.
+func opError(err error) bool {
+	if err == ErrNotFound || err == ErrVersionMismatch || err == ErrDuplicateSKU {
+		return true
+	}
+
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+
+	// integrity constraint violations and data exceptions
+	class := pqErr.Code.Class()
+	return class == "23" || class == "22"
+}
+
+// savepoint runs fn inside a savepoint of tx, so that if it fails the
+// transaction can carry on without its changes.
+func savepoint(ctx context.Context, tx *sql.Tx, fn func() error) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT bulk"); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bulk"); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT bulk")
+	return err
+}
@@ -0,0 +1,147 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Cursor marks a position in a sorted listing for keyset pagination. A
+// page that starts from a cursor contains the products that sort after
+// (or, if Before is set, before) the boundary product, so inserts and
+// deletes elsewhere in the table never shift the page the way they shift
+// an OFFSET.
+type Cursor struct {
+	// Sort is the order the cursor was issued for, without the id
+	// tiebreaker.
+	Sort []SortKey `json:"sort"`
+
+	// Boundary holds the sort column values (and id) of the product at
+	// the edge of the page the cursor was issued for.
+	Boundary Product `json:"boundary"`
+
+	// Before pages backwards from the boundary.
+	Before bool `json:"before,omitempty"`
+
+	// Filter identifies the filters the cursor was issued for, so that a
+	// cursor can't be replayed against a different listing.
+	Filter string `json:"filter,omitempty"`
+}
+
+// NewCursor returns a cursor positioned at p in a listing sorted by sort.
+// Only the columns the cursor needs are kept from p.
+func NewCursor(p Product, sort []SortKey, before bool, filter string) Cursor {
+	c := Cursor{Sort: sort, Before: before, Filter: filter}
+	c.Boundary.ID = p.ID
+	for _, k := range sort {
+		switch k.Column {
+		case "name":
+			c.Boundary.Name = p.Name
+		case "price":
+			c.Boundary.Price = p.Price
+		case "currency":
+			c.Boundary.Currency = p.Currency
+		case "created_at":
+			c.Boundary.CreatedAt = p.CreatedAt
+		case "updated_at":
+			c.Boundary.UpdatedAt = p.UpdatedAt
+		}
+	}
+
+	return c
+}
+
+// keyset compiles the cursor into a WHERE condition selecting the rows
+// on the far side of the boundary. For keys k1, k2, ..., id it produces
+//
+//	k1 > v1 OR (k1 = v1 AND k2 > v2) OR ... OR (k1 = v1 AND ... AND id > vid)
+//
+// with each > flipped to < for descending keys and when paging backwards.
+func (c Cursor) keyset(keys []SortKey, args []interface{}) (string, []interface{}) {
+	var ors []string
+	for i, k := range keys {
+		var ands []string
+		for _, eq := range keys[:i] {
+			args = append(args, columnValue(c.Boundary, eq.Column))
+			ands = append(ands, eq.Column+" = $"+strconv.Itoa(len(args)))
+		}
+
+		op := " > $"
+		if k.Desc != c.Before {
+			op = " < $"
+		}
+		args = append(args, columnValue(c.Boundary, k.Column))
+		ands = append(ands, k.Column+op+strconv.Itoa(len(args)))
+
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+
+	return "(" + strings.Join(ors, " OR ") + ")", args
+}
+
+// after reports whether p sorts on the far side of the boundary, the
+// in-memory equivalent of keyset.
+func (c Cursor) after(p Product, keys []SortKey) bool {
+	for _, k := range keys {
+		cmp := compare(p, c.Boundary, k.Column)
+		if cmp == 0 {
+			continue
+		}
+		return (cmp > 0) != (k.Desc != c.Before)
+	}
+
+	return false
+}
+
+// columnValue returns the value of a sortable column of p.
+func columnValue(p Product, column string) interface{} {
+	switch column {
+	case "name":
+		return p.Name
+	case "price":
+		return p.Price
+	case "currency":
+		return p.Currency
+	case "created_at":
+		return p.CreatedAt
+	case "updated_at":
+		return p.UpdatedAt
+	}
+
+	return p.ID
+}
+
+// SameSort reports whether two lists of sort keys are identical.
+func SameSort(a, b []SortKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestCursorKeyset(t *testing.T) {
+
+	c := NewCursor(Product{ID: 7, Name: "x", Price: 150}, []SortKey{{Column: "price", Desc: true}}, false, "")
+	q := Query{Sort: c.Sort, Cursor: &c, Deleted: IncludeDeleted}
+
+	where, args := q.where(nil)
+	expected := ` WHERE ((price < $1) OR (price = $2 AND id > $3))`
+	if where != expected {
+		t.Errorf("Expected %s. Got %s", expected, where)
+	}
+	if !reflect.DeepEqual(args, []interface{}{Money(150), Money(150), 7}) {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	// paging backwards flips every comparison and the order
+	c.Before = true
+	where, _ = q.where(nil)
+	expected = ` WHERE ((price > $1) OR (price = $2 AND id < $3))`
+	if where != expected {
+		t.Errorf("Expected %s. Got %s", expected, where)
+	}
+	if order := q.orderBy(); order != " ORDER BY price, id DESC" {
+		t.Errorf("Expected ' ORDER BY price, id DESC'. Got '%s'", order)
+	}
+
+	// only the sort columns are kept in the boundary
+	if c.Boundary.Name != "" {
+		t.Errorf("Expected the name to be dropped. Got '%s'", c.Boundary.Name)
+	}
+}
+
+func TestMemoryStoreCursor(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+	for _, price := range []Money{300, 100, 200, 100, 300} {
+		s.Create(ctx, &Product{Name: "product", Price: price})
+	}
+
+	ids := func(products []Product) []int {
+		var ids []int
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	// sorted by price then id the order is 2, 4, 3, 1, 5
+	sort := []SortKey{{Column: "price"}}
+	first, _ := s.List(ctx, Query{Sort: sort, Count: 2})
+	if got := ids(first); !reflect.DeepEqual(got, []int{2, 4}) {
+		t.Fatalf("Expected [2 4]. Got %v", got)
+	}
+
+	// a product inserted before the boundary doesn't shift the next page
+	s.Create(ctx, &Product{Name: "cheap", Price: 50})
+
+	c := NewCursor(first[1], sort, false, "")
+	next, _ := s.List(ctx, Query{Sort: sort, Count: 2, Cursor: &c})
+	if got := ids(next); !reflect.DeepEqual(got, []int{3, 1}) {
+		t.Errorf("Expected [3 1]. Got %v", got)
+	}
+
+	// and paging back from there returns the products just before it,
+	// in the normal order
+	c = NewCursor(next[0], sort, true, "")
+	prev, _ := s.List(ctx, Query{Sort: sort, Count: 2, Cursor: &c})
+	if got := ids(prev); !reflect.DeepEqual(got, []int{2, 4}) {
+		t.Errorf("Expected [2 4]. Got %v", got)
+	}
+}
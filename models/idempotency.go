@@ -0,0 +1,305 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrKeyInFlight is returned when an idempotency key is claimed while
+	// the request that claimed it first is still being handled.
+	ErrKeyInFlight = errors.New("a request with this idempotency key is in progress")
+
+	// ErrKeyReused is returned when an idempotency key is claimed for a
+	// request that differs from the one it was first used for.
+	ErrKeyReused = errors.New("idempotency key was used for a different request")
+)
+
+// SavedResponse is the response to a request made with an idempotency
+// key, replayed to any retry of the request.
+type SavedResponse struct {
+	Status int
+	Header map[string][]string
+	Body   []byte
+}
+
+// IdempotencyStore keeps the responses to requests made with an
+// idempotency key until they expire.
+type IdempotencyStore interface {
+	// Begin claims key for a request, identified by hash, for ttl. If key
+	// is new, or expired, it returns the claim and the caller must Finish
+	// or Release it. If key has already been used for the same request it
+	// returns the saved response. Otherwise it returns ErrKeyInFlight or
+	// ErrKeyReused.
+	Begin(ctx context.Context, key, hash string, ttl time.Duration) (claim string, res *SavedResponse, err error)
+
+	// Finish saves the response to the request that claimed key, unless
+	// a retry has taken the key over since.
+	Finish(ctx context.Context, key, claim string, res SavedResponse) error
+
+	// Release gives up the claim on key without saving a response, so the
+	// request can be retried.
+	Release(ctx context.Context, key, claim string) error
+
+	// Expire deletes the expired keys and returns how many there were.
+	Expire(ctx context.Context) (int, error)
+}
+
+// PostgresIdempotencyStore is an IdempotencyStore backed by the
+// idempotency_keys table, so that every replica sees the same keys.
+type PostgresIdempotencyStore struct {
+	DB *sql.DB
+
+	// Timeout bounds every query. Zero means queries are only bounded by
+	// the caller's context.
+	Timeout time.Duration
+
+	// AbandonAfter is how long a key can be in flight before we assume
+	// the request that claimed it died with its server, and let a retry
+	// claim it. It must be longer than any request can take.
+	AbandonAfter time.Duration
+}
+
+// NewPostgresIdempotencyStore returns a PostgresIdempotencyStore using
+// db, with each query limited to timeout, that lets retries take over
+// keys in flight for longer than abandonAfter.
+func NewPostgresIdempotencyStore(db *sql.DB, timeout, abandonAfter time.Duration) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{DB: db, Timeout: timeout, AbandonAfter: abandonAfter}
+}
+
+// Begin claims key, or returns the response saved for it
+func (s *PostgresIdempotencyStore) Begin(ctx context.Context, key, hash string, ttl time.Duration) (string, *SavedResponse, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	claim, res, err := s.begin(ctx, key, hash, ttl)
+
+	return claim, res, contextError(ctx, err)
+}
+
+func (s *PostgresIdempotencyStore) begin(ctx context.Context, key, hash string, ttl time.Duration) (string, *SavedResponse, error) {
+	// a new key is inserted, an expired or abandoned one taken over
+	claim := newClaim()
+	var claimed bool
+	err := s.DB.QueryRowContext(ctx, `INSERT INTO idempotency_keys (key, request_hash, claim, expires_at)
+		VALUES ($1, $2, $3, now() + $4::float8 * interval '1 second')
+		ON CONFLICT (key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, claim = EXCLUDED.claim, status = NULL, header = NULL, body = NULL,
+			created_at = now(), expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < now()
+		OR (idempotency_keys.status IS NULL AND idempotency_keys.created_at < now() - $5::float8 * interval '1 second')
+		RETURNING true`, key, hash, claim, ttl.Seconds(), s.AbandonAfter.Seconds()).Scan(&claimed)
+	if err == nil {
+		return claim, nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", nil, err
+	}
+
+	var saved string
+	var status sql.NullInt64
+	var header []byte
+	res := SavedResponse{}
+	err = s.DB.QueryRowContext(ctx,
+		"SELECT request_hash, status, header, body FROM idempotency_keys WHERE key=$1",
+		key).Scan(&saved, &status, &header, &res.Body)
+	switch {
+	case err == sql.ErrNoRows:
+		// it expired in the meantime and was deleted, the client can
+		// retry
+		return "", nil, ErrKeyInFlight
+	case err != nil:
+		return "", nil, err
+	case saved != hash:
+		return "", nil, ErrKeyReused
+	case !status.Valid:
+		return "", nil, ErrKeyInFlight
+	}
+
+	res.Status = int(status.Int64)
+	if err = json.Unmarshal(header, &res.Header); err != nil {
+		return "", nil, errors.Wrap(err, "decoding saved header")
+	}
+
+	return "", &res, nil
+}
+
+// Finish saves the response to the request that claimed key
+func (s *PostgresIdempotencyStore) Finish(ctx context.Context, key, claim string, res SavedResponse) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	header, err := json.Marshal(res.Header)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status=$3, header=$4, body=$5 WHERE key=$1 AND claim=$2 AND status IS NULL",
+		key, claim, res.Status, header, res.Body)
+
+	return contextError(ctx, err)
+}
+
+// Release gives up the claim on key
+func (s *PostgresIdempotencyStore) Release(ctx context.Context, key, claim string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key=$1 AND claim=$2 AND status IS NULL", key, claim)
+
+	return contextError(ctx, err)
+}
+
+// Expire deletes the expired keys
+func (s *PostgresIdempotencyStore) Expire(ctx context.Context) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < now()")
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+	n, err := result.RowsAffected()
+
+	return int(n), err
+}
+
+// withTimeout derives the context for a single query.
+func (s *PostgresIdempotencyStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return queryContext(ctx, s.Timeout)
+}
+
+// MemoryIdempotencyStore is a thread-safe IdempotencyStore that keeps
+// keys in memory, for use with a MemoryStore.
+type MemoryIdempotencyStore struct {
+	// AbandonAfter is how long a key can be in flight before a retry
+	// can claim it, as for PostgresIdempotencyStore.
+	AbandonAfter time.Duration
+
+	mu   sync.Mutex
+	keys map[string]idempotencyKey
+}
+
+// idempotencyKey is a key held by a MemoryIdempotencyStore. res is nil
+// while the request is in flight.
+type idempotencyKey struct {
+	hash    string
+	claim   string
+	res     *SavedResponse
+	created time.Time
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore that
+// lets retries take over keys in flight for longer than abandonAfter.
+func NewMemoryIdempotencyStore(abandonAfter time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{AbandonAfter: abandonAfter, keys: make(map[string]idempotencyKey)}
+}
+
+// Begin claims key, or returns the response saved for it
+func (s *MemoryIdempotencyStore) Begin(ctx context.Context, key, hash string, ttl time.Duration) (string, *SavedResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	k, ok := s.keys[key]
+	switch {
+	case !ok, now.After(k.expires), k.res == nil && now.Sub(k.created) > s.AbandonAfter:
+		k = idempotencyKey{hash: hash, claim: newClaim(), created: now, expires: now.Add(ttl)}
+		s.keys[key] = k
+		return k.claim, nil, nil
+	case k.hash != hash:
+		return "", nil, ErrKeyReused
+	case k.res == nil:
+		return "", nil, ErrKeyInFlight
+	}
+
+	return "", k.res, nil
+}
+
+// Finish saves the response to the request that claimed key
+func (s *MemoryIdempotencyStore) Finish(ctx context.Context, key, claim string, res SavedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.keys[key]; ok && k.claim == claim && k.res == nil {
+		k.res = &res
+		s.keys[key] = k
+	}
+
+	return nil
+}
+
+// Release gives up the claim on key
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key, claim string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.keys[key]; ok && k.claim == claim && k.res == nil {
+		delete(s.keys, key)
+	}
+
+	return nil
+}
+
+// Expire deletes the expired keys
+func (s *MemoryIdempotencyStore) Expire(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, now := 0, time.Now()
+	for key, k := range s.keys {
+		if now.After(k.expires) {
+			delete(s.keys, key)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// newClaim returns a random token identifying one claim on a key.
+func newClaim() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
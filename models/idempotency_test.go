@@ -0,0 +1,103 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testIdempotencyStore runs the same checks against any IdempotencyStore.
+func testIdempotencyStore(t *testing.T, s IdempotencyStore) {
+	ctx := context.Background()
+
+	// a new key is claimed
+	claim, res, err := s.Begin(ctx, "key", "a", time.Hour)
+	if err != nil || res != nil || claim == "" {
+		t.Fatalf("Expected the key to be claimed. Got %v (%v)", res, err)
+	}
+
+	// until there is a response, retries are in flight
+	if _, _, err = s.Begin(ctx, "key", "a", time.Hour); err != ErrKeyInFlight {
+		t.Errorf("Expected ErrKeyInFlight. Got %v", err)
+	}
+
+	saved := SavedResponse{Status: 201, Header: map[string][]string{"Etag": {`"1"`}}, Body: []byte(`{"id":1}`)}
+	if err = s.Finish(ctx, "key", claim, saved); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// then they get the response, unless they are a different request
+	_, res, err = s.Begin(ctx, "key", "a", time.Hour)
+	if err != nil || res == nil || !reflect.DeepEqual(*res, saved) {
+		t.Errorf("Expected the saved response. Got %+v (%v)", res, err)
+	}
+	if _, _, err = s.Begin(ctx, "key", "b", time.Hour); err != ErrKeyReused {
+		t.Errorf("Expected ErrKeyReused. Got %v", err)
+	}
+
+	// a released key can be claimed again
+	claim, _, _ = s.Begin(ctx, "gone", "a", time.Hour)
+	s.Release(ctx, "gone", claim)
+	if claim, res, err = s.Begin(ctx, "gone", "b", time.Hour); err != nil || res != nil {
+		t.Errorf("Expected the key to be claimed again. Got %v (%v)", res, err)
+	}
+	s.Release(ctx, "gone", claim)
+
+	// and so can an expired one, until the expired keys are deleted
+	claim, _, _ = s.Begin(ctx, "gone", "a", -time.Hour)
+	s.Finish(ctx, "gone", claim, saved)
+	if n, err := s.Expire(ctx); err != nil || n != 1 {
+		t.Errorf("Expected 1 key to expire. Got %v (%v)", n, err)
+	}
+	if _, res, err = s.Begin(ctx, "gone", "b", time.Hour); err != nil || res != nil {
+		t.Errorf("Expected the key to be claimed again. Got %v (%v)", res, err)
+	}
+
+	// once a retry has taken a key over, the request that claimed it
+	// first can neither save its response nor release the key
+	first, _, _ := s.Begin(ctx, "taken", "a", -time.Hour)
+	second, _, err := s.Begin(ctx, "taken", "a", time.Hour)
+	if err != nil || second == first {
+		t.Fatalf("Expected the key to be taken over. Got %v", err)
+	}
+	s.Finish(ctx, "taken", first, saved)
+	s.Release(ctx, "taken", first)
+	if _, _, err = s.Begin(ctx, "taken", "a", time.Hour); err != ErrKeyInFlight {
+		t.Errorf("Expected the retry to keep its claim. Got %v", err)
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	testIdempotencyStore(t, NewMemoryIdempotencyStore(time.Hour))
+}
+
+func TestIdempotencyAbandoned(t *testing.T) {
+
+	// This test checks that a retry only takes over a key once the
+	// request that claimed it has been in flight for AbandonAfter.
+	ctx := context.Background()
+	s := NewMemoryIdempotencyStore(time.Hour)
+
+	s.Begin(ctx, "key", "a", time.Hour)
+	if _, _, err := s.Begin(ctx, "key", "a", time.Hour); err != ErrKeyInFlight {
+		t.Errorf("Expected ErrKeyInFlight. Got %v", err)
+	}
+
+	s.AbandonAfter = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if _, res, err := s.Begin(ctx, "key", "a", time.Hour); err != nil || res != nil {
+		t.Errorf("Expected the abandoned key to be claimed. Got %v (%v)", res, err)
+	}
+}
+
+func TestPostgresIdempotencyStore(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	db.Exec("DELETE FROM idempotency_keys")
+	testIdempotencyStore(t, NewPostgresIdempotencyStore(db, 0, time.Hour))
+	db.Exec("DELETE FROM idempotency_keys")
+}
@@ -0,0 +1,257 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The outcomes of importing a product.
+const (
+	ImportCreated   = "created"
+	ImportUpdated   = "updated"
+	ImportUnchanged = "unchanged"
+	ImportRejected  = "rejected"
+)
+
+// Reasons an import rejects a valid product.
+const (
+	ImportDuplicate    = "name appears earlier in the import"
+	ImportDuplicateSKU = "sku appears earlier in the import"
+	ImportAmbiguous    = "name matches more than one product"
+	ImportConflict     = "name matches a product imported by sku"
+)
+
+// ImportResult is the outcome of importing one product, the product as
+// stored or the reason it was rejected.
+type ImportResult struct {
+	Product Product
+	Status  string
+	Reason  string
+}
+
+// Import upserts products by sku, or by name, the natural key of a
+// catalogue without skus. A product with a sku updates the name, price
+// and currency of the product with that sku that isn't in the trash, or
+// is created. A product without one updates the price and currency of
+// the product with its name, or is created. Products must already be
+// valid. Only the first of several products with the same sku, or
+// without a sku and with the same name, is imported. A name that matches
+// more than one product, or a product that another is imported by sku
+// to, is rejected.
+//
+// The products are copied into a staging table with COPY and merged into
+// the products table with a handful of statements, however many there
+// are. The table is locked against other writers once the products are
+// staged, until tx ends, so the merge can't race with them.
+func Import(ctx context.Context, tx *sql.Tx, products []Product) ([]ImportResult, error) {
+	results := importResults(products)
+
+	_, err := tx.ExecContext(ctx, `CREATE TEMP TABLE import_staging
+		(n INTEGER, sku TEXT, name TEXT, price NUMERIC(10,2), currency CHAR(3)) ON COMMIT DROP`)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = stage(ctx, tx, results); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "LOCK TABLE products IN SHARE ROW EXCLUSIVE MODE")
+	if err != nil {
+		return nil, err
+	}
+
+	// A product without a sku that matches a product another one is
+	// imported to by sku would change it twice, and one that matches
+	// several can't pick one.
+	reject := []struct{ reason, query string }{
+		{ImportConflict, `DELETE FROM import_staging s WHERE s.sku IS NULL AND EXISTS
+			(SELECT 1 FROM products p JOIN import_staging k ON k.sku = p.sku
+			WHERE p.name = s.name AND p.deleted_at IS NULL)
+			RETURNING n`},
+		{ImportAmbiguous, `DELETE FROM import_staging s
+			WHERE (SELECT count(*) FROM products p WHERE ` + nameMatch + `) > 1
+			RETURNING n`},
+	}
+	for _, r := range reject {
+		if err = rejectImport(ctx, tx, r.query, r.reason, results); err != nil {
+			return nil, err
+		}
+	}
+
+	// Each statement only sets the outcome of the products that don't
+	// have one yet, so the products updated by the first two are not
+	// reported as unchanged by the third. Products created are matched
+	// back to the staging table by sku, or by name, which are unique
+	// among the staged products.
+	merge := []struct{ status, query string }{
+		{ImportUpdated, `UPDATE products p SET name = s.name, price = s.price, currency = s.currency, version = p.version + 1
+			FROM import_staging s
+			WHERE ` + skuMatch + `
+			AND (p.name, p.price, p.currency) IS DISTINCT FROM (s.name, s.price, s.currency)
+			RETURNING s.n, p.id, p.version, p.created_at, p.updated_at`},
+		{ImportUpdated, `UPDATE products p SET price = s.price, currency = s.currency, version = p.version + 1
+			FROM import_staging s
+			WHERE ` + nameMatch + `
+			AND (p.price, p.currency) IS DISTINCT FROM (s.price, s.currency)
+			RETURNING s.n, p.id, p.version, p.created_at, p.updated_at`},
+		{ImportUnchanged, `SELECT s.n, p.id, p.version, p.created_at, p.updated_at
+			FROM import_staging s JOIN products p ON (` + skuMatch + `) OR (` + nameMatch + `)`},
+		{ImportCreated, `WITH inserted AS (
+				INSERT INTO products(sku, name, price, currency)
+				SELECT sku, name, price, currency FROM import_staging s
+				WHERE NOT EXISTS (SELECT 1 FROM products p WHERE (` + skuMatch + `) OR (` + nameMatch + `))
+				ORDER BY n
+				RETURNING id, sku, name, version, created_at, updated_at
+			)
+			SELECT s.n, i.id, i.version, i.created_at, i.updated_at
+			FROM inserted i JOIN import_staging s
+			ON i.sku = s.sku OR (i.sku IS NULL AND s.sku IS NULL AND i.name = s.name)`},
+	}
+	for _, m := range merge {
+		if err = mergeImport(ctx, tx, m.query, m.status, results); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// skuMatch matches a staged product s with a sku to the product p it is
+// imported to.
+const skuMatch = "p.sku = s.sku AND p.deleted_at IS NULL"
+
+// nameMatch matches a staged product s without a sku to the product p it
+// is imported to. Products imported to by sku are left out, as their
+// names may be changed by the import.
+const nameMatch = `s.sku IS NULL AND p.name = s.name AND p.deleted_at IS NULL
+	AND NOT EXISTS (SELECT 1 FROM import_staging k WHERE k.sku = p.sku)`
+
+// importResults starts the results of an import, rejecting the products
+// whose sku, or name if they have no sku, appears earlier in the import.
+func importResults(products []Product) []ImportResult {
+	results := make([]ImportResult, len(products))
+	skus := make(map[string]bool, len(products))
+	names := make(map[string]bool, len(products))
+	for i, p := range products {
+		results[i].Product = p
+		switch {
+		case p.SKU != "" && skus[p.SKU]:
+			results[i].Status, results[i].Reason = ImportRejected, ImportDuplicateSKU
+		case p.SKU == "" && names[p.Name]:
+			results[i].Status, results[i].Reason = ImportRejected, ImportDuplicate
+		}
+		if p.SKU != "" {
+			skus[p.SKU] = true
+		} else {
+			names[p.Name] = true
+		}
+	}
+
+	return results
+}
+
+// stage copies the products of an import that haven't been rejected into
+// the staging table, numbered by their index.
+func stage(ctx context.Context, tx *sql.Tx, results []ImportResult) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("import_staging", "n", "sku", "name", "price", "currency"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for n, r := range results {
+		if r.Status != "" {
+			continue
+		}
+		var sku interface{}
+		if r.Product.SKU != "" {
+			sku = r.Product.SKU
+		}
+		if _, err = stmt.ExecContext(ctx, n, sku, r.Product.Name, r.Product.Price, r.Product.Currency); err != nil {
+			return err
+		}
+	}
+
+	// an Exec without arguments flushes the COPY
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+
+	return stmt.Close()
+}
+
+// rejectImport runs one of the statements that take products out of the
+// staging table, which return the index of each, and rejects them for
+// reason.
+func rejectImport(ctx context.Context, tx *sql.Tx, query, reason string, results []ImportResult) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n int
+		if err := rows.Scan(&n); err != nil {
+			return err
+		}
+		results[n].Status, results[n].Reason = ImportRejected, reason
+	}
+
+	return rows.Err()
+}
+
+// mergeImport runs one of the statements that merge the staging table
+// into the products table. Each row it returns gives the index, id,
+// version and timestamps of an imported product, whose outcome is set to
+// status if it hasn't got one yet.
+func mergeImport(ctx context.Context, tx *sql.Tx, query, status string, results []ImportResult) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n, id, version int
+		var created, updated time.Time
+		if err := rows.Scan(&n, &id, &version, &created, &updated); err != nil {
+			return err
+		}
+
+		r := &results[n]
+		if r.Status == "" {
+			r.Status = status
+			r.Product.ID, r.Product.Version = id, version
+			r.Product.CreatedAt, r.Product.UpdatedAt = created, updated
+		}
+	}
+
+	return rows.Err()
+}
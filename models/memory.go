@@ -0,0 +1,524 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryStore is a thread-safe ProductStore that keeps products in memory.
+// It mirrors the behaviour of PostgresStore (SERIAL-like ids, filtering,
+// ordering, LIMIT/OFFSET paging and ErrNotFound) so the API can be run and tested without a
+// database. Operations are quick, so the context is only checked before
+// each one starts.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	products map[int]Product
+	lastID   int
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{products: make(map[int]Product)}
+}
+
+// Get gets one product by id
+func (s *MemoryStore) Get(ctx context.Context, id int) (Product, error) {
+	if err := ctx.Err(); err != nil {
+		return Product{ID: id}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.products[id]
+	if !ok || p.DeletedAt != nil {
+		return Product{ID: id}, ErrNotFound
+	}
+
+	return p, nil
+}
+
+// GetBySKU gets one product by sku
+func (s *MemoryStore) GetBySKU(ctx context.Context, sku string) (Product, error) {
+	if err := ctx.Err(); err != nil {
+		return Product{SKU: sku}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.bySKU(sku, 0)
+	if !ok {
+		return Product{SKU: sku}, ErrNotFound
+	}
+
+	return p, nil
+}
+
+// List fetches the products matching q, sorted and paged the same way
+// the SQL query would.
+func (s *MemoryStore) List(ctx context.Context, q Query) ([]Product, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	products := []Product{}
+	for _, p := range s.products {
+		if q.Match(p) {
+			products = append(products, p)
+		}
+	}
+	q.SortProducts(products)
+
+	products = append([]Product{}, q.Page(products)...)
+	q.restoreOrder(products)
+
+	return products, nil
+}
+
+// Export calls fn with every product matching q's filters, in q's order.
+// The products are copied out first so fn runs without the lock held.
+func (s *MemoryStore) Export(ctx context.Context, q Query, fn func(p Product) error) error {
+	q.Start, q.Count, q.Cursor = 0, 0, nil
+	products, err := s.List(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range products {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Search finds the products matching q. See SearchQuery.match for how
+// matching and ranking differ from Postgres.
+func (s *MemoryStore) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []SearchResult{}
+	for _, p := range s.products {
+		if p.DeletedAt != nil {
+			continue
+		}
+		if r, ok := q.match(p); ok {
+			results = append(results, r)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID < results[j].ID
+	})
+
+	if q.Start >= len(results) {
+		return []SearchResult{}, nil
+	}
+	results = results[q.Start:]
+	if q.Count > 0 && q.Count < len(results) {
+		results = results[:q.Count]
+	}
+
+	return results, nil
+}
+
+// Count counts the products matching q's filters. Counting in memory is
+// cheap, so the count is always exact.
+func (s *MemoryStore) Count(ctx context.Context, q Query, exact bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	q.Cursor = nil
+	n := 0
+	for _, p := range s.products {
+		if q.Match(p) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Create creates a new product, assigning it the next id in sequence.
+func (s *MemoryStore) Create(ctx context.Context, p *Product) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, taken := s.bySKU(p.SKU, 0); taken {
+		return ErrDuplicateSKU
+	}
+
+	s.lastID++
+	p.ID = s.lastID
+	p.Version = 1
+	p.CreatedAt = now()
+	p.UpdatedAt, p.DeletedAt = p.CreatedAt, nil
+	s.products[p.ID] = *p
+
+	return nil
+}
+
+// Update updates one product by id
+func (s *MemoryStore) Update(ctx context.Context, p *Product) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.products[p.ID]
+	if !ok || old.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if p.Version != 0 && p.Version != old.Version {
+		return ErrVersionMismatch
+	}
+	if _, taken := s.bySKU(p.SKU, p.ID); taken {
+		return ErrDuplicateSKU
+	}
+	p.Version = old.Version + 1
+	p.CreatedAt, p.UpdatedAt, p.DeletedAt = old.CreatedAt, now(), nil
+	s.products[p.ID] = *p
+
+	return nil
+}
+
+// Upsert creates or replaces one product by sku
+func (s *MemoryStore) Upsert(ctx context.Context, p *Product) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.bySKU(p.SKU, 0)
+	switch {
+	case !ok && p.Version != 0:
+		return false, ErrNotFound
+	case !ok:
+		s.lastID++
+		p.ID, p.Version = s.lastID, 1
+		p.CreatedAt = now()
+		p.UpdatedAt, p.DeletedAt = p.CreatedAt, nil
+	case p.Version != 0 && p.Version != old.Version:
+		return false, ErrVersionMismatch
+	default:
+		p.ID, p.Version = old.ID, old.Version+1
+		p.CreatedAt, p.UpdatedAt, p.DeletedAt = old.CreatedAt, now(), nil
+	}
+	s.products[p.ID] = *p
+
+	return !ok, nil
+}
+
+// Patch modifies one product by id. The store stays locked while patch
+// runs, so patch must not call back into the store.
+func (s *MemoryStore) Patch(ctx context.Context, id int, patch func(p *Product) error) (Product, error) {
+	if err := ctx.Err(); err != nil {
+		return Product{ID: id}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.products[id]
+	if !ok || p.DeletedAt != nil {
+		return Product{ID: id}, ErrNotFound
+	}
+
+	if err := patch(&p); err != nil {
+		return s.products[id], err
+	}
+	if _, taken := s.bySKU(p.SKU, id); taken {
+		return s.products[id], ErrDuplicateSKU
+	}
+	old := s.products[id]
+	p.ID = id
+	p.Version = old.Version + 1
+	p.CreatedAt, p.UpdatedAt, p.DeletedAt = old.CreatedAt, now(), nil
+	s.products[id] = p
+
+	return p, nil
+}
+
+// Delete moves one product by id to the trash
+func (s *MemoryStore) Delete(ctx context.Context, id, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.products[id]
+	if !ok || p.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if version != 0 && version != p.Version {
+		return ErrVersionMismatch
+	}
+
+	deleted := now()
+	p.UpdatedAt, p.DeletedAt = deleted, &deleted
+	p.Version++
+	s.products[id] = p
+
+	return nil
+}
+
+// Bulk runs many operations while holding the lock. In atomic mode they
+// run against a copy of the products, which only replaces the original
+// if they all succeed.
+func (s *MemoryStore) Bulk(ctx context.Context, ops []BulkOp, atomic bool) ([]BulkResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// work has its own lock, so we can use the store's methods on it
+	work := &MemoryStore{products: s.products, lastID: s.lastID}
+	if atomic {
+		work.products = make(map[int]Product, len(s.products))
+		for id, p := range s.products {
+			work.products[id] = p
+		}
+	}
+
+	results := make([]BulkResult, len(ops))
+	for i, op := range ops {
+		p := op.Product
+		var err error
+		switch op.Op {
+		case BulkCreate:
+			err = work.Create(ctx, &p)
+		case BulkUpdate:
+			err = work.Update(ctx, &p)
+		case BulkDelete:
+			err = work.Delete(ctx, p.ID, p.Version)
+		default:
+			err = errors.Errorf("unknown bulk operation %q", op.Op)
+		}
+		results[i] = BulkResult{Product: p, Err: err}
+
+		if err != nil && atomic {
+			for j := range results {
+				if j != i {
+					results[j] = BulkResult{Product: ops[j].Product, Err: ErrBulkAborted}
+				}
+			}
+			return results, nil
+		}
+	}
+
+	s.products, s.lastID = work.products, work.lastID
+
+	return results, nil
+}
+
+// Import upserts products by sku or name
+func (s *MemoryStore) Import(ctx context.Context, products []Product) ([]ImportResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := importResults(products)
+	targeted := make(map[string]bool)
+	for _, r := range results {
+		if r.Status == "" && r.Product.SKU != "" {
+			targeted[r.Product.SKU] = true
+		}
+	}
+
+	// names are matched against the products as they were before the
+	// import, leaving out those imported to by sku
+	byName := make(map[string][]int)
+	conflicts := make(map[string]bool)
+	for id, p := range s.products {
+		switch {
+		case p.DeletedAt != nil:
+		case p.SKU != "" && targeted[p.SKU]:
+			conflicts[p.Name] = true
+		default:
+			byName[p.Name] = append(byName[p.Name], id)
+		}
+	}
+
+	for i := range results {
+		r := &results[i]
+		if r.Status != "" {
+			continue
+		}
+
+		var old Product
+		var found bool
+		if r.Product.SKU != "" {
+			old, found = s.bySKU(r.Product.SKU, 0)
+		} else {
+			ids := byName[r.Product.Name]
+			switch {
+			case conflicts[r.Product.Name]:
+				r.Status, r.Reason = ImportRejected, ImportConflict
+				continue
+			case len(ids) > 1:
+				r.Status, r.Reason = ImportRejected, ImportAmbiguous
+				continue
+			case len(ids) == 1:
+				old, found = s.products[ids[0]], true
+				r.Product.Name = old.Name
+			}
+		}
+
+		if !found {
+			s.lastID++
+			r.Product.ID, r.Product.Version = s.lastID, 1
+			r.Product.CreatedAt = now()
+			r.Product.UpdatedAt, r.Product.DeletedAt = r.Product.CreatedAt, nil
+			r.Status = ImportCreated
+		} else {
+			r.Status = ImportUnchanged
+			if old.Name != r.Product.Name || old.Price != r.Product.Price || old.Currency != r.Product.Currency {
+				old.Version++
+				old.UpdatedAt = now()
+				r.Status = ImportUpdated
+			}
+			old.Name, old.Price, old.Currency = r.Product.Name, r.Product.Price, r.Product.Currency
+			r.Product = old
+		}
+		s.products[r.Product.ID] = r.Product
+	}
+
+	return results, nil
+}
+
+// Restore restores one product by id from the trash
+func (s *MemoryStore) Restore(ctx context.Context, id int) (Product, error) {
+	if err := ctx.Err(); err != nil {
+		return Product{ID: id}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.products[id]
+	if !ok || p.DeletedAt == nil {
+		return Product{ID: id}, ErrNotFound
+	}
+	if _, taken := s.bySKU(p.SKU, id); taken {
+		return Product{ID: id}, ErrDuplicateSKU
+	}
+
+	p.DeletedAt = nil
+	p.UpdatedAt = now()
+	p.Version++
+	s.products[id] = p
+
+	return p, nil
+}
+
+// Purge deletes the products trashed before the given time for good
+func (s *MemoryStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, p := range s.products {
+		if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+			delete(s.products, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// bySKU finds the product other than except with the given sku that
+// isn't in the trash. Products without a sku are never found.
+func (s *MemoryStore) bySKU(sku string, except int) (Product, bool) {
+	if sku == "" {
+		return Product{}, false
+	}
+
+	for id, p := range s.products {
+		if p.SKU == sku && p.DeletedAt == nil && id != except {
+			return p, true
+		}
+	}
+
+	return Product{}, false
+}
+
+// Clear removes every product and restarts the id sequence, the same as
+// ClearTable does for Postgres.
+func (s *MemoryStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.products = make(map[int]Product)
+	s.lastID = 0
+}
+
+// now returns the current time at the microsecond precision of a
+// Postgres timestamp, so times round trip the same as they do there.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
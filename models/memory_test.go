@@ -0,0 +1,380 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestMemoryStore(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	// get a product that does not exist
+	_, err := s.Get(ctx, 1)
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	// create products, ids should behave like a SERIAL column
+	for i := 1; i <= 3; i++ {
+		p := Product{Name: "hello kitty", Price: 1499}
+		if err := s.Create(ctx, &p); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if p.ID != i {
+			t.Errorf("Expected id %v. Got %v", i, p.ID)
+		}
+	}
+
+	// update a product
+	err = s.Update(ctx, &Product{ID: 2, Name: "new name", Price: 150})
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	p, err := s.Get(ctx, 2)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if p.Name != "new name" || p.Price != 150 {
+		t.Errorf("Expected the product to be updated. Got %+v", p)
+	}
+
+	// patch a product, a failed patch changes nothing
+	p, err = s.Patch(ctx, 2, func(p *Product) error { p.Price = 175; return nil })
+	if err != nil || p.Price != 175 || p.Name != "new name" {
+		t.Errorf("Expected the price to be patched. Got %+v (%v)", p, err)
+	}
+
+	errPatch := errors.New("bad patch")
+	_, err = s.Patch(ctx, 2, func(p *Product) error { p.Price = 0; return errPatch })
+	if p, _ := s.Get(ctx, 2); err != errPatch || p.Price != 175 {
+		t.Errorf("Expected the patch error and no change. Got %+v (%v)", p, err)
+	}
+
+	// updates bump the version and can be made conditional on it
+	p, _ = s.Get(ctx, 2)
+	if p.Version != 3 {
+		t.Errorf("Expected version 3. Got %v", p.Version)
+	}
+	if err := s.Update(ctx, &Product{ID: 2, Name: "stale", Version: 2}); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch. Got %v", err)
+	}
+	if err := s.Delete(ctx, 2, 2); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch. Got %v", err)
+	}
+
+	// delete a product, ids are never reused
+	if err := s.Delete(ctx, 3, 0); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if _, err := s.Get(ctx, 3); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	p = Product{Name: "another"}
+	s.Create(ctx, &p)
+	if p.ID != 4 {
+		t.Errorf("Expected id 4. Got %v", p.ID)
+	}
+
+	// update and delete a product that does not exist
+	if err := s.Update(ctx, &Product{ID: 3}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+	if err := s.Delete(ctx, 3, 0); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+	if _, err := s.Patch(ctx, 3, func(p *Product) error { return nil }); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	// deleted products can be listed, restored and purged
+	trash, _ := s.List(ctx, Query{Deleted: OnlyDeleted})
+	if len(trash) != 1 || trash[0].ID != 3 || trash[0].DeletedAt == nil {
+		t.Errorf("Expected product 3 in the trash. Got %+v", trash)
+	}
+
+	if p, err := s.Restore(ctx, 3); err != nil || p.ID != 3 {
+		t.Errorf("Expected product 3 to be restored. Got %+v (%v)", p, err)
+	}
+	if _, err := s.Restore(ctx, 3); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	s.Delete(ctx, 3, 0)
+	if n, _ := s.Purge(ctx, time.Now().Add(-time.Hour)); n != 0 {
+		t.Errorf("Expected nothing to be purged. Got %v", n)
+	}
+	if n, _ := s.Purge(ctx, time.Now().Add(time.Hour)); n != 1 {
+		t.Errorf("Expected 1 product to be purged. Got %v", n)
+	}
+	if _, err := s.Restore(ctx, 3); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	// timestamps are kept by the store
+	time.Sleep(time.Millisecond)
+	s.Update(ctx, &Product{ID: 2, Name: "newer name"})
+	p, _ = s.Get(ctx, 2)
+	if p.CreatedAt.IsZero() || p.UpdatedAt.Before(p.CreatedAt) {
+		t.Errorf("Expected created_at and updated_at to be set. Got %v and %v", p.CreatedAt, p.UpdatedAt)
+	}
+	since := p.UpdatedAt
+	products, _ := s.List(ctx, Query{UpdatedSince: &since})
+	if len(products) != 1 || products[0].ID != 2 {
+		t.Errorf("Expected only product 2 to be updated since %v. Got %+v", since, products)
+	}
+
+	// clear restarts the sequence
+	s.Clear()
+	p = Product{Name: "first"}
+	s.Create(ctx, &p)
+	if p.ID != 1 {
+		t.Errorf("Expected id 1. Got %v", p.ID)
+	}
+}
+
+func TestMemoryStoreList(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+	for i := 0; i < 40; i++ {
+		s.Create(ctx, &Product{Name: "product"})
+	}
+
+	// get 8 products starting at 10
+	products, err := s.List(ctx, Query{Start: 10, Count: 8})
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	if len(products) != 8 {
+		t.Errorf("Expected 8 products. Got %v", len(products))
+	}
+
+	if products[0].ID != 11 || products[7].ID != 18 {
+		t.Errorf("Expected ids 11 to 18. Got %v to %v", products[0].ID, products[7].ID)
+	}
+
+	// paging off the end returns an empty list
+	products, _ = s.List(ctx, Query{Start: 40, Count: 8})
+	if products == nil || len(products) != 0 {
+		t.Errorf("Expected an empty list. Got %v", products)
+	}
+
+	// the count ignores paging but not filters
+	for _, c := range []struct {
+		q     Query
+		total int
+	}{
+		{Query{Start: 10, Count: 8}, 40},
+		{Query{NameContains: "PROD"}, 40},
+		{Query{NamePrefix: "nope"}, 0},
+	} {
+		total, err := s.Count(ctx, c.q, false)
+		if err != nil || total != c.total {
+			t.Errorf("Expected a count of %v for %+v. Got %v (%v)", c.total, c.q, total, err)
+		}
+	}
+}
+
+func TestMemoryStoreBulk(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+	s.Create(ctx, &Product{Name: "one"})
+
+	ops := []BulkOp{
+		{Op: BulkCreate, Product: Product{Name: "two"}},
+		{Op: BulkUpdate, Product: Product{ID: 1, Name: "uno"}},
+		{Op: BulkDelete, Product: Product{ID: 9}},
+	}
+
+	// in atomic mode the missing product aborts the lot
+	results, err := s.Bulk(ctx, ops, true)
+	if err != nil || results[0].Err != ErrBulkAborted || results[1].Err != ErrBulkAborted || results[2].Err != ErrNotFound {
+		t.Errorf("Expected the delete to abort the rest. Got %+v (%v)", results, err)
+	}
+	if p, _ := s.Get(ctx, 1); p.Name != "one" {
+		t.Errorf("Expected no changes. Got %+v", p)
+	}
+
+	// in partial mode the rest are applied
+	results, err = s.Bulk(ctx, ops, false)
+	if err != nil || results[0].Err != nil || results[0].Product.ID != 2 || results[1].Err != nil || results[2].Err != ErrNotFound {
+		t.Errorf("Expected the create and update to succeed. Got %+v (%v)", results, err)
+	}
+	if p, _ := s.Get(ctx, 1); p.Name != "uno" {
+		t.Errorf("Expected product 1 to be updated. Got %+v", p)
+	}
+}
+
+func TestMemoryStoreImport(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+	s.Create(ctx, &Product{Name: "one", Price: 100, Currency: "USD"})
+	s.Create(ctx, &Product{Name: "two", Price: 200, Currency: "USD"})
+	s.Create(ctx, &Product{Name: "twin", Price: 300, Currency: "USD"})
+	s.Create(ctx, &Product{Name: "twin", Price: 300, Currency: "USD"})
+
+	results, err := s.Import(ctx, []Product{
+		{Name: "one", Price: 150, Currency: "USD"},
+		{Name: "two", Price: 200, Currency: "USD"},
+		{Name: "three", Price: 300, Currency: "EUR"},
+		{Name: "twin", Price: 300, Currency: "USD"},
+		{Name: "one", Price: 175, Currency: "USD"},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	var statuses []string
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	expected := []string{ImportUpdated, ImportUnchanged, ImportCreated, ImportRejected, ImportRejected}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected %v. Got %v", expected, statuses)
+	}
+	if results[3].Reason != ImportAmbiguous || results[4].Reason != ImportDuplicate {
+		t.Errorf("Expected the twins to be ambiguous and the second one a duplicate. Got %+v", results[3:])
+	}
+
+	if p, _ := s.Get(ctx, 1); p.Price != 150 || p.Version != 2 {
+		t.Errorf("Expected product 1 to be updated once. Got %+v", p)
+	}
+	if p, _ := s.Get(ctx, 2); p.Version != 1 {
+		t.Errorf("Expected product 2 to be left alone. Got %+v", p)
+	}
+	if p, _ := s.Get(ctx, 5); p.Name != "three" || results[2].Product.ID != 5 {
+		t.Errorf("Expected product 5 to be created. Got %+v", p)
+	}
+
+	// products with a sku are matched by it, even if their name changes
+	s.Create(ctx, &Product{SKU: "SKU-1", Name: "sixth", Price: 100, Currency: "USD"})
+	results, err = s.Import(ctx, []Product{
+		{SKU: "SKU-1", Name: "twin", Price: 100, Currency: "USD"},
+		{SKU: "SKU-2", Name: "twin", Price: 200, Currency: "USD"},
+		{Name: "sixth", Price: 100, Currency: "USD"},
+		{SKU: "SKU-2", Name: "seventh", Price: 200, Currency: "USD"},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	statuses = nil
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	expected = []string{ImportUpdated, ImportCreated, ImportRejected, ImportRejected}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected %v. Got %v", expected, statuses)
+	}
+	if results[2].Reason != ImportConflict || results[3].Reason != ImportDuplicateSKU {
+		t.Errorf("Expected a conflict and a duplicate sku. Got %+v", results[2:])
+	}
+	if p, _ := s.GetBySKU(ctx, "SKU-1"); p.ID != 6 || p.Name != "twin" || p.Version != 2 {
+		t.Errorf("Expected product 6 to be renamed. Got %+v", p)
+	}
+	if p, _ := s.GetBySKU(ctx, "SKU-2"); p.ID != results[1].Product.ID || p.Name != "twin" {
+		t.Errorf("Expected a product to be created with its sku. Got %+v", p)
+	}
+}
+
+func TestMemoryStoreSKU(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	// upserting a new sku creates the product, and then replaces it
+	p := Product{SKU: "abc", Name: "one", Price: 100, Currency: "USD"}
+	created, err := s.Upsert(ctx, &p)
+	if err != nil || !created || p.ID != 1 || p.Version != 1 {
+		t.Errorf("Expected product 1 to be created. Got %+v (%v)", p, err)
+	}
+	p = Product{SKU: "abc", Name: "uno", Price: 100, Currency: "USD"}
+	created, err = s.Upsert(ctx, &p)
+	if err != nil || created || p.ID != 1 || p.Version != 2 {
+		t.Errorf("Expected product 1 to be replaced. Got %+v (%v)", p, err)
+	}
+	if p, _ := s.GetBySKU(ctx, "abc"); p.Name != "uno" {
+		t.Errorf("Expected to get product 1 by sku. Got %+v", p)
+	}
+
+	// a conditional upsert only replaces the expected version
+	p = Product{SKU: "abc", Name: "eins", Version: 1}
+	if _, err = s.Upsert(ctx, &p); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch. Got %v", err)
+	}
+	p = Product{SKU: "xyz", Name: "eins", Version: 1}
+	if _, err = s.Upsert(ctx, &p); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	// skus are unique among the products that aren't in the trash
+	if err = s.Create(ctx, &Product{SKU: "abc", Name: "two"}); err != ErrDuplicateSKU {
+		t.Errorf("Expected ErrDuplicateSKU. Got %v", err)
+	}
+	s.Create(ctx, &Product{Name: "two"})
+	if err = s.Update(ctx, &Product{ID: 2, SKU: "abc", Name: "two"}); err != ErrDuplicateSKU {
+		t.Errorf("Expected ErrDuplicateSKU. Got %v", err)
+	}
+	s.Delete(ctx, 1, 0)
+	if _, err = s.GetBySKU(ctx, "abc"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+	if err = s.Update(ctx, &Product{ID: 2, SKU: "abc", Name: "two"}); err != nil {
+		t.Errorf("Expected the deleted product's sku to be free. Got %v", err)
+	}
+	if _, err = s.Restore(ctx, 1); err != ErrDuplicateSKU {
+		t.Errorf("Expected ErrDuplicateSKU. Got %v", err)
+	}
+}
+
+func TestMemoryStoreConcurrency(t *testing.T) {
+
+	// Many goroutines creating products at once should never hand out
+	// the same id twice. Run with -race to check the locking.
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Create(ctx, &Product{Name: "product"})
+			s.List(ctx, Query{Count: 10})
+		}()
+	}
+	wg.Wait()
+
+	products, _ := s.List(ctx, Query{Count: 100})
+	if len(products) != 50 {
+		t.Errorf("Expected 50 products. Got %v", len(products))
+	}
+}
+
+func TestMemoryStoreCanceled(t *testing.T) {
+
+	// A canceled context should stop the call and return ctx.Err().
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := NewMemoryStore()
+	if err := s.Create(ctx, &Product{Name: "product"}); err != context.Canceled {
+		t.Errorf("Expected context.Canceled. Got %v", err)
+	}
+
+	if _, err := s.List(ctx, Query{Count: 10}); err != context.Canceled {
+		t.Errorf("Expected context.Canceled. Got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCurrency is the currency products get when none is given. It
+// matches the default of the currency column.
+const DefaultCurrency = "USD"
+
+// Money is an exact amount of money held as an integer number of cents,
+// matching the NUMERIC(10,2) columns it is stored in. It never passes
+// through a float: it scans from and is written to Postgres as a decimal
+// string and is marshaled to JSON as a number with exactly two decimal
+// places.
+type Money int64
+
+// MoneyError is returned when a value can't be represented as Money.
+type MoneyError struct {
+	Value  string
+	Reason string
+}
+
+func (e *MoneyError) Error() string {
+	return "invalid amount " + strconv.Quote(e.Value) + ": " + e.Reason
+}
+
+// ParseMoney parses a decimal string such as "5.97", "-1" or "0.5". It
+// returns a *MoneyError if s is not a plain decimal number or has more
+// than two decimal places.
+func ParseMoney(s string) (Money, error) {
+	str := strings.TrimSpace(s)
+
+	negative := strings.HasPrefix(str, "-")
+	str = strings.TrimPrefix(strings.TrimPrefix(str, "-"), "+")
+
+	whole, frac := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		whole, frac = str[:i], str[i+1:]
+	}
+
+	// trailing zeros don't add precision, 1.500 is fine
+	frac = strings.TrimRight(frac, "0")
+
+	if whole == "" && frac == "" || !digits(whole) || !digits(frac) {
+		return 0, &MoneyError{Value: s, Reason: "not a decimal number"}
+	}
+	if len(frac) > 2 {
+		return 0, &MoneyError{Value: s, Reason: "must have at most 2 decimal places"}
+	}
+
+	cents, err := strconv.ParseInt("0"+whole+(frac + "00")[:2], 10, 64)
+	if err != nil {
+		return 0, &MoneyError{Value: s, Reason: "out of range"}
+	}
+
+	if negative {
+		cents = -cents
+	}
+
+	return Money(cents), nil
+}
+
+// digits reports whether s consists only of ASCII digits.
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String formats m with exactly two decimal places, e.g. "5.00".
+func (m Money) String() string {
+	cents := int64(m)
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+
+	frac := strconv.FormatInt(cents%100, 10)
+	if len(frac) < 2 {
+		frac = "0" + frac
+	}
+
+	return sign + strconv.FormatInt(cents/100, 10) + "." + frac
+}
+
+// Float64 returns m as a float64. It is only meant for comparisons such
+// as validation limits, never for arithmetic.
+func (m Money) Float64() float64 {
+	return float64(m) / 100
+}
+
+// MarshalJSON encodes m as a JSON number with two decimal places.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a string holding a decimal.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+
+	return nil
+}
+
+// Scan implements sql.Scanner. Postgres sends numeric values as text.
+func (m *Money) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	default:
+		return errors.Errorf("can't scan %T into Money", src)
+	}
+
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+
+	return nil
+}
+
+// Value implements driver.Valuer, sending m as a decimal string so that
+// Postgres stores it exactly.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
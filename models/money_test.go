@@ -0,0 +1,101 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"0", 0},
+		{"5.97", 597},
+		{"5.9", 590},
+		{"5.", 500},
+		{".5", 50},
+		{"-0.01", -1},
+		{"+3", 300},
+		{"1.500", 150},
+		{"99999999.99", 9999999999},
+	}
+
+	for _, test := range tests {
+		got, err := ParseMoney(test.in)
+		if err != nil {
+			t.Errorf("%s: error: %v", test.in, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: expected %d. Got %d", test.in, test.want, got)
+		}
+	}
+
+	for _, in := range []string{"", "-", "abc", "1e3", "1.2.3", "5.971", "5.970000000000001", "99999999999999999999"} {
+		if _, err := ParseMoney(in); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+
+	tests := map[Money]string{
+		0:    "0.00",
+		5:    "0.05",
+		597:  "5.97",
+		500:  "5.00",
+		-1:   "-0.01",
+		-150: "-1.50",
+	}
+
+	for m, want := range tests {
+		if got := m.String(); got != want {
+			t.Errorf("%d: expected %s. Got %s", m, want, got)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+
+	// Money is marshaled as a number with a fixed scale, so sums that
+	// drift in floating point (3 * 1.99) come out exact.
+	b, _ := json.Marshal(Product{ID: 1, Name: "x", Price: 3 * 199, Currency: "USD"})
+	expected := `{"id":1,"name":"x","price":5.97,"currency":"USD",` +
+		`"created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"}`
+	if string(b) != expected {
+		t.Errorf("Expected %s. Got %s", expected, b)
+	}
+
+	// both numbers and strings are accepted
+	var p Product
+	if err := json.Unmarshal([]byte(`{"price":"11.22"}`), &p); err != nil || p.Price != 1122 {
+		t.Errorf("Expected 1122. Got %d (%v)", p.Price, err)
+	}
+	if err := json.Unmarshal([]byte(`{"price":11.2}`), &p); err != nil || p.Price != 1120 {
+		t.Errorf("Expected 1120. Got %d (%v)", p.Price, err)
+	}
+
+	err := json.Unmarshal([]byte(`{"price":11.225}`), &p)
+	if _, ok := err.(*MoneyError); !ok {
+		t.Errorf("Expected a MoneyError. Got %v", err)
+	}
+}
+
+func TestMoneySQL(t *testing.T) {
+
+	var m Money
+	if err := m.Scan([]byte("14.99")); err != nil || m != 1499 {
+		t.Errorf("Expected 1499. Got %d (%v)", m, err)
+	}
+
+	v, _ := m.Value()
+	if v != "14.99" {
+		t.Errorf("Expected '14.99'. Got %v", v)
+	}
+
+	if err := m.Scan(1.5); err == nil {
+		t.Errorf("Expected an error scanning a float")
+	}
+}
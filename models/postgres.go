@@ -0,0 +1,388 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	// Postgres driver
+	_ "github.com/lib/pq"
+)
+
+// PostgresStore is a ProductStore backed by the products table in a
+// Postgres database. It uses the CRUD methods on Product.
+type PostgresStore struct {
+	DB *sql.DB
+
+	// Timeout bounds every query. Zero means queries are only bounded by
+	// the caller's context.
+	Timeout time.Duration
+
+	// BatchTimeout bounds a bulk request or an import, which run many
+	// statements in one transaction, in place of Timeout. Zero means Timeout applies.
+	BatchTimeout time.Duration
+
+	// trigrams records whether the pg_trgm extension is installed, which
+	// is only checked by the first search.
+	mu       sync.Mutex
+	checked  bool
+	trigrams bool
+}
+
+// NewPostgresStore returns a PostgresStore using db, with each query
+// limited to timeout.
+func NewPostgresStore(db *sql.DB, timeout time.Duration) *PostgresStore {
+	return &PostgresStore{DB: db, Timeout: timeout}
+}
+
+// Get gets one product by id
+func (s *PostgresStore) Get(ctx context.Context, id int) (Product, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	p := Product{ID: id}
+	err := p.Get(ctx, s.DB)
+
+	return p, contextError(ctx, err)
+}
+
+// GetBySKU gets one product by sku
+func (s *PostgresStore) GetBySKU(ctx context.Context, sku string) (Product, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	p := Product{SKU: sku}
+	err := p.GetBySKU(ctx, s.DB)
+
+	return p, contextError(ctx, err)
+}
+
+// List fetches a list of products
+func (s *PostgresStore) List(ctx context.Context, q Query) ([]Product, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	products, err := GetMany(ctx, s.DB, q)
+
+	return products, contextError(ctx, err)
+}
+
+// Search finds the products matching q, with typo tolerance if the
+// pg_trgm extension is installed.
+func (s *PostgresStore) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	trigrams, err := s.hasTrigrams(ctx)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	results, err := Search(ctx, s.DB, q, trigrams)
+
+	return results, contextError(ctx, err)
+}
+
+// hasTrigrams reports whether the pg_trgm extension is installed. The
+// migration installs it when it can, so the answer is cached.
+func (s *PostgresStore) hasTrigrams(ctx context.Context) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.checked {
+		err := s.DB.QueryRowContext(ctx,
+			"SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')").Scan(&s.trigrams)
+		if err != nil {
+			return false, err
+		}
+		s.checked = true
+	}
+
+	return s.trigrams, nil
+}
+
+// exportBatch is the number of rows fetched from an export cursor at a
+// time, which bounds the memory an export uses.
+const exportBatch = 1000
+
+// Export calls fn with every product matching q's filters, in q's order.
+// The rows are read from a server-side cursor a batch at a time, so the
+// whole table never has to fit in memory. The store's timeout applies to
+// each batch rather than to the whole export.
+func (s *PostgresStore) Export(ctx context.Context, q Query, fn func(p Product) error) error {
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	q.Start, q.Count, q.Cursor = 0, 0, nil
+	where, args := q.where(nil)
+	_, err = tx.ExecContext(ctx,
+		"DECLARE export NO SCROLL CURSOR FOR SELECT "+listColumns+" FROM products"+where+q.orderBy(), args...)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	for {
+		products, err := s.fetch(ctx, tx)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+
+		// fn may be slow, e.g. writing to a slow client, so it's only
+		// called once the batch has been read
+		for _, p := range products {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+
+		if len(products) < exportBatch {
+			return nil
+		}
+	}
+}
+
+// fetch reads the next batch of rows from the export cursor.
+func (s *PostgresStore) fetch(ctx context.Context, tx *sql.Tx) ([]Product, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := tx.QueryContext(ctx, "FETCH "+strconv.Itoa(exportBatch)+" FROM export")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make([]Product, 0, exportBatch)
+	for rows.Next() {
+		var p Product
+		if err := scanProduct(rows, &p); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
+}
+
+// Count counts the products matching q, or estimates the count if exact
+// is false
+func (s *PostgresStore) Count(ctx context.Context, q Query, exact bool) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var n int
+	var err error
+	if exact {
+		n, err = CountMany(ctx, s.DB, q)
+	} else {
+		n, err = EstimateMany(ctx, s.DB, q)
+	}
+
+	return n, contextError(ctx, err)
+}
+
+// Create creates a new product
+func (s *PostgresStore) Create(ctx context.Context, p *Product) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return contextError(ctx, p.Post(ctx, s.DB))
+}
+
+// Update updates one product by id
+func (s *PostgresStore) Update(ctx context.Context, p *Product) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return contextError(ctx, p.Put(ctx, s.DB))
+}
+
+// Upsert creates or replaces one product by sku
+func (s *PostgresStore) Upsert(ctx context.Context, p *Product) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	created, err := p.Upsert(ctx, s.DB)
+
+	return created, contextError(ctx, err)
+}
+
+// Patch modifies one product by id in a transaction, holding a lock on
+// its row until the patched product is written back.
+func (s *PostgresStore) Patch(ctx context.Context, id int, patch func(p *Product) error) (Product, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	p := Product{ID: id}
+	err := s.patch(ctx, &p, patch)
+
+	return p, contextError(ctx, err)
+}
+
+func (s *PostgresStore) patch(ctx context.Context, p *Product, patch func(p *Product) error) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := p.Lock(ctx, tx); err != nil {
+		return err
+	}
+
+	id, version := p.ID, p.Version
+	if err := patch(p); err != nil {
+		return err
+	}
+	p.ID, p.Version = id, version
+
+	if err := p.Put(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete deletes one product by id
+func (s *PostgresStore) Delete(ctx context.Context, id, version int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	p := Product{ID: id, Version: version}
+	return contextError(ctx, p.Delete(ctx, s.DB))
+}
+
+// Bulk runs many operations in one transaction, which is only committed
+// if they all succeed or atomic isn't set
+func (s *PostgresStore) Bulk(ctx context.Context, ops []BulkOp, atomic bool) ([]BulkResult, error) {
+	ctx, cancel := s.withBatchTimeout(ctx)
+	defer cancel()
+
+	results, err := s.bulk(ctx, ops, atomic)
+
+	return results, contextError(ctx, err)
+}
+
+func (s *PostgresStore) bulk(ctx context.Context, ops []BulkOp, atomic bool) ([]BulkResult, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results, err := Bulk(ctx, tx, ops, atomic)
+	if err != nil || (atomic && BulkFailed(results)) {
+		return results, err
+	}
+
+	return results, tx.Commit()
+}
+
+// Import upserts products by sku or name in a single transaction
+func (s *PostgresStore) Import(ctx context.Context, products []Product) ([]ImportResult, error) {
+	ctx, cancel := s.withBatchTimeout(ctx)
+	defer cancel()
+
+	results, err := s.importProducts(ctx, products)
+
+	return results, contextError(ctx, err)
+}
+
+func (s *PostgresStore) importProducts(ctx context.Context, products []Product) ([]ImportResult, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results, err := Import(ctx, tx, products)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, tx.Commit()
+}
+
+// Restore restores one product by id from the trash
+func (s *PostgresStore) Restore(ctx context.Context, id int) (Product, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	p := Product{ID: id}
+	err := p.Restore(ctx, s.DB)
+
+	return p, contextError(ctx, err)
+}
+
+// Purge deletes the products trashed before the given time for good
+func (s *PostgresStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	n, err := Purge(ctx, s.DB, before)
+
+	return n, contextError(ctx, err)
+}
+
+// withTimeout derives the context for a single query.
+func (s *PostgresStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return queryContext(ctx, s.Timeout)
+}
+
+// withBatchTimeout derives the context for a transaction of many
+// statements.
+func (s *PostgresStore) withBatchTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.BatchTimeout <= 0 {
+		return s.withTimeout(ctx)
+	}
+
+	return queryContext(ctx, s.BatchTimeout)
+}
+
+// queryContext derives the context for a single query, limited to
+// timeout unless it is zero.
+func queryContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError replaces err with the context's error when the query failed
+// because the context was canceled or timed out. Depending on timing the
+// driver reports this either as ctx.Err() or as its own "canceling
+// statement" error; callers should only have to check for the former.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
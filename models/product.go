@@ -24,75 +24,194 @@
 package model
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"strconv"
-	// Postgres driver
-	_ "github.com/lib/pq"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 )
 
 // When we define a model we
 // - Give it CRUD methods
 // - Give it a "GetMany" function
 // - Give it helper methods:
-//   * EnsureTableExists is a function to create the underlying table if it does not exist
 //   * ClearTable is a function to clean out the table
 //   * AddTestData is a function to create test data
+//
+// The underlying table is created by the migrations package.
 
-const createProductsTable = `CREATE TABLE IF NOT EXISTS products
-(
-id SERIAL,
-name TEXT NOT NULL,
-price NUMERIC(10,2) NOT NULL DEFAULT 0.00,
-CONSTRAINT products_pkey PRIMARY KEY (id)
-)`
-
-// Product represents products
+// Product represents products. The validate tags mirror the constraints of
+// the products table so that bad data is rejected before it gets there.
 type Product struct {
-	ID    int     `json:"id"`
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	ID       int    `json:"id"`
+	SKU      string `json:"sku,omitempty" validate:"sku"`
+	Name     string `json:"name" validate:"required,max=255"`
+	Price    Money  `json:"price" validate:"min=0,max=99999999.99"`
+	Currency string `json:"currency" validate:"currency"`
+
+	// Version starts at 1 and goes up with every update. It is sent as
+	// the ETag rather than in the body.
+	Version int `json:"-"`
+
+	// CreatedAt, UpdatedAt and DeletedAt are maintained by the store, any
+	// values sent by a client are ignored. DeletedAt is set while the
+	// product is in the trash.
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// SetDefaults fills in the fields a client may leave out.
+func (p *Product) SetDefaults() {
+	if p.Currency == "" {
+		p.Currency = DefaultCurrency
+	}
+}
+
+// Validate checks the product against its validation rules and returns a
+// ValidationError listing every violation, or nil.
+func (p *Product) Validate() error {
+	return Validate(p)
 }
 
 /**
  * CRUD Methods
  */
 
-// Get gets one product by id
-func (p *Product) Get(db *sql.DB) error {
-	err := db.QueryRow("SELECT name, price FROM products WHERE id=$1",
-		p.ID).Scan(&p.Name, &p.Price)
+// Querier is implemented by both *sql.DB and *sql.Tx, so the CRUD methods
+// can run on their own or as part of a transaction.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Get gets one product by id. It returns ErrNotFound if there is no
+// such product or it has been deleted.
+func (p *Product) Get(ctx context.Context, db Querier) error {
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(sku, ''), name, price, currency, version, created_at, updated_at FROM products WHERE id=$1 AND deleted_at IS NULL",
+		p.ID).Scan(&p.SKU, &p.Name, &p.Price, &p.Currency, &p.Version, &p.CreatedAt, &p.UpdatedAt)
 
-	return err
+	return notFound(err)
 }
 
-// Put updates one product by id
-func (p *Product) Put(db *sql.DB) error {
-	_, err := db.Exec("UPDATE products SET name=$1, price=$2 WHERE id=$3", p.Name, p.Price, p.ID)
+// GetBySKU gets one product by sku like Get.
+func (p *Product) GetBySKU(ctx context.Context, db Querier) error {
+	err := db.QueryRowContext(ctx, "SELECT id, name, price, currency, version, created_at, updated_at FROM products WHERE sku=$1 AND deleted_at IS NULL",
+		p.SKU).Scan(&p.ID, &p.Name, &p.Price, &p.Currency, &p.Version, &p.CreatedAt, &p.UpdatedAt)
 
-	return err
+	return notFound(err)
 }
 
-// Delete deletes one product by id
-func (p *Product) Delete(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM products WHERE id=$1", p.ID)
+// Lock gets one product by id like Get and locks its row until the end of
+// the transaction tx, so it can be read, modified and written back
+// without another transaction changing it in between.
+func (p *Product) Lock(ctx context.Context, tx *sql.Tx) error {
+	err := tx.QueryRowContext(ctx,
+		"SELECT COALESCE(sku, ''), name, price, currency, version, created_at, updated_at FROM products WHERE id=$1 AND deleted_at IS NULL FOR UPDATE",
+		p.ID).Scan(&p.SKU, &p.Name, &p.Price, &p.Currency, &p.Version, &p.CreatedAt, &p.UpdatedAt)
 
-	return err
+	return notFound(err)
+}
+
+// Put updates one product by id, bumps its version and reloads p with the
+// stored row. If p.Version isn't zero the product is only updated if it
+// is still at that version. It returns ErrNotFound if there is no such
+// product, or ErrVersionMismatch if it has changed.
+func (p *Product) Put(ctx context.Context, db Querier) error {
+	err := db.QueryRowContext(ctx,
+		"UPDATE products SET name=$1, price=$2, currency=$3, sku=NULLIF($6, ''), version=version+1 "+
+			"WHERE id=$4 AND deleted_at IS NULL AND ($5::int = 0 OR version=$5) "+
+			"RETURNING name, price, currency, version, created_at, updated_at",
+		p.Name, p.Price, p.Currency, p.ID, p.Version, p.SKU).Scan(&p.Name, &p.Price, &p.Currency, &p.Version, &p.CreatedAt, &p.UpdatedAt)
+
+	return p.mismatch(ctx, db, notFound(skuTaken(err)))
+}
+
+// Delete moves one product by id to the trash, it stays in the table
+// until it is restored or purged. If p.Version isn't zero the product is
+// only deleted if it is still at that version. It returns ErrNotFound if
+// there is no such product, or ErrVersionMismatch if it has changed.
+func (p *Product) Delete(ctx context.Context, db Querier) error {
+	res, err := db.ExecContext(ctx,
+		"UPDATE products SET deleted_at=now(), version=version+1 "+
+			"WHERE id=$1 AND deleted_at IS NULL AND ($2::int = 0 OR version=$2)",
+		p.ID, p.Version)
+	if err != nil {
+		return err
+	}
+
+	return p.mismatch(ctx, db, rowsAffected(res))
+}
+
+// Restore takes one product by id back out of the trash and reloads p
+// with it. It returns ErrNotFound if there is no such product in the
+// trash.
+func (p *Product) Restore(ctx context.Context, db Querier) error {
+	err := db.QueryRowContext(ctx,
+		"UPDATE products SET deleted_at=NULL, version=version+1 "+
+			"WHERE id=$1 AND deleted_at IS NOT NULL RETURNING COALESCE(sku, ''), name, price, currency, version, created_at, updated_at",
+		p.ID).Scan(&p.SKU, &p.Name, &p.Price, &p.Currency, &p.Version, &p.CreatedAt, &p.UpdatedAt)
+	p.DeletedAt = nil
+
+	return notFound(skuTaken(err))
 }
 
 // Post creates a new product
-func (p *Product) Post(db *sql.DB) error {
-	err := db.QueryRow(
-		"INSERT INTO products(name, price) VALUES($1, $2) RETURNING id",
-		p.Name, p.Price).Scan(&p.ID)
+func (p *Product) Post(ctx context.Context, db Querier) error {
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO products(name, price, currency, sku) VALUES($1, $2, $3, NULLIF($4, '')) RETURNING id, version, created_at, updated_at",
+		p.Name, p.Price, p.Currency, p.SKU).Scan(&p.ID, &p.Version, &p.CreatedAt, &p.UpdatedAt)
 
-	return err
+	return skuTaken(err)
 }
 
-// GetMany fetches a list of products
-func GetMany(db *sql.DB, start, count int) ([]Product, error) {
-	rows, err := db.Query(
-		"SELECT id, name, price FROM products LIMIT $1 OFFSET $2",
-		count, start)
+// Upsert creates the product with p's sku, or replaces it if there is
+// one, and reports whether it was created. If p.Version isn't zero only
+// an existing product still at that version is replaced; it returns
+// ErrNotFound if there is no such product, or ErrVersionMismatch if it
+// has changed.
+func (p *Product) Upsert(ctx context.Context, db Querier) (created bool, err error) {
+	if p.Version != 0 {
+		err = db.QueryRowContext(ctx,
+			"UPDATE products SET name=$1, price=$2, currency=$3, version=version+1 "+
+				"WHERE sku=$4 AND deleted_at IS NULL AND version=$5 "+
+				"RETURNING id, version, created_at, updated_at",
+			p.Name, p.Price, p.Currency, p.SKU, p.Version).Scan(&p.ID, &p.Version, &p.CreatedAt, &p.UpdatedAt)
+
+		return false, p.mismatch(ctx, db, notFound(err))
+	}
+
+	// a product is created at version 1 and every update bumps it
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO products(sku, name, price, currency) VALUES($1, $2, $3, $4) "+
+			"ON CONFLICT (sku) WHERE deleted_at IS NULL DO UPDATE "+
+			"SET name=EXCLUDED.name, price=EXCLUDED.price, currency=EXCLUDED.currency, version=products.version+1 "+
+			"RETURNING id, version, created_at, updated_at",
+		p.SKU, p.Name, p.Price, p.Currency).Scan(&p.ID, &p.Version, &p.CreatedAt, &p.UpdatedAt)
+
+	return p.Version == 1, err
+}
+
+// listColumns are the columns of a product listing, in the order
+// scanProduct reads them.
+const listColumns = "id, COALESCE(sku, ''), name, price, currency, version, created_at, updated_at, deleted_at"
+
+// scanProduct reads a row of listColumns into p.
+func scanProduct(rows *sql.Rows, p *Product) error {
+	return rows.Scan(&p.ID, &p.SKU, &p.Name, &p.Price, &p.Currency, &p.Version, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt)
+}
+
+// GetMany fetches a list of products matching q
+func GetMany(ctx context.Context, db *sql.DB, q Query) ([]Product, error) {
+	where, args := q.where(nil)
+	query := "SELECT " + listColumns + " FROM products" + where + q.orderBy()
+	query, args = q.limit(query, args)
+
+	rows, err := db.QueryContext(ctx, query, args...)
 
 	if err != nil {
 		return nil, err
@@ -104,25 +223,150 @@ func GetMany(db *sql.DB, start, count int) ([]Product, error) {
 
 	for rows.Next() {
 		var p Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+		if err := scanProduct(rows, &p); err != nil {
 			return nil, err
 		}
 		products = append(products, p)
 	}
+	q.restoreOrder(products)
 
 	return products, nil
 }
 
+// Purge permanently deletes the products that were moved to the trash
+// before the given time, and returns how many there were.
+func Purge(ctx context.Context, db Querier, before time.Time) (int, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM products WHERE deleted_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// CountMany counts the products matching q's filters
+func CountMany(ctx context.Context, db *sql.DB, q Query) (int, error) {
+	q.Cursor = nil
+	where, args := q.where(nil)
+
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM products"+where, args...).Scan(&n)
+
+	return n, err
+}
+
+// EstimateMany estimates the number of products matching q's filters
+// without scanning the table. With no filters but the trash it uses the
+// planner's row counts from pg_class, otherwise the row estimate from
+// EXPLAIN. Both are only as fresh as the table's last ANALYZE.
+func EstimateMany(ctx context.Context, db *sql.DB, q Query) (int, error) {
+	q.Cursor = nil
+	where, args := q.where(nil)
+
+	all := q
+	all.Deleted = IncludeDeleted
+	if unfiltered, _ := all.where(nil); unfiltered == "" {
+		// products_sku_key indexes every product that isn't in the
+		// trash, with or without a sku
+		var total, live float64
+		err := db.QueryRowContext(ctx, `SELECT
+			(SELECT reltuples FROM pg_class WHERE oid = 'products'::regclass),
+			(SELECT reltuples FROM pg_class WHERE oid = 'products_sku_key'::regclass)`).Scan(&total, &live)
+		switch {
+		case err != nil:
+			return 0, err
+		case total < 0 || live < 0:
+			// the table has never been analyzed, so there's no estimate
+			return CountMany(ctx, db, q)
+		case q.Deleted == ExcludeDeleted:
+			return int(live), nil
+		case q.Deleted == OnlyDeleted && total < live:
+			return 0, nil
+		case q.Deleted == OnlyDeleted:
+			return int(total - live), nil
+		}
+
+		return int(total), nil
+	}
+
+	var plan []byte
+	err := db.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) SELECT 1 FROM products"+where, args...).Scan(&plan)
+	if err != nil {
+		return 0, err
+	}
+
+	var explain []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		}
+	}
+	if err := json.Unmarshal(plan, &explain); err != nil || len(explain) == 0 {
+		return 0, errors.New("unexpected EXPLAIN output")
+	}
+
+	return int(explain[0].Plan.Rows), nil
+}
+
 /**
  * Helpers
  */
 
-// EnsureTableExists makes sure that the table we need for testing is available.
-func (p *Product) EnsureTableExists(db *sql.DB) error {
-	if _, err := db.Exec(createProductsTable); err != nil {
+// notFound translates sql.ErrNoRows into ErrNotFound.
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// mismatch tells apart the two reasons a conditional statement on p can
+// miss its row: if err is ErrNotFound but the product exists, it must
+// have been at another version and ErrVersionMismatch is returned. The
+// product is looked up by id, or by sku if it has no id.
+func (p *Product) mismatch(ctx context.Context, db Querier, err error) error {
+	if err != ErrNotFound || p.Version == 0 {
 		return err
 	}
 
+	query, key := "SELECT EXISTS(SELECT 1 FROM products WHERE id=$1 AND deleted_at IS NULL)", interface{}(p.ID)
+	if p.ID == 0 {
+		query, key = "SELECT EXISTS(SELECT 1 FROM products WHERE sku=$1 AND deleted_at IS NULL)", p.SKU
+	}
+
+	var exists bool
+	err = db.QueryRowContext(ctx, query, key).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+
+	return ErrNotFound
+}
+
+// skuTaken translates a violation of the unique sku index into
+// ErrDuplicateSKU.
+func skuTaken(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" && pqErr.Constraint == "products_sku_key" {
+		return ErrDuplicateSKU
+	}
+
+	return err
+}
+
+// rowsAffected returns ErrNotFound if a statement didn't touch any rows.
+func rowsAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
 	return nil
 }
 
@@ -145,7 +389,7 @@ func (p *Product) AddTestData(db *sql.DB, count int) error {
 
 	var err error
 	for i := 0; i < count; i++ {
-		_, err = db.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Product "+strconv.Itoa(i+1), float32(i+1.0)*1.99)
+		_, err = db.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Product "+strconv.Itoa(i+1), Money(199*(i+1)))
 		if err != nil {
 			return err
 		}
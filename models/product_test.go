@@ -1,30 +1,62 @@
 package model
 
 import (
+	"context"
 	"database/sql"
+	"os"
+	"reflect"
 	"testing"
+	"time"
 
-	"github.com/dstroot/postgres-api/api"
+	"github.com/dstroot/postgres-api/migrations"
+	"github.com/pkg/errors"
+	// Load environment vars
+	_ "github.com/joho/godotenv/autoload"
 )
 
-func TestGet(t *testing.T) {
+// openDB connects to the Postgres database configured in our environment
+// and migrates it. The test is skipped when the database can't be reached
+// so that the suite can run without Postgres.
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("postgres", "postgres://"+os.Getenv("SQL_USER")+
+		":"+os.Getenv("SQL_PASSWORD")+
+		"@"+os.Getenv("SQL_HOST")+
+		":"+os.Getenv("SQL_PORT")+
+		"/"+os.Getenv("SQL_DATABASE")+
+		"?sslmode=disable")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skipf("Skipping, Postgres is not available: %s", err)
+	}
 
-	// Initialize app
-	a, err := api.Initialize()
+	// make sure the schema is up to date
+	m, err := migrations.New(db)
+	if err == nil {
+		_, err = m.Up()
+	}
 	if err != nil {
-		t.Errorf("Expected clean initialization. Got %s", err.Error())
+		t.Fatalf("Expected clean migration. Got %s", err)
 	}
-	defer a.DB.Close()
+
+	return db
+}
+
+func TestGet(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
 
 	p := Product{ID: 1}
 
-	p.EnsureTableExists(a.DB)
-	p.ClearTable(a.DB)
-	p.AddTestData(a.DB, 1)
+	p.ClearTable(db)
+	p.AddTestData(db, 1)
 
-	err1 := p.Get(a.DB)
+	err1 := p.Get(context.Background(), db)
 	if err1 != nil {
-		if err1 == sql.ErrNoRows {
+		if err1 == ErrNotFound {
 			t.Errorf("Expected a row to be returned. Got %s", err1.Error())
 			return
 		}
@@ -32,28 +64,24 @@ func TestGet(t *testing.T) {
 		t.Errorf("Error: %v", err1)
 	}
 
-	p.ClearTable(a.DB)
+	p.ClearTable(db)
 }
 
 func TestPut(t *testing.T) {
 
-	// Initialize app
-	a, err := api.Initialize()
-	if err != nil {
-		t.Errorf("Expected clean initialization. Got %s", err.Error())
-	}
-	defer a.DB.Close()
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
 
 	p := Product{ID: 1}
 
-	p.EnsureTableExists(a.DB)
-	p.ClearTable(a.DB)
-	p.AddTestData(a.DB, 1)
+	p.ClearTable(db)
+	p.AddTestData(db, 1)
 
 	// get product
-	err1 := p.Get(a.DB)
+	err1 := p.Get(context.Background(), db)
 	if err1 != nil {
-		if err1 == sql.ErrNoRows {
+		if err1 == ErrNotFound {
 			t.Errorf("Expected a row to be returned. Got %s", err1.Error())
 			return
 		}
@@ -66,9 +94,9 @@ func TestPut(t *testing.T) {
 
 	// update product
 	p.Name = "new name"
-	err2 := p.Put(a.DB)
+	err2 := p.Put(context.Background(), db)
 	if err2 != nil {
-		if err2 == sql.ErrNoRows {
+		if err2 == ErrNotFound {
 			t.Errorf("Expected a row to be returned. Got %s", err2.Error())
 			return
 		}
@@ -77,9 +105,9 @@ func TestPut(t *testing.T) {
 	}
 
 	// get product again
-	err3 := p.Get(a.DB)
+	err3 := p.Get(context.Background(), db)
 	if err3 != nil {
-		if err3 == sql.ErrNoRows {
+		if err3 == ErrNotFound {
 			t.Errorf("Expected a row to be returned. Got %s", err3.Error())
 			return
 		}
@@ -100,65 +128,493 @@ func TestPut(t *testing.T) {
 		t.Errorf("Expected the price to remain the same (%v). Got %v", original.Price, p.Price)
 	}
 
-	p.ClearTable(a.DB)
+	p.ClearTable(db)
 }
 
 func TestDelete(t *testing.T) {
 
-	// Initialize app
-	a, err := api.Initialize()
-	if err != nil {
-		t.Errorf("Expected clean initialization. Got %s", err.Error())
-	}
-	defer a.DB.Close()
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
 
 	p := Product{ID: 1}
 
-	p.EnsureTableExists(a.DB)
-	p.ClearTable(a.DB)
-	p.AddTestData(a.DB, 1)
+	p.ClearTable(db)
+	p.AddTestData(db, 1)
 
 	// delete product
-	err1 := p.Delete(a.DB)
+	err1 := p.Delete(context.Background(), db)
 	if err1 != nil {
 		t.Errorf("Error: %v", err1)
 	}
 
 	// get product > no rows
-	err2 := p.Get(a.DB)
+	err2 := p.Get(context.Background(), db)
 	if err2 != nil {
-		if err2 == sql.ErrNoRows {
+		if err2 == ErrNotFound {
 			return
 		}
 		t.Errorf("Expected no rows to be returned. Got %s", err2.Error())
 	}
 
-	p.ClearTable(a.DB)
+	p.ClearTable(db)
 }
 
-func TestPost(t *testing.T) {
+func TestEstimateMany(t *testing.T) {
+
+	// This test checks that listings with no filters but the trash are
+	// estimated from pg_class.
+	db := openDB(t)
+	defer db.Close()
+
+	p := Product{ID: 1}
+
+	p.ClearTable(db)
+	p.AddTestData(db, 3)
+	p.Delete(context.Background(), db)
+	if _, err := db.Exec("VACUUM ANALYZE products"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for deleted, expected := range map[Deleted]int{ExcludeDeleted: 2, OnlyDeleted: 1, IncludeDeleted: 3} {
+		n, err := EstimateMany(context.Background(), db, Query{Deleted: deleted})
+		if err != nil || n != expected {
+			t.Errorf("Expected an estimate of %v. Got %v (%v)", expected, n, err)
+		}
+	}
+
+	p.ClearTable(db)
+}
+
+func TestVersion(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	p := Product{ID: 1}
+	p.ClearTable(db)
+	p.AddTestData(db, 1)
+	p.Get(context.Background(), db)
+
+	// an update at the current version bumps it
+	if err := p.Put(context.Background(), db); err != nil || p.Version != 2 {
+		t.Errorf("Expected version 2. Got %v (%v)", p.Version, err)
+	}
+
+	// updates and deletes at an old version are refused
+	stale := Product{ID: 1, Name: "stale", Currency: "USD", Version: 1}
+	if err := stale.Put(context.Background(), db); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch. Got %v", err)
+	}
+	if err := stale.Delete(context.Background(), db); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch. Got %v", err)
+	}
+
+	p.ClearTable(db)
+}
+
+func TestRestore(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	p := Product{ID: 1}
+	p.ClearTable(db)
+	p.AddTestData(db, 2)
+
+	// a deleted product stays in the table, out of the default listing
+	p.Delete(context.Background(), db)
+	products, _ := GetMany(context.Background(), db, Query{})
+	trash, _ := GetMany(context.Background(), db, Query{Deleted: OnlyDeleted})
+	if len(products) != 1 || len(trash) != 1 || trash[0].DeletedAt == nil {
+		t.Errorf("Expected 1 live and 1 deleted product. Got %v and %v", len(products), len(trash))
+	}
+
+	if err := p.Restore(context.Background(), db); err != nil || p.Name != "Product 1" {
+		t.Errorf("Expected the product to be restored. Got %+v (%v)", p, err)
+	}
+	if err := p.Restore(context.Background(), db); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	// only products deleted before the cutoff are purged
+	p.Delete(context.Background(), db)
+	if n, err := Purge(context.Background(), db, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("Expected nothing to be purged. Got %v (%v)", n, err)
+	}
+	if n, err := Purge(context.Background(), db, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Errorf("Expected 1 product to be purged. Got %v (%v)", n, err)
+	}
+
+	p.ClearTable(db)
+}
+
+func TestTimestamps(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	p := Product{ID: 1}
+	p.ClearTable(db)
+	p.AddTestData(db, 2)
+	p.Get(context.Background(), db)
+	created := p.CreatedAt
+
+	// the trigger moves updated_at on, created_at stays put
+	time.Sleep(10 * time.Millisecond)
+	p.Put(context.Background(), db)
+	if !p.CreatedAt.Equal(created) || !p.UpdatedAt.After(created) {
+		t.Errorf("Expected only updated_at to change. Got %v and %v", p.CreatedAt, p.UpdatedAt)
+	}
+
+	products, _ := GetMany(context.Background(), db, Query{UpdatedSince: &p.UpdatedAt})
+	if len(products) != 1 || products[0].ID != 1 {
+		t.Errorf("Expected only product 1 to be updated since %v. Got %+v", p.UpdatedAt, products)
+	}
+
+	p.ClearTable(db)
+}
+
+func TestBulk(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	s := NewPostgresStore(db, 0)
+	p := Product{}
+	p.ClearTable(db)
+	p.AddTestData(db, 1)
+
+	ops := []BulkOp{
+		{Op: BulkCreate, Product: Product{Name: "two", Price: 200, Currency: "USD"}},
+		{Op: BulkCreate, Product: Product{Name: "bad", Price: 300, Currency: "usd"}},
+		{Op: BulkCreate, Product: Product{Name: "four", Price: 400, Currency: "USD"}},
+		{Op: BulkUpdate, Product: Product{ID: 1, Name: "one", Price: 100, Currency: "USD"}},
+		{Op: BulkDelete, Product: Product{ID: 99}},
+	}
+
+	// the bad currency breaks the multi-row insert, so the creates are
+	// retried one by one to find it
+	results, err := s.Bulk(context.Background(), ops, false)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if results[0].Err != nil || results[1].Err == nil || results[2].Err != nil || results[3].Err != nil || results[4].Err != ErrNotFound {
+		t.Errorf("Expected the bad create and the delete to fail. Got %+v", results)
+	}
+
+	n, _ := CountMany(context.Background(), db, Query{})
+	if n != 3 {
+		t.Errorf("Expected 3 products. Got %v", n)
+	}
+
+	// in atomic mode nothing is applied
+	results, _ = s.Bulk(context.Background(), ops, true)
+	if results[0].Err != ErrBulkAborted || results[1].Err == nil || results[1].Err == ErrBulkAborted {
+		t.Errorf("Expected the bad create to abort the rest. Got %+v", results)
+	}
+	if n2, _ := CountMany(context.Background(), db, Query{}); n2 != n {
+		t.Errorf("Expected %v products. Got %v", n, n2)
+	}
+
+	p.ClearTable(db)
+}
+
+func TestExport(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	s := NewPostgresStore(db, 0)
+	p := Product{}
+	p.ClearTable(db)
+	p.AddTestData(db, exportBatch+2)
+
+	// the export crosses a batch boundary and ignores paging
+	var ids []int
+	err := s.Export(context.Background(), Query{Count: 10, Sort: []SortKey{{Column: "id", Desc: true}}}, func(p Product) error {
+		ids = append(ids, p.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(ids) != exportBatch+2 || ids[0] != exportBatch+2 || ids[len(ids)-1] != 1 {
+		t.Errorf("Expected %d products in descending order. Got %d", exportBatch+2, len(ids))
+	}
+
+	// an error from fn stops the export
+	n := 0
+	err = s.Export(context.Background(), Query{}, func(p Product) error {
+		if n++; n == 3 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if errors.Cause(err) != ErrNotFound || n != 3 {
+		t.Errorf("Expected the export to stop after 3 products. Got %d, %v", n, err)
+	}
+
+	p.ClearTable(db)
+}
+
+func TestSearch(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	s := NewPostgresStore(db, 0)
+	p := Product{}
+	p.ClearTable(db)
+	for _, name := range []string{"Red wool jumper", "Blue wool socks", "Red socks"} {
+		s.Create(ctx, &Product{Name: name, Price: 1, Currency: "USD"})
+	}
+
+	search := func(text string) []SearchResult {
+		q, err := ParseSearch(text)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		q.Count = 10
+		results, err := s.Search(ctx, q)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return results
+	}
+
+	// stemming matches sock with socks
+	results := search("red sock")
+	if len(results) != 1 || results[0].Name != "Red socks" || results[0].Snippet != "<mark>Red</mark> <mark>socks</mark>" {
+		t.Errorf("Expected Red socks. Got %+v", results)
+	}
+	if results = search(`"wool socks"`); len(results) != 1 || results[0].Name != "Blue wool socks" {
+		t.Errorf("Expected Blue wool socks. Got %+v", results)
+	}
+	if results = search("jump*"); len(results) != 1 || results[0].Name != "Red wool jumper" {
+		t.Errorf("Expected Red wool jumper. Got %+v", results)
+	}
+
+	// only the highlights are markup
+	s.Create(ctx, &Product{Name: "<b>Bold</b> scarf", Price: 1, Currency: "USD"})
+	if results = search("scarf"); len(results) != 1 || results[0].Snippet != "&lt;b&gt;Bold&lt;/b&gt; <mark>scarf</mark>" {
+		t.Errorf("Expected the name to be escaped. Got %+v", results)
+	}
+
+	// a match is never highlighted inside an entity
+	s.Create(ctx, &Product{Name: "Rock 'n' roll 39", Price: 1, Currency: "USD"})
+	if results = search("39"); len(results) != 1 || results[0].Snippet != "Rock &#39;n&#39; roll <mark>39</mark>" {
+		t.Errorf("Expected only the number to be highlighted. Got %+v", results)
+	}
+
+	// typos are only tolerated when pg_trgm is installed
+	if trigrams, _ := s.hasTrigrams(ctx); trigrams {
+		if results = search("jumpr"); len(results) != 1 {
+			t.Errorf("Expected Red wool jumper despite the typo. Got %+v", results)
+		}
+	}
+
+	p.ClearTable(db)
+}
+
+func TestImport(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
 
-	// Initialize app
-	a, err := api.Initialize()
+	s := NewPostgresStore(db, 0)
+	p := Product{}
+	p.ClearTable(db)
+	p.AddTestData(db, 2)
+	twin := Product{Name: "twin", Price: 300, Currency: "USD"}
+	twin.Post(context.Background(), db)
+	twin.Post(context.Background(), db)
+
+	one := Product{ID: 1}
+	one.Get(context.Background(), db)
+	two := Product{ID: 2}
+	two.Get(context.Background(), db)
+
+	results, err := s.Import(context.Background(), []Product{
+		{Name: one.Name, Price: one.Price + 1, Currency: one.Currency},
+		{Name: two.Name, Price: two.Price, Currency: two.Currency},
+		{Name: "three", Price: 300, Currency: "EUR"},
+		{Name: "twin", Price: 300, Currency: "USD"},
+		{Name: one.Name, Price: 175, Currency: "USD"},
+	})
 	if err != nil {
-		t.Errorf("Expected clean initialization. Got %s", err.Error())
+		t.Fatalf("Error: %v", err)
+	}
+
+	var statuses []string
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	expected := []string{ImportUpdated, ImportUnchanged, ImportCreated, ImportRejected, ImportRejected}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected %v. Got %v", expected, statuses)
+	}
+	if results[0].Product.ID != 1 || results[0].Product.Version != 2 || results[2].Product.ID == 0 {
+		t.Errorf("Expected the ids and versions of the imported products. Got %+v", results)
 	}
-	defer a.DB.Close()
 
-	new := Product{Name: "hello kitty", Price: 14.99}
+	// the staging table is gone with the transaction, so we can import again
+	results, err = s.Import(context.Background(), []Product{{Name: "three", Price: 300, Currency: "EUR"}})
+	if err != nil || results[0].Status != ImportUnchanged {
+		t.Errorf("Expected three to be unchanged. Got %+v (%v)", results, err)
+	}
+
+	// products with a sku are matched by it, even if their name changes
+	sixth := Product{SKU: "SKU-1", Name: "sixth", Price: 100, Currency: "USD"}
+	sixth.Post(context.Background(), db)
+	results, err = s.Import(context.Background(), []Product{
+		{SKU: "SKU-1", Name: "twin", Price: 100, Currency: "USD"},
+		{SKU: "SKU-2", Name: "twin", Price: 200, Currency: "USD"},
+		{Name: "sixth", Price: 100, Currency: "USD"},
+		{SKU: "SKU-2", Name: "seventh", Price: 200, Currency: "USD"},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	statuses = nil
+	for _, r := range results {
+		statuses = append(statuses, r.Status+" "+r.Reason)
+	}
+	expected = []string{ImportUpdated + " ", ImportCreated + " ", ImportRejected + " " + ImportConflict, ImportRejected + " " + ImportDuplicateSKU}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected %v. Got %v", expected, statuses)
+	}
+	if results[0].Product.ID != sixth.ID || results[0].Product.Version != 2 {
+		t.Errorf("Expected the product with the sku to be updated. Got %+v", results[0])
+	}
+	created := Product{SKU: "SKU-2"}
+	if err = created.GetBySKU(context.Background(), db); err != nil || created.ID != results[1].Product.ID {
+		t.Errorf("Expected a product to be created with its sku. Got %+v (%v)", created, err)
+	}
+
+	p.ClearTable(db)
+}
 
-	new.EnsureTableExists(a.DB)
-	new.ClearTable(a.DB)
+func TestUpsert(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	p := Product{}
+	p.ClearTable(db)
+	ctx := context.Background()
+
+	p = Product{SKU: "abc", Name: "one", Price: 100, Currency: "USD"}
+	created, err := p.Upsert(ctx, db)
+	if err != nil || !created || p.Version != 1 {
+		t.Errorf("Expected the product to be created. Got %+v (%v)", p, err)
+	}
+	id := p.ID
+
+	p = Product{SKU: "abc", Name: "uno", Price: 200, Currency: "EUR"}
+	created, err = p.Upsert(ctx, db)
+	if err != nil || created || p.ID != id || p.Version != 2 {
+		t.Errorf("Expected the product to be replaced. Got %+v (%v)", p, err)
+	}
+
+	got := Product{SKU: "abc"}
+	if err = got.GetBySKU(ctx, db); err != nil || got.ID != id || got.Name != "uno" || got.Price != 200 {
+		t.Errorf("Expected to get the product by sku. Got %+v (%v)", got, err)
+	}
+
+	p = Product{SKU: "abc", Name: "eins", Currency: "USD", Version: 1}
+	if _, err = p.Upsert(ctx, db); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch. Got %v", err)
+	}
+
+	other := Product{SKU: "abc", Name: "two", Currency: "USD"}
+	if err = other.Post(ctx, db); err != ErrDuplicateSKU {
+		t.Errorf("Expected ErrDuplicateSKU. Got %v", err)
+	}
+
+	// a product in the trash doesn't hold on to its sku
+	got.Delete(ctx, db)
+	if err = other.Post(ctx, db); err != nil {
+		t.Errorf("Expected the sku to be free. Got %v", err)
+	}
+
+	p.ClearTable(db)
+}
+
+func TestNotFound(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	p := Product{ID: 1, Name: "ghost", Price: 100, Currency: "USD"}
+	p.ClearTable(db)
+
+	// update and delete a product that does not exist
+	if err := p.Put(context.Background(), db); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	if err := p.Delete(context.Background(), db); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+}
+
+func TestPatch(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	s := NewPostgresStore(db, 0)
+	p := Product{}
+	p.ClearTable(db)
+	p.AddTestData(db, 1)
+
+	// patch the price, the rest of the row is left alone
+	p, err := s.Patch(context.Background(), 1, func(p *Product) error {
+		p.Price = 250
+		return nil
+	})
+	if err != nil || p.Price != 250 || p.Name != "Product 1" {
+		t.Errorf("Expected the price to be patched. Got %+v (%v)", p, err)
+	}
+
+	if _, err := s.Patch(context.Background(), 2, func(p *Product) error { return nil }); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+
+	p.ClearTable(db)
+}
+
+func TestPost(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	new := Product{Name: "hello kitty", Price: 1499, Currency: "USD"}
+
+	new.ClearTable(db)
 
 	// Post a new product
-	err1 := new.Post(a.DB)
+	err1 := new.Post(context.Background(), db)
 	if err1 != nil {
 		t.Errorf("Error: %v", err1)
 	}
 
 	// get product
 	p := Product{ID: 1}
-	err2 := p.Get(a.DB)
+	err2 := p.Get(context.Background(), db)
 	if err2 != nil {
 		t.Errorf("Error: %v", err2)
 	}
@@ -175,26 +631,22 @@ func TestPost(t *testing.T) {
 		t.Errorf("Expected the price to remain the same (%v). Got %v", new.Price, p.Price)
 	}
 
-	p.ClearTable(a.DB)
+	p.ClearTable(db)
 }
 
 func TestGetMany(t *testing.T) {
 
-	// Initialize app
-	a, err := api.Initialize()
-	if err != nil {
-		t.Errorf("Expected clean initialization. Got %s", err.Error())
-	}
-	defer a.DB.Close()
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
 
 	p := Product{}
 
-	p.EnsureTableExists(a.DB)
-	p.ClearTable(a.DB)
-	p.AddTestData(a.DB, 40)
+	p.ClearTable(db)
+	p.AddTestData(db, 40)
 
 	// get 8 products
-	products, err1 := GetMany(a.DB, 0, 8)
+	products, err1 := GetMany(context.Background(), db, Query{Count: 8})
 	if err1 != nil {
 		t.Errorf("Error: %v", err1)
 	}
@@ -203,10 +655,10 @@ func TestGetMany(t *testing.T) {
 		t.Errorf("Length is wrong")
 	}
 
-	p.ClearTable(a.DB)
+	p.ClearTable(db)
 
-	a.DB.Close()
-	_, err2 := GetMany(a.DB, 0, 8)
+	db.Close()
+	_, err2 := GetMany(context.Background(), db, Query{Count: 8})
 	if err2.Error() != "sql: database is closed" {
 		t.Errorf("Expected the 'error' response to be 'sql: database is closed'. Got '%s'", err2.Error())
 	}
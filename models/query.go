@@ -0,0 +1,347 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Query describes which products a listing returns and in what order. The
+// zero value lists everything ordered by id.
+type Query struct {
+	Start int
+	Count int
+
+	// NameContains and NamePrefix match names case-insensitively.
+	NameContains string
+	NamePrefix   string
+
+	// MinPrice and MaxPrice are inclusive bounds, nil means unbounded.
+	MinPrice *Money
+	MaxPrice *Money
+
+	// UpdatedSince, if set, selects the products created or changed at
+	// or after that time, including deletes when deleted products are
+	// listed.
+	UpdatedSince *time.Time
+
+	// Sort lists the sort keys in order of precedence. id is always
+	// added as a final tiebreaker so paging is deterministic.
+	Sort []SortKey
+
+	// Deleted selects whether products in the trash are listed.
+	Deleted Deleted
+
+	// Cursor, if set, selects the products after (or before) a position
+	// in the listing instead of skipping Start products. Its sort must
+	// match Sort.
+	Cursor *Cursor
+}
+
+// Deleted selects how a listing treats products in the trash.
+type Deleted int
+
+// The ways a listing can treat deleted products. The zero value leaves
+// them out.
+const (
+	ExcludeDeleted Deleted = iota
+	IncludeDeleted
+	OnlyDeleted
+)
+
+// SortKey is one column of an ORDER BY.
+type SortKey struct {
+	Column string
+	Desc   bool
+}
+
+// sortColumns whitelists the columns a listing can be sorted by. Only
+// these names ever make it into SQL.
+var sortColumns = map[string]bool{
+	"id":         true,
+	"name":       true,
+	"price":      true,
+	"currency":   true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// ParseSort parses a comma separated list of sort keys such as
+// "price:desc,name". Each key is a column name optionally followed by
+// :asc or :desc.
+func ParseSort(s string) ([]SortKey, error) {
+	var keys []SortKey
+	if strings.TrimSpace(s) == "" {
+		return keys, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		column, dir := strings.TrimSpace(part), "asc"
+		if i := strings.IndexByte(column, ':'); i >= 0 {
+			column, dir = column[:i], strings.ToLower(column[i+1:])
+		}
+
+		if !sortColumns[column] {
+			return nil, errors.Errorf("invalid sort column %q", column)
+		}
+		if dir != "asc" && dir != "desc" {
+			return nil, errors.Errorf("invalid sort direction %q", dir)
+		}
+		if seen[column] {
+			return nil, errors.Errorf("duplicate sort column %q", column)
+		}
+		seen[column] = true
+
+		keys = append(keys, SortKey{Column: column, Desc: dir == "desc"})
+	}
+
+	return keys, nil
+}
+
+// sortKeys returns the query's sort keys with the id tiebreaker added.
+func (q Query) sortKeys() []SortKey {
+	keys := append([]SortKey{}, q.Sort...)
+	for _, k := range keys {
+		if k.Column == "id" {
+			return keys
+		}
+	}
+
+	return append(keys, SortKey{Column: "id"})
+}
+
+// where compiles the query's filters into a WHERE clause (or "") using
+// numbered placeholders starting after the ones already in args.
+func (q Query) where(args []interface{}) (string, []interface{}) {
+	var conds []string
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+
+	switch q.Deleted {
+	case ExcludeDeleted:
+		conds = append(conds, "deleted_at IS NULL")
+	case OnlyDeleted:
+		conds = append(conds, "deleted_at IS NOT NULL")
+	}
+	if q.NameContains != "" {
+		add("name ILIKE ?", "%"+escapeLike(q.NameContains)+"%")
+	}
+	if q.NamePrefix != "" {
+		add("name ILIKE ?", escapeLike(q.NamePrefix)+"%")
+	}
+	if q.MinPrice != nil {
+		add("price >= ?", *q.MinPrice)
+	}
+	if q.MaxPrice != nil {
+		add("price <= ?", *q.MaxPrice)
+	}
+	if q.UpdatedSince != nil {
+		add("updated_at >= ?", *q.UpdatedSince)
+	}
+	if q.Cursor != nil {
+		var cond string
+		cond, args = q.Cursor.keyset(q.sortKeys(), args)
+		conds = append(conds, cond)
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// orderBy compiles the sort keys into an ORDER BY clause.
+func (q Query) orderBy() string {
+	var cols []string
+	for _, k := range q.sortKeys() {
+		if !sortColumns[k.Column] {
+			// ParseSort won't let this happen, but a Query can be built
+			// by hand and we never want to put unchecked text in SQL.
+			continue
+		}
+
+		col := k.Column
+		if k.Desc != q.backwards() {
+			col += " DESC"
+		}
+		cols = append(cols, col)
+	}
+
+	return " ORDER BY " + strings.Join(cols, ", ")
+}
+
+// limit adds the query's LIMIT and OFFSET to sql. A Count of zero means
+// no limit.
+func (q Query) limit(sql string, args []interface{}) (string, []interface{}) {
+	if q.Count > 0 {
+		args = append(args, q.Count)
+		sql += " LIMIT $" + strconv.Itoa(len(args))
+	}
+	if q.Start > 0 {
+		args = append(args, q.Start)
+		sql += " OFFSET $" + strconv.Itoa(len(args))
+	}
+
+	return sql, args
+}
+
+// Page returns the window of products selected by Start and Count, the
+// in-memory equivalent of LIMIT and OFFSET.
+func (q Query) Page(products []Product) []Product {
+	start := q.Start
+	if start < 0 {
+		start = 0
+	}
+	if start > len(products) {
+		start = len(products)
+	}
+
+	end := len(products)
+	if q.Count > 0 && start+q.Count < end {
+		end = start + q.Count
+	}
+
+	return products[start:end]
+}
+
+// backwards reports whether the query pages backwards from a cursor. The
+// rows are then fetched in reverse order and flipped by restoreOrder.
+func (q Query) backwards() bool {
+	return q.Cursor != nil && q.Cursor.Before
+}
+
+// restoreOrder puts products fetched by a backwards query back into the
+// query's order.
+func (q Query) restoreOrder(products []Product) {
+	if !q.backwards() {
+		return
+	}
+
+	for i, j := 0, len(products)-1; i < j; i, j = i+1, j-1 {
+		products[i], products[j] = products[j], products[i]
+	}
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Match reports whether p passes the query's filters. It is the in-memory
+// equivalent of the WHERE clause.
+func (q Query) Match(p Product) bool {
+	if (q.Deleted == ExcludeDeleted && p.DeletedAt != nil) || (q.Deleted == OnlyDeleted && p.DeletedAt == nil) {
+		return false
+	}
+
+	name := strings.ToLower(p.Name)
+	if q.NameContains != "" && !strings.Contains(name, strings.ToLower(q.NameContains)) {
+		return false
+	}
+	if q.NamePrefix != "" && !strings.HasPrefix(name, strings.ToLower(q.NamePrefix)) {
+		return false
+	}
+	if q.MinPrice != nil && p.Price < *q.MinPrice {
+		return false
+	}
+	if q.MaxPrice != nil && p.Price > *q.MaxPrice {
+		return false
+	}
+	if q.UpdatedSince != nil && p.UpdatedAt.Before(*q.UpdatedSince) {
+		return false
+	}
+	if q.Cursor != nil && !q.Cursor.after(p, q.sortKeys()) {
+		return false
+	}
+
+	return true
+}
+
+// SortProducts sorts products in place the way the query's ORDER BY
+// would. Like the SQL, a backwards query sorts in reverse until
+// restoreOrder is called.
+func (q Query) SortProducts(products []Product) {
+	keys := q.sortKeys()
+	sort.SliceStable(products, func(i, j int) bool {
+		for _, k := range keys {
+			c := compare(products[i], products[j], k.Column)
+			if c == 0 {
+				continue
+			}
+			if k.Desc != q.backwards() {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// compare compares one column of two products.
+func compare(a, b Product, column string) int {
+	switch column {
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	case "price":
+		return compareInt(int64(a.Price), int64(b.Price))
+	case "currency":
+		return strings.Compare(a.Currency, b.Currency)
+	case "created_at":
+		return compareTime(a.CreatedAt, b.CreatedAt)
+	case "updated_at":
+		return compareTime(a.UpdatedAt, b.UpdatedAt)
+	}
+
+	return compareInt(int64(a.ID), int64(b.ID))
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+
+	return 0
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+
+	keys, err := ParseSort("price:desc, name,id:ASC")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := []SortKey{{"price", true}, {"name", false}, {"id", false}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v. Got %v", expected, keys)
+	}
+
+	for _, bad := range []string{"colour", "price:up", "name,name", "price;DROP TABLE products"} {
+		if _, err := ParseSort(bad); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestQuerySQL(t *testing.T) {
+
+	min, max := Money(100), Money(1000)
+	q := Query{
+		Start:        20,
+		Count:        10,
+		NameContains: "50%_off",
+		MinPrice:     &min,
+		MaxPrice:     &max,
+		Sort:         []SortKey{{Column: "price", Desc: true}},
+	}
+
+	where, args := q.where(nil)
+	sql, args := q.limit("SELECT"+where+q.orderBy(), args)
+
+	expected := `SELECT WHERE deleted_at IS NULL AND name ILIKE $1 AND price >= $2 AND price <= $3 ORDER BY price DESC, id LIMIT $4 OFFSET $5`
+	if sql != expected {
+		t.Errorf("Expected %s. Got %s", expected, sql)
+	}
+
+	expectedArgs := []interface{}{`%50\%\_off%`, min, max, 10, 20}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Expected %v. Got %v", expectedArgs, args)
+	}
+
+	// deleted products can be included, or listed on their own
+	for deleted, expected := range map[Deleted]string{IncludeDeleted: "", OnlyDeleted: " WHERE deleted_at IS NOT NULL"} {
+		if where, _ := (Query{Deleted: deleted}).where(nil); where != expected {
+			t.Errorf("Expected '%s'. Got '%s'", expected, where)
+		}
+	}
+
+	// columns that aren't whitelisted never reach the SQL
+	q = Query{Sort: []SortKey{{Column: "1; DROP TABLE products"}}}
+	if sql := q.orderBy(); sql != " ORDER BY id" {
+		t.Errorf("Expected ' ORDER BY id'. Got '%s'", sql)
+	}
+}
+
+func TestMemoryStoreQuery(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+	for _, p := range []Product{
+		{Name: "Red Apple", Price: 150, Currency: "USD"},
+		{Name: "Green Apple", Price: 120, Currency: "USD"},
+		{Name: "Banana", Price: 50, Currency: "USD"},
+		{Name: "Apple Pie", Price: 500, Currency: "EUR"},
+		{Name: "Cherry", Price: 150, Currency: "USD"},
+	} {
+		p := p
+		s.Create(ctx, &p)
+	}
+
+	names := func(q Query) []string {
+		products, err := s.List(ctx, q)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		var names []string
+		for _, p := range products {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+
+	min, max := Money(100), Money(200)
+	tests := []struct {
+		q    Query
+		want []string
+	}{
+		{Query{NameContains: "apple"}, []string{"Red Apple", "Green Apple", "Apple Pie"}},
+		{Query{NamePrefix: "APPLE"}, []string{"Apple Pie"}},
+		{Query{MinPrice: &min, MaxPrice: &max}, []string{"Red Apple", "Green Apple", "Cherry"}},
+		{Query{Sort: []SortKey{{Column: "price", Desc: true}}}, []string{"Apple Pie", "Red Apple", "Cherry", "Green Apple", "Banana"}},
+		{Query{Sort: []SortKey{{Column: "price"}, {Column: "name", Desc: true}}}, []string{"Banana", "Green Apple", "Red Apple", "Cherry", "Apple Pie"}},
+		{Query{Sort: []SortKey{{Column: "name"}}, Start: 1, Count: 2}, []string{"Banana", "Cherry"}},
+	}
+
+	for _, test := range tests {
+		if got := names(test.q); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: expected %v. Got %v", test.q, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrRoleNotFound is returned by a RoleStore when the requested role
+	// does not exist.
+	ErrRoleNotFound = errors.New("role not found")
+
+	// ErrBindingNotFound is returned by a RoleStore when a subject that
+	// doesn't have a role is unbound from it.
+	ErrBindingNotFound = errors.New("subject does not have the role")
+)
+
+var (
+	roleName   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,63}$`)
+	permission = regexp.MustCompile(`^(\*|[a-z][a-z0-9_-]{0,63}:(\*|[a-z][a-z0-9_-]{0,63}))$`)
+)
+
+// ValidRoleName reports whether name can be the name of a role: lower
+// case letters, digits, dashes and underscores.
+func ValidRoleName(name string) bool {
+	return roleName.MatchString(name)
+}
+
+// ValidPermission reports whether p is a permission, like products:read,
+// a wildcard for a resource, like products:*, or * for everything.
+func ValidPermission(p string) bool {
+	return permission.MatchString(p)
+}
+
+// Allows reports whether the permissions granted allow want.
+func Allows(granted []string, want string) bool {
+	resource := strings.SplitN(want, ":", 2)[0]
+	for _, p := range granted {
+		if p == "*" || p == want || p == resource+":*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Everyone is the subject that stands for every authenticated client,
+// binding it to a role gives everyone the role.
+const Everyone = "*"
+
+// Role is a named set of permissions that subjects can be bound to.
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// defaultRoles are the roles the roles migration creates.
+var defaultRoles = []Role{
+	{Name: "reader", Description: "Can read products", Permissions: []string{"products:read"}},
+	{Name: "editor", Description: "Can read and change products", Permissions: []string{"products:read", "products:write"}},
+	{Name: "owner", Description: "Has every permission, except for the admin API", Permissions: []string{"*"}},
+}
+
+// defaultBindings are the roles a new store binds subjects to: everyone
+// can read products. The roles migration also makes the API keys that
+// existed before there were roles editors.
+var defaultBindings = map[string][]string{
+	Everyone: {"reader"},
+}
+
+// RoleStore keeps the roles and which subjects are bound to them. A
+// subject is whoever made a request, see auth.Principal.
+type RoleStore interface {
+	// Roles returns every role by name.
+	Roles(ctx context.Context) ([]Role, error)
+
+	// PutRole creates r, or replaces the role with its name, and reports
+	// whether it was created.
+	PutRole(ctx context.Context, r Role) (bool, error)
+
+	// DeleteRole deletes the role with the given name, and unbinds
+	// everyone from it, or returns ErrRoleNotFound.
+	DeleteRole(ctx context.Context, name string) error
+
+	// Bind gives subject the role, or returns ErrRoleNotFound. Binding
+	// a subject twice is harmless.
+	Bind(ctx context.Context, subject, role string) error
+
+	// Unbind takes the role away from subject, or returns
+	// ErrBindingNotFound.
+	Unbind(ctx context.Context, subject, role string) error
+
+	// SubjectRoles returns the names of the roles subject is bound to.
+	SubjectRoles(ctx context.Context, subject string) ([]string, error)
+
+	// Permissions returns the permissions of every role subject is bound
+	// to, and of the roles bound to the subject *, which is everyone.
+	Permissions(ctx context.Context, subject string) ([]string, error)
+}
+
+// PostgresRoleStore is a RoleStore backed by the roles, role_permissions
+// and role_bindings tables.
+type PostgresRoleStore struct {
+	DB *sql.DB
+
+	// Timeout bounds every query. Zero means queries are only bounded by
+	// the caller's context.
+	Timeout time.Duration
+}
+
+// NewPostgresRoleStore returns a PostgresRoleStore using db, with each
+// query limited to timeout.
+func NewPostgresRoleStore(db *sql.DB, timeout time.Duration) *PostgresRoleStore {
+	return &PostgresRoleStore{DB: db, Timeout: timeout}
+}
+
+// Roles fetches every role with its permissions
+func (s *PostgresRoleStore) Roles(ctx context.Context) ([]Role, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	roles, err := s.roles(ctx)
+
+	return roles, contextError(ctx, err)
+}
+
+func (s *PostgresRoleStore) roles(ctx context.Context) ([]Role, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT name, description, "+
+		"ARRAY(SELECT permission FROM role_permissions WHERE role = name ORDER BY permission) "+
+		"FROM roles ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var r Role
+		if err := rows.Scan(&r.Name, &r.Description, pq.Array(&r.Permissions)); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+
+	return roles, rows.Err()
+}
+
+// PutRole creates or replaces a role, in a transaction
+func (s *PostgresRoleStore) PutRole(ctx context.Context, r Role) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	created, err := s.putRole(ctx, r)
+
+	return created, contextError(ctx, err)
+}
+
+func (s *PostgresRoleStore) putRole(ctx context.Context, r Role) (created bool, err error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// xmax is zero for a row the statement inserted
+	err = tx.QueryRowContext(ctx, "INSERT INTO roles (name, description) VALUES ($1, $2) "+
+		"ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description RETURNING xmax = 0",
+		r.Name, r.Description).Scan(&created)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM role_permissions WHERE role = $1", r.Name)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO role_permissions (role, permission) "+
+		"SELECT DISTINCT $1::text, unnest($2::text[])", r.Name, pq.Array(r.Permissions))
+	if err != nil {
+		return false, err
+	}
+
+	return created, tx.Commit()
+}
+
+// DeleteRole deletes a role, its permissions and bindings go with it
+func (s *PostgresRoleStore) DeleteRole(ctx context.Context, name string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	err := affected(s.DB.ExecContext(ctx, "DELETE FROM roles WHERE name = $1", name))
+	if err == sql.ErrNoRows {
+		err = ErrRoleNotFound
+	}
+
+	return contextError(ctx, err)
+}
+
+// Bind gives a subject a role
+func (s *PostgresRoleStore) Bind(ctx context.Context, subject, role string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, "INSERT INTO role_bindings (subject, role) VALUES ($1, $2) "+
+		"ON CONFLICT DO NOTHING", subject, role)
+	if err, ok := err.(*pq.Error); ok && err.Code == "23503" {
+		// foreign_key_violation
+		return ErrRoleNotFound
+	}
+
+	return contextError(ctx, err)
+}
+
+// Unbind takes a role away from a subject
+func (s *PostgresRoleStore) Unbind(ctx context.Context, subject, role string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	err := affected(s.DB.ExecContext(ctx, "DELETE FROM role_bindings WHERE subject = $1 AND role = $2", subject, role))
+	if err == sql.ErrNoRows {
+		err = ErrBindingNotFound
+	}
+
+	return contextError(ctx, err)
+}
+
+// SubjectRoles fetches the names of a subject's roles
+func (s *PostgresRoleStore) SubjectRoles(ctx context.Context, subject string) ([]string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	roles := []string{}
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT ARRAY(SELECT role FROM role_bindings WHERE subject = $1 ORDER BY role)",
+		subject).Scan(pq.Array(&roles))
+
+	return roles, contextError(ctx, err)
+}
+
+// Permissions fetches the permissions of a subject's roles
+func (s *PostgresRoleStore) Permissions(ctx context.Context, subject string) ([]string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	permissions := []string{}
+	err := s.DB.QueryRowContext(ctx, "SELECT ARRAY(SELECT DISTINCT permission "+
+		"FROM role_bindings JOIN role_permissions USING (role) WHERE subject IN ($1, $2) ORDER BY permission)",
+		subject, Everyone).Scan(pq.Array(&permissions))
+
+	return permissions, contextError(ctx, err)
+}
+
+// withTimeout derives the context for a single query.
+func (s *PostgresRoleStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return queryContext(ctx, s.Timeout)
+}
+
+// affected turns the result of a statement that changed no rows into
+// sql.ErrNoRows.
+func affected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// MemoryRoleStore is a thread-safe RoleStore that keeps roles in memory,
+// for use with a MemoryStore. It starts with the same roles and bindings
+// as the migration creates.
+type MemoryRoleStore struct {
+	mu       sync.RWMutex
+	roles    map[string]Role
+	bindings map[string]map[string]bool
+}
+
+// NewMemoryRoleStore returns a MemoryRoleStore with the default roles
+// and bindings.
+func NewMemoryRoleStore() *MemoryRoleStore {
+	s := &MemoryRoleStore{roles: make(map[string]Role), bindings: make(map[string]map[string]bool)}
+	for _, r := range defaultRoles {
+		s.roles[r.Name] = r
+	}
+	for subject, roles := range defaultBindings {
+		s.bindings[subject] = make(map[string]bool)
+		for _, role := range roles {
+			s.bindings[subject][role] = true
+		}
+	}
+
+	return s
+}
+
+// Roles fetches every role with its permissions
+func (s *MemoryRoleStore) Roles(ctx context.Context) ([]Role, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roles := []Role{}
+	for _, r := range s.roles {
+		roles = append(roles, r)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+
+	return roles, nil
+}
+
+// PutRole creates or replaces a role
+func (s *MemoryRoleStore) PutRole(ctx context.Context, r Role) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	permissions := []string{}
+	for _, p := range r.Permissions {
+		if !seen[p] {
+			seen[p] = true
+			permissions = append(permissions, p)
+		}
+	}
+	sort.Strings(permissions)
+	r.Permissions = permissions
+
+	_, exists := s.roles[r.Name]
+	s.roles[r.Name] = r
+
+	return !exists, nil
+}
+
+// DeleteRole deletes a role and unbinds everyone from it
+func (s *MemoryRoleStore) DeleteRole(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[name]; !ok {
+		return ErrRoleNotFound
+	}
+	delete(s.roles, name)
+	for _, roles := range s.bindings {
+		delete(roles, name)
+	}
+
+	return nil
+}
+
+// Bind gives a subject a role
+func (s *MemoryRoleStore) Bind(ctx context.Context, subject, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[role]; !ok {
+		return ErrRoleNotFound
+	}
+	if s.bindings[subject] == nil {
+		s.bindings[subject] = make(map[string]bool)
+	}
+	s.bindings[subject][role] = true
+
+	return nil
+}
+
+// Unbind takes a role away from a subject
+func (s *MemoryRoleStore) Unbind(ctx context.Context, subject, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.bindings[subject][role] {
+		return ErrBindingNotFound
+	}
+	delete(s.bindings[subject], role)
+
+	return nil
+}
+
+// SubjectRoles fetches the names of a subject's roles
+func (s *MemoryRoleStore) SubjectRoles(ctx context.Context, subject string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roles := []string{}
+	for role := range s.bindings[subject] {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	return roles, nil
+}
+
+// Permissions fetches the permissions of a subject's roles
+func (s *MemoryRoleStore) Permissions(ctx context.Context, subject string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[string]bool{}
+	permissions := []string{}
+	for _, roles := range []map[string]bool{s.bindings[subject], s.bindings[Everyone]} {
+		for role := range roles {
+			for _, p := range s.roles[role].Permissions {
+				if !seen[p] {
+					seen[p] = true
+					permissions = append(permissions, p)
+				}
+			}
+		}
+	}
+	sort.Strings(permissions)
+
+	return permissions, nil
+}
+
+// RoleCache is a RoleStore that remembers each subject's permissions for
+// TTL, so that checking a request doesn't cost a query. Changes made
+// through the cache clear it, but other replicas only notice once their
+// cached permissions expire.
+type RoleCache struct {
+	RoleStore
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedPermissions
+}
+
+// cachedPermissions are a subject's permissions as fetched at fetched.
+type cachedPermissions struct {
+	permissions []string
+	fetched     time.Time
+}
+
+// NewRoleCache returns a RoleCache in front of store.
+func NewRoleCache(store RoleStore, ttl time.Duration) *RoleCache {
+	return &RoleCache{RoleStore: store, TTL: ttl, entries: make(map[string]cachedPermissions)}
+}
+
+// Permissions returns the permissions of a subject's roles, from the
+// cache if they were fetched less than TTL ago
+func (c *RoleCache) Permissions(ctx context.Context, subject string) ([]string, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[subject]
+	c.mu.Unlock()
+	if ok && now.Sub(e.fetched) < c.TTL {
+		return e.permissions, nil
+	}
+
+	permissions, err := c.RoleStore.Permissions(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxCachedKeys {
+		c.entries = make(map[string]cachedPermissions)
+	}
+	c.entries[subject] = cachedPermissions{permissions: permissions, fetched: now}
+	c.mu.Unlock()
+
+	return permissions, nil
+}
+
+// PutRole creates or replaces a role, and clears the cache
+func (c *RoleCache) PutRole(ctx context.Context, r Role) (bool, error) {
+	defer c.clear()
+	return c.RoleStore.PutRole(ctx, r)
+}
+
+// DeleteRole deletes a role, and clears the cache
+func (c *RoleCache) DeleteRole(ctx context.Context, name string) error {
+	defer c.clear()
+	return c.RoleStore.DeleteRole(ctx, name)
+}
+
+// Bind gives a subject a role, and clears the cache
+func (c *RoleCache) Bind(ctx context.Context, subject, role string) error {
+	defer c.clear()
+	return c.RoleStore.Bind(ctx, subject, role)
+}
+
+// Unbind takes a role away from a subject, and clears the cache
+func (c *RoleCache) Unbind(ctx context.Context, subject, role string) error {
+	defer c.clear()
+	return c.RoleStore.Unbind(ctx, subject, role)
+}
+
+func (c *RoleCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]cachedPermissions)
+}
@@ -0,0 +1,146 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAllows(t *testing.T) {
+
+	for _, c := range []struct {
+		granted []string
+		want    string
+		allowed bool
+	}{
+		{[]string{"products:read"}, "products:read", true},
+		{[]string{"products:read"}, "products:write", false},
+		{[]string{"products:*"}, "products:write", true},
+		{[]string{"orders:*"}, "products:write", false},
+		{[]string{"*"}, "products:write", true},
+		{nil, "products:read", false},
+	} {
+		if Allows(c.granted, c.want) != c.allowed {
+			t.Errorf("%v %s: expected %v", c.granted, c.want, c.allowed)
+		}
+	}
+
+	for p, valid := range map[string]bool{"products:read": true, "products:*": true, "*": true, "products": false, "*:read": false, "Products:read": false} {
+		if ValidPermission(p) != valid {
+			t.Errorf("%s: expected valid to be %v", p, valid)
+		}
+	}
+}
+
+// testRoleStore runs the same checks against any RoleStore, which has
+// the default roles and bindings.
+func testRoleStore(t *testing.T, s RoleStore) {
+	ctx := context.Background()
+
+	roles, err := s.Roles(ctx)
+	if err != nil || !reflect.DeepEqual(roles, []Role{defaultRoles[1], defaultRoles[2], defaultRoles[0]}) {
+		t.Errorf("Expected the default roles. Got %+v (%v)", roles, err)
+	}
+
+	// everyone can read products, but not change them
+	if p, err := s.Permissions(ctx, "apikey:new"); err != nil || !reflect.DeepEqual(p, []string{"products:read"}) {
+		t.Errorf("Expected everyone to be a reader. Got %v (%v)", p, err)
+	}
+	if err = s.Unbind(ctx, Everyone, "reader"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	created, err := s.PutRole(ctx, Role{Name: "auditor", Permissions: []string{"products:read", "products:read"}})
+	if err != nil || !created {
+		t.Errorf("Expected the role to be created. Got %v", err)
+	}
+	created, err = s.PutRole(ctx, Role{Name: "auditor", Description: "Reads", Permissions: []string{"reports:read"}})
+	if err != nil || created {
+		t.Errorf("Expected the role to be replaced. Got %v", err)
+	}
+
+	if err = s.Bind(ctx, "apikey:ci", "auditor"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	s.Bind(ctx, "apikey:ci", "auditor")
+	s.Bind(ctx, "apikey:ci", "reader")
+	s.Bind(ctx, Everyone, "reader")
+	if err = s.Bind(ctx, "apikey:ci", "nope"); err != ErrRoleNotFound {
+		t.Errorf("Expected ErrRoleNotFound. Got %v", err)
+	}
+
+	if roles, err := s.SubjectRoles(ctx, "apikey:ci"); err != nil || !reflect.DeepEqual(roles, []string{"auditor", "reader"}) {
+		t.Errorf("Expected 2 roles. Got %v (%v)", roles, err)
+	}
+	if p, err := s.Permissions(ctx, "apikey:ci"); err != nil || !reflect.DeepEqual(p, []string{"products:read", "reports:read"}) {
+		t.Errorf("Expected 2 permissions. Got %v (%v)", p, err)
+	}
+
+	// everyone's roles apply to subjects with none of their own
+	if p, err := s.Permissions(ctx, "someone"); err != nil || !reflect.DeepEqual(p, []string{"products:read"}) {
+		t.Errorf("Expected everyone's permission. Got %v (%v)", p, err)
+	}
+	if err = s.Unbind(ctx, Everyone, "reader"); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if err = s.Unbind(ctx, Everyone, "reader"); err != ErrBindingNotFound {
+		t.Errorf("Expected ErrBindingNotFound. Got %v", err)
+	}
+	if p, _ := s.Permissions(ctx, "someone"); len(p) != 0 {
+		t.Errorf("Expected no permissions. Got %v", p)
+	}
+
+	// deleting a role takes it away
+	if err = s.DeleteRole(ctx, "auditor"); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if err = s.DeleteRole(ctx, "auditor"); err != ErrRoleNotFound {
+		t.Errorf("Expected ErrRoleNotFound. Got %v", err)
+	}
+	if roles, _ := s.SubjectRoles(ctx, "apikey:ci"); !reflect.DeepEqual(roles, []string{"reader"}) {
+		t.Errorf("Expected only reader. Got %v", roles)
+	}
+	s.Unbind(ctx, "apikey:ci", "reader")
+	s.Bind(ctx, Everyone, "reader")
+}
+
+func TestMemoryRoleStore(t *testing.T) {
+	testRoleStore(t, NewMemoryRoleStore())
+}
+
+func TestPostgresRoleStore(t *testing.T) {
+
+	// Connect to the database
+	db := openDB(t)
+	defer db.Close()
+
+	db.Exec("DELETE FROM role_bindings")
+	db.Exec("INSERT INTO role_bindings (subject, role) VALUES ('*', 'reader')")
+	db.Exec("DELETE FROM roles WHERE name = 'auditor'")
+	testRoleStore(t, NewPostgresRoleStore(db, 0))
+}
+
+func TestRoleCache(t *testing.T) {
+
+	ctx := context.Background()
+	store := NewMemoryRoleStore()
+	store.Unbind(ctx, Everyone, "reader")
+	c := NewRoleCache(store, time.Hour)
+	c.Bind(ctx, "apikey:ci", "reader")
+
+	if p, _ := c.Permissions(ctx, "apikey:ci"); !reflect.DeepEqual(p, []string{"products:read"}) {
+		t.Errorf("Expected products:read. Got %v", p)
+	}
+
+	// changes made behind the cache's back aren't seen, those made
+	// through it are
+	store.Bind(ctx, "apikey:ci", "editor")
+	if p, _ := c.Permissions(ctx, "apikey:ci"); len(p) != 1 {
+		t.Errorf("Expected the cached permissions. Got %v", p)
+	}
+	c.Unbind(ctx, "apikey:ci", "reader")
+	if p, _ := c.Permissions(ctx, "apikey:ci"); len(p) != 2 {
+		t.Errorf("Expected the editor's permissions. Got %v", p)
+	}
+}
@@ -0,0 +1,305 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// maxSearchTerms limits the number of terms in a search.
+const maxSearchTerms = 16
+
+// A search snippet marks the words that matched with these.
+const (
+	HighlightStart = "<mark>"
+	HighlightStop  = "</mark>"
+)
+
+// SearchTerm is a word, or a phrase of several words that must appear
+// together in that order, that a product must match. If Prefix is set the
+// term is a single word matching any word it starts.
+type SearchTerm struct {
+	Words  []string
+	Prefix bool
+}
+
+// SearchQuery is a full-text search for the products matching every one
+// of its terms, best matches first.
+type SearchQuery struct {
+	Terms []SearchTerm
+	Start int
+	Count int
+}
+
+// SearchResult is a product found by a search, with its rank and its name
+// with the matching words highlighted. The snippet is HTML, the name is
+// escaped so that only the highlights are markup.
+type SearchResult struct {
+	Product
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// ParseSearch parses the text of a search. Words are separated by spaces
+// and punctuation, "quoted words" are a phrase and a word ending in * is
+// a prefix. It returns an error if there are no words to search for or
+// too many.
+func ParseSearch(text string) (SearchQuery, error) {
+	var q SearchQuery
+	for i, part := range strings.Split(text, `"`) {
+		// odd parts are inside quotes
+		if i%2 == 1 {
+			if words := searchWords(part); len(words) > 0 {
+				q.Terms = append(q.Terms, SearchTerm{Words: words})
+			}
+			continue
+		}
+
+		// a word with punctuation in it, like t-shirt, is a phrase
+		for _, field := range strings.Fields(part) {
+			if words := searchWords(field); len(words) > 0 {
+				prefix := len(words) == 1 && strings.HasSuffix(field, "*")
+				q.Terms = append(q.Terms, SearchTerm{Words: words, Prefix: prefix})
+			}
+		}
+	}
+
+	switch {
+	case len(q.Terms) == 0:
+		return q, errors.New("search has no words")
+	case len(q.Terms) > maxSearchTerms:
+		return q, errors.Errorf("search has more than %d terms", maxSearchTerms)
+	}
+
+	return q, nil
+}
+
+// searchWords splits s into lower case words.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), notWordRune)
+}
+
+func notWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// words returns every word of the search.
+func (q SearchQuery) words() []string {
+	var words []string
+	for _, t := range q.Terms {
+		words = append(words, t.Words...)
+	}
+
+	return words
+}
+
+// tsquery returns the tsquery expression of the search, and appends its
+// parameters to args. The words only have letters and digits in them, so
+// they are safe to use as tsquery syntax.
+func (q SearchQuery) tsquery(args []interface{}) (string, []interface{}) {
+	parts := make([]string, len(q.Terms))
+	for i, t := range q.Terms {
+		args = append(args, strings.Join(t.Words, " "))
+		n := "$" + strconv.Itoa(len(args))
+		if t.Prefix {
+			parts[i] = "to_tsquery('english', " + n + "::text || ':*')"
+		} else {
+			parts[i] = "phraseto_tsquery('english', " + n + ")"
+		}
+	}
+
+	return strings.Join(parts, " && "), args
+}
+
+// ts_headline marks the matching words of a name with these control
+// characters, which are taken out of the name first. The name is only
+// escaped as HTML after that, so a match can't land inside an entity,
+// and then the marks are swapped for the highlights.
+const (
+	markStart = "\x02"
+	markStop  = "\x03"
+)
+
+var highlighter = strings.NewReplacer(markStart, HighlightStart, markStop, HighlightStop)
+
+// snippet escapes a name marked by ts_headline as HTML and highlights
+// the marked words.
+func snippet(marked string) string {
+	return highlighter.Replace(html.EscapeString(marked))
+}
+
+// Search finds the products matching q that aren't in the trash, ranked
+// by how well they match. With trigrams set, which needs the pg_trgm
+// extension, products whose name is similar to the words of the search
+// are found too, so that typos don't get in the way.
+func Search(ctx context.Context, db Querier, q SearchQuery, trigrams bool) ([]SearchResult, error) {
+	tsquery, args := q.tsquery(nil)
+
+	rank, match := "ts_rank_cd(search, query)", "search @@ query"
+	if trigrams {
+		args = append(args, strings.Join(q.words(), " "))
+		n := "$" + strconv.Itoa(len(args))
+		rank += " + word_similarity(" + n + ", name)"
+		match = "(" + match + " OR " + n + " <% name)"
+	}
+	args = append(args, markStart+markStop, "HighlightAll=true, StartSel="+markStart+", StopSel="+markStop)
+	marks, options := "$"+strconv.Itoa(len(args)-1), "$"+strconv.Itoa(len(args))
+	args = append(args, q.Count, q.Start)
+
+	// the snippets are only made for the page of results
+	rows, err := db.QueryContext(ctx, "SELECT "+listColumns+", rank, "+
+		"ts_headline('english', translate(name, "+marks+", ''), query, "+options+") "+
+		"FROM (SELECT products.*, query, "+rank+" AS rank "+
+		"FROM products, (SELECT "+tsquery+" AS query) q "+
+		"WHERE deleted_at IS NULL AND "+match+" "+
+		"ORDER BY rank DESC, id "+
+		"LIMIT $"+strconv.Itoa(len(args)-1)+" OFFSET $"+strconv.Itoa(len(args))+") found "+
+		"ORDER BY rank DESC, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		p := &r.Product
+		err := rows.Scan(&p.ID, &p.SKU, &p.Name, &p.Price, &p.Currency, &p.Version, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt,
+			&r.Rank, &r.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		r.Snippet = snippet(r.Snippet)
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
+
+// match is how a MemoryStore searches. It ranks a product by the share
+// of the search's terms its name matches, counting a word that is only a
+// typo away as half a match, and highlights the matching words. Unlike
+// Postgres it doesn't know about stemming or stop words. It returns false
+// if the product doesn't match.
+func (q SearchQuery) match(p Product) (SearchResult, bool) {
+	// the start and end of each word of the name
+	var spans [][2]int
+	start := -1
+	for i, r := range p.Name + " " {
+		switch {
+		case notWordRune(r) && start >= 0:
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		case !notWordRune(r) && start < 0:
+			start = i
+		}
+	}
+	words := make([]string, len(spans))
+	for i, s := range spans {
+		words[i] = strings.ToLower(p.Name[s[0]:s[1]])
+	}
+
+	marked := make([]bool, len(words))
+	score := 0.0
+	for _, t := range q.Terms {
+		found, typo := false, false
+		for i := 0; i+len(t.Words) <= len(words) && !found; i++ {
+			found = true
+			for j, w := range t.Words {
+				word := words[i+j]
+				switch {
+				case word == w, t.Prefix && strings.HasPrefix(word, w):
+				case len(t.Words) == 1 && len(w) >= 4 && editDistance(word, w) == 1:
+					typo = true
+				default:
+					found, typo = false, false
+				}
+				if !found {
+					break
+				}
+			}
+			if found {
+				for j := range t.Words {
+					marked[i+j] = true
+				}
+			}
+		}
+		if !found {
+			return SearchResult{}, false
+		}
+		if typo {
+			score += 0.5
+		} else {
+			score++
+		}
+	}
+
+	var snippet strings.Builder
+	last := 0
+	for i, s := range spans {
+		if marked[i] {
+			snippet.WriteString(html.EscapeString(p.Name[last:s[0]]) +
+				HighlightStart + html.EscapeString(p.Name[s[0]:s[1]]) + HighlightStop)
+			last = s[1]
+		}
+	}
+	snippet.WriteString(html.EscapeString(p.Name[last:]))
+
+	return SearchResult{Product: p, Rank: score / float64(len(q.Terms)), Snippet: snippet.String()}, true
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+
+	return prev[len(rb)]
+}
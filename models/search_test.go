@@ -0,0 +1,98 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseSearch(t *testing.T) {
+
+	q, err := ParseSearch(`Red t-shirt "Wool  Socks" jump* *`)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := []SearchTerm{
+		{Words: []string{"red"}},
+		{Words: []string{"t", "shirt"}},
+		{Words: []string{"wool", "socks"}},
+		{Words: []string{"jump"}, Prefix: true},
+	}
+	if !reflect.DeepEqual(q.Terms, expected) {
+		t.Errorf("Expected %v. Got %v", expected, q.Terms)
+	}
+
+	for _, bad := range []string{"", `""`, " - ", "a b c d e f g h i j k l m n o p q"} {
+		if _, err := ParseSearch(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestTSQuery(t *testing.T) {
+
+	q, _ := ParseSearch(`"wool socks" red*`)
+	sql, args := q.tsquery([]interface{}{1})
+
+	expected := "phraseto_tsquery('english', $2) && to_tsquery('english', $3::text || ':*')"
+	if sql != expected {
+		t.Errorf("Expected %s. Got %s", expected, sql)
+	}
+	if !reflect.DeepEqual(args, []interface{}{1, "wool socks", "red"}) {
+		t.Errorf("Expected the words as args. Got %v", args)
+	}
+}
+
+func TestMemoryStoreSearch(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+	for _, name := range []string{"Red wool jumper", "Blue wool socks", "Wooly hat, red", "Socks"} {
+		s.Create(ctx, &Product{Name: name})
+	}
+	s.Delete(ctx, 4, 0)
+
+	search := func(text string) []SearchResult {
+		q, err := ParseSearch(text)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		results, err := s.Search(ctx, q)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return results
+	}
+
+	results := search("red")
+	if len(results) != 2 || results[0].ID != 1 || results[1].Snippet != "Wooly hat, <mark>red</mark>" {
+		t.Errorf("Expected products 1 and 3. Got %+v", results)
+	}
+
+	// an exact match ranks above a typo
+	results = search("wool")
+	if len(results) != 3 || results[2].ID != 3 || results[0].Rank <= results[2].Rank {
+		t.Errorf("Expected product 3 last. Got %+v", results)
+	}
+
+	if results = search(`"socks wool"`); len(results) != 0 {
+		t.Errorf("Expected no products. Got %+v", results)
+	}
+	if results = search("jum* blue"); len(results) != 0 {
+		t.Errorf("Expected no products. Got %+v", results)
+	}
+	if results = search("jum* red"); len(results) != 1 || results[0].Snippet != "<mark>Red</mark> wool <mark>jumper</mark>" {
+		t.Errorf("Expected product 1. Got %+v", results)
+	}
+
+	// only the highlights are markup
+	s.Create(ctx, &Product{Name: "<img src=x onerror=alert(1)> scarf"})
+	if results = search("scarf"); len(results) != 1 || results[0].Snippet != "&lt;img src=x onerror=alert(1)&gt; <mark>scarf</mark>" {
+		t.Errorf("Expected the name to be escaped. Got %+v", results)
+	}
+	s.Create(ctx, &Product{Name: "Rock 'n' roll 39"})
+	if results = search("39"); len(results) != 1 || results[0].Snippet != "Rock &#39;n&#39; roll <mark>39</mark>" {
+		t.Errorf("Expected only the number to be highlighted. Got %+v", results)
+	}
+}
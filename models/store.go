@@ -0,0 +1,125 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by a ProductStore when the requested product
+// does not exist.
+var ErrNotFound = errors.New("product not found")
+
+// ErrVersionMismatch is returned by a ProductStore when a product was
+// changed by someone else since the version the caller expected.
+var ErrVersionMismatch = errors.New("product version mismatch")
+
+// ErrDuplicateSKU is returned by a ProductStore when a product would
+// get the sku of another product that isn't in the trash.
+var ErrDuplicateSKU = errors.New("sku is already in use")
+
+// ProductStore is the interface the handlers use to persist products. It
+// hides the storage engine from the HTTP layer so that handlers can be
+// tested with fakes and the backend can be swapped without touching them.
+//
+// Every method takes the context of the HTTP request. When the context is
+// canceled or its deadline passes the method gives up and returns
+// ctx.Err(), so callers can tell those cases apart from other failures.
+type ProductStore interface {
+	// Get returns the product with the given id, or ErrNotFound.
+	Get(ctx context.Context, id int) (Product, error)
+
+	// GetBySKU returns the product with the given sku, or ErrNotFound.
+	GetBySKU(ctx context.Context, sku string) (Product, error)
+
+	// List returns the products selected by q, in q's order.
+	List(ctx context.Context, q Query) ([]Product, error)
+
+	// Export calls fn with every product matching q's filters, in q's
+	// order, ignoring its paging and cursor. It streams the products
+	// rather than loading them all at once, and stops at the first error
+	// from fn, returning it.
+	Export(ctx context.Context, q Query, fn func(p Product) error) error
+
+	// Search returns the products that aren't in the trash matching q,
+	// best matches first.
+	Search(ctx context.Context, q SearchQuery) ([]SearchResult, error)
+
+	// Count returns how many products match q's filters, ignoring its
+	// paging and cursor. If exact is false the store may return a cheaper
+	// estimate.
+	Count(ctx context.Context, q Query, exact bool) (int, error)
+
+	// Create stores a new product and sets its ID.
+	Create(ctx context.Context, p *Product) error
+
+	// Update replaces the stored product that has the same ID as p and
+	// reloads p with what was stored, or returns ErrNotFound. If
+	// p.Version isn't zero and the stored product is at another version
+	// it returns ErrVersionMismatch instead.
+	Update(ctx context.Context, p *Product) error
+
+	// Upsert creates the product with p's sku, or replaces it if there
+	// is one, reloads p with what was stored and reports whether it was
+	// created. If p.Version isn't zero only an existing product is
+	// replaced, and Upsert returns ErrNotFound or ErrVersionMismatch like
+	// Update.
+	Upsert(ctx context.Context, p *Product) (created bool, err error)
+
+	// Patch loads the product with the given id, calls patch to modify
+	// it and stores the result, as one atomic operation. If patch returns
+	// an error nothing is stored and the error is returned as is. It
+	// returns the product as stored, or ErrNotFound. Patching bumps the
+	// product's version.
+	Patch(ctx context.Context, id int, patch func(p *Product) error) (Product, error)
+
+	// Delete moves the product with the given id to the trash, or
+	// returns ErrNotFound. If version isn't zero and the product is at
+	// another version it returns ErrVersionMismatch. Products in the
+	// trash are left out of everything but listings asking for them.
+	Delete(ctx context.Context, id, version int) error
+
+	// Bulk runs ops in order and returns the result of each. If atomic
+	// is set either all of them succeed or none are applied, and the
+	// ones that didn't fail are reported as ErrBulkAborted. Otherwise
+	// the operations that succeed are applied regardless of the rest.
+	// The error is only set if the store failed as a whole.
+	Bulk(ctx context.Context, ops []BulkOp, atomic bool) ([]BulkResult, error)
+
+	// Import upserts products by sku, or by name for products without
+	// one, creating them or updating the product with the same sku or
+	// name, and returns the outcome for each of them. The products must
+	// be valid.
+	Import(ctx context.Context, products []Product) ([]ImportResult, error)
+
+	// Restore takes the product with the given id out of the trash and
+	// returns it, or returns ErrNotFound if it isn't in the trash.
+	Restore(ctx context.Context, id int) (Product, error)
+
+	// Purge permanently removes the products moved to the trash before
+	// the given time and returns how many there were.
+	Purge(ctx context.Context, before time.Time) (int, error)
+}
@@ -0,0 +1,237 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Daniel J. Stroot
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Models declare their validation rules with a validate struct tag, for
+// example `validate:"required,max=255"`. The rules are:
+//
+//   required   the field must not be empty (or blank, for strings)
+//   min=N      minimum length of a string, or minimum value of a number
+//   max=N      maximum length of a string, or maximum value of a number
+//   scale=N    a number may have at most N digits after the decimal point
+//   currency   a three letter, upper case ISO 4217 currency code
+//   sku        empty, or up to 64 letters, digits, dots, dashes and
+//              underscores starting with a letter or digit
+//
+// Validate checks every rule on every field and reports all of the
+// failures at once, using the field's JSON name.
+
+// FieldError describes one validation rule that a field failed.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field-level violation found by Validate.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + " " + fe.Message
+	}
+
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// rule checks one field value against the rule's argument and returns a
+// message describing the failure, or "" if the value is fine.
+type rule func(v reflect.Value, arg string) string
+
+var rules = map[string]rule{
+	"required": required,
+	"min":      minimum,
+	"max":      maximum,
+	"scale":    scale,
+	"currency": currency,
+	"sku":      sku,
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// skuCode matches a sku, which has to be safe to use in a URL path.
+var skuCode = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Validate checks the validate tags of the struct v (or pointer to struct)
+// and returns a ValidationError listing every violation, or nil.
+func Validate(v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+
+	var errs ValidationError
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag := f.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+
+		for _, r := range strings.Split(tag, ",") {
+			name, arg := r, ""
+			if i := strings.Index(r, "="); i >= 0 {
+				name, arg = r[:i], r[i+1:]
+			}
+
+			check, ok := rules[name]
+			if !ok {
+				panic(fmt.Sprintf("model: unknown validation rule %q on %s.%s", name, rt.Name(), f.Name))
+			}
+
+			if msg := check(rv.Field(i), arg); msg != "" {
+				errs = append(errs, FieldError{Field: fieldName(f), Rule: name, Message: msg})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// fieldName returns the name a field has in JSON.
+func fieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return f.Name
+	}
+
+	return name
+}
+
+func required(v reflect.Value, _ string) string {
+	if v.Kind() == reflect.String && strings.TrimSpace(v.String()) == "" || v.IsZero() {
+		return "is required"
+	}
+
+	return ""
+}
+
+func minimum(v reflect.Value, arg string) string {
+	limit := parseLimit(arg)
+	if v.Kind() == reflect.String {
+		if float64(utf8.RuneCountInString(v.String())) < limit {
+			return "must be at least " + arg + " characters long"
+		}
+		return ""
+	}
+
+	if number(v) < limit {
+		return "must be at least " + arg
+	}
+
+	return ""
+}
+
+func maximum(v reflect.Value, arg string) string {
+	limit := parseLimit(arg)
+	if v.Kind() == reflect.String {
+		if float64(utf8.RuneCountInString(v.String())) > limit {
+			return "must be at most " + arg + " characters long"
+		}
+		return ""
+	}
+
+	if number(v) > limit {
+		return "must be at most " + arg
+	}
+
+	return ""
+}
+
+func scale(v reflect.Value, arg string) string {
+	digits, err := strconv.Atoi(arg)
+	if err != nil {
+		panic(fmt.Sprintf("model: invalid scale %q", arg))
+	}
+
+	// The shortest representation that round trips tells us how many
+	// decimals the value really has, so 0.1 has one and not seventeen.
+	s := strconv.FormatFloat(number(v), 'f', -1, 64)
+	if i := strings.IndexByte(s, '.'); i >= 0 && len(s)-i-1 > digits {
+		return "must have at most " + arg + " decimal places"
+	}
+
+	return ""
+}
+
+func currency(v reflect.Value, _ string) string {
+	if !currencyCode.MatchString(v.String()) {
+		return "must be a three letter ISO 4217 currency code"
+	}
+
+	return ""
+}
+
+// ValidSKU reports whether s is a valid, non-empty sku.
+func ValidSKU(s string) bool {
+	return skuCode.MatchString(s)
+}
+
+func sku(v reflect.Value, _ string) string {
+	if v.String() != "" && !ValidSKU(v.String()) {
+		return "must be up to 64 letters, digits, dots, dashes and underscores"
+	}
+
+	return ""
+}
+
+// parseLimit parses the argument of a min or max rule.
+func parseLimit(arg string) float64 {
+	limit, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		panic(fmt.Sprintf("model: invalid limit %q", arg))
+	}
+
+	return limit
+}
+
+// number returns the value of a numeric field as a float64. Types such as
+// Money provide their own Float64 method.
+func number(v reflect.Value) float64 {
+	if n, ok := v.Interface().(interface{ Float64() float64 }); ok {
+		return n.Float64()
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+
+	panic(fmt.Sprintf("model: can't validate %s as a number", v.Type()))
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+
+	tests := []struct {
+		product Product
+		rules   []string
+	}{
+		{Product{Name: "hello kitty", Price: 1499, Currency: "USD"}, nil},
+		{Product{Name: "free", Price: 0, Currency: "EUR"}, nil},
+		{Product{Name: "biggest", Price: 9999999999, Currency: "USD"}, nil},
+		{Product{Name: "", Price: 100, Currency: "USD"}, []string{"name:required"}},
+		{Product{Name: " \t", Price: 100, Currency: "USD"}, []string{"name:required"}},
+		{Product{Name: strings.Repeat("x", 256), Price: 100, Currency: "USD"}, []string{"name:max"}},
+		{Product{Name: "negative", Price: -1, Currency: "USD"}, []string{"price:min"}},
+		{Product{Name: "too big", Price: 10000000000, Currency: "USD"}, []string{"price:max"}},
+		{Product{Name: "lower case", Price: 100, Currency: "usd"}, []string{"currency:currency"}},
+		{Product{SKU: "ABC-123_x.1", Name: "sku", Price: 100, Currency: "USD"}, nil},
+		{Product{SKU: "-abc", Name: "sku", Price: 100, Currency: "USD"}, []string{"sku:sku"}},
+		{Product{SKU: "a/b", Name: "sku", Price: 100, Currency: "USD"}, []string{"sku:sku"}},
+		{Product{SKU: strings.Repeat("x", 65), Name: "sku", Price: 100, Currency: "USD"}, []string{"sku:sku"}},
+		{Product{Price: -100}, []string{"name:required", "price:min", "currency:currency"}},
+	}
+
+	for _, test := range tests {
+		var got []string
+		if err := test.product.Validate(); err != nil {
+			for _, fe := range err.(ValidationError) {
+				got = append(got, fe.Field+":"+fe.Rule)
+			}
+		}
+
+		if !reflect.DeepEqual(got, test.rules) {
+			t.Errorf("%+v: expected %v. Got %v", test.product, test.rules, got)
+		}
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+
+	err := Validate(Product{Price: -100, Currency: "USD"})
+	expected := "validation failed: name is required; price must be at least 0"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected '%s'. Got '%v'", expected, err)
+	}
+}
+
+func TestValidateScale(t *testing.T) {
+
+	// The scale rule counts the decimals a float really has, so 0.1
+	// has one and not seventeen.
+	type measurement struct {
+		Weight float64 `json:"weight" validate:"scale=2"`
+	}
+
+	for _, w := range []float64{0, 0.1, 5.97, 1e6} {
+		if err := Validate(measurement{w}); err != nil {
+			t.Errorf("%v: expected no error. Got %v", w, err)
+		}
+	}
+
+	for _, w := range []float64{0.001, 5.970000000000001} {
+		if err := Validate(measurement{w}); err == nil {
+			t.Errorf("%v: expected a scale error", w)
+		}
+	}
+}
@@ -29,26 +29,57 @@ import (
 
 	"github.com/dstroot/postgres-api/app"
 	"github.com/dstroot/postgres-api/handlers"
+	"github.com/dstroot/postgres-api/middleware/auth"
+	"github.com/dstroot/postgres-api/middleware/deadline"
 	"github.com/julienschmidt/httprouter"
 )
 
 // InitializeRoutes intializes our routes
 func InitializeRoutes(a app.App) {
 
-	a.Router.GET("/products", handlers.GetProducts(a.DB))
-	a.Router.POST("/product", handlers.CreateProduct(a.DB))
-	a.Router.GET("/product/:id", handlers.GetProduct(a.DB))
-	a.Router.PUT("/product/:id", handlers.UpdateProduct(a.DB))
-	a.Router.DELETE("/product/:id", handlers.DeleteProduct(a.DB))
+	// retries of these are safe with an Idempotency-Key
+	idempotent := handlers.Idempotent(a.Idempotency, a.Cfg.IdempotencyTTL)
 
-	a.Router.GET("/config", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		s, err := json.MarshalIndent(a.Cfg, "", "  ")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		w.Write(s)
-	})
+	// bulk requests and imports may take longer than the server's
+	// timeouts allow, they get a minute on top of the transaction to read
+	// the request and respond
+	batch := deadline.Allow(a.Cfg.BatchDeadline())
+
+	// clients need a role with these permissions, and tokens the scopes
+	policy := auth.Policy{Roles: a.Roles}
+	read := policy.Require("products:read")
+	write := policy.Require("products:write")
+
+	a.Router.GET("/products", read(handlers.GetProducts(a.Store, []byte(a.Cfg.CursorSecret))))
+	a.Router.GET("/products/export", read(handlers.ExportProducts(a.Store)))
+	a.Router.GET("/products/search", read(handlers.SearchProducts(a.Store)))
+	a.Router.POST("/products/bulk", batch(write(idempotent(handlers.BulkProducts(a.Store)))))
+	a.Router.POST("/products/import", batch(write(idempotent(handlers.ImportProducts(a.Store)))))
+	a.Router.POST("/product", write(idempotent(handlers.CreateProduct(a.Store))))
+	a.Router.GET("/product/:id", read(handlers.GetProduct(a.Store)))
+	a.Router.PUT("/product/:id", write(handlers.UpdateProduct(a.Store)))
+	a.Router.PATCH("/product/:id", write(handlers.PatchProduct(a.Store)))
+	a.Router.DELETE("/product/:id", write(handlers.DeleteProduct(a.Store)))
+	a.Router.POST("/product/:id/restore", write(handlers.RestoreProduct(a.Store)))
+
+	// these are /product/sku/:sku, see handlers/sku.go
+	a.Router.GET("/product/:id/:sku", read(handlers.GetProductBySKU(a.Store)))
+	a.Router.PUT("/product/:id/:sku", write(handlers.PutProductBySKU(a.Store)))
+	a.Router.DELETE("/product/:id/:sku", write(handlers.DeleteProductBySKU(a.Store)))
+
+	// the admin API needs ADMIN_TOKEN
+	admin := handlers.AdminOnly(a.Cfg.AdminToken)
+	a.Router.GET("/admin/config", admin(handlers.GetConfig(a.Settings)))
+	a.Router.GET("/admin/keys", admin(handlers.ListAPIKeys(a.Keys)))
+	a.Router.POST("/admin/keys", admin(handlers.CreateAPIKey(a.Keys)))
+	a.Router.POST("/admin/keys/:id/rotate", admin(handlers.RotateAPIKey(a.Keys)))
+	a.Router.DELETE("/admin/keys/:id", admin(handlers.RevokeAPIKey(a.Keys)))
+	a.Router.GET("/admin/roles", admin(handlers.ListRoles(a.Roles)))
+	a.Router.PUT("/admin/roles/:name", admin(handlers.PutRole(a.Roles)))
+	a.Router.DELETE("/admin/roles/:name", admin(handlers.DeleteRole(a.Roles)))
+	a.Router.GET("/admin/subjects/:subject/roles", admin(handlers.GetSubjectRoles(a.Roles)))
+	a.Router.PUT("/admin/subjects/:subject/roles/:role", admin(handlers.BindRole(a.Roles)))
+	a.Router.DELETE("/admin/subjects/:subject/roles/:role", admin(handlers.UnbindRole(a.Roles)))
 
 	a.Router.GET("/stats", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dstroot/postgres-api/app"
+)
+
+func TestRoutes(t *testing.T) {
+
+	// This test builds the app with the real routes and middleware, and
+	// checks that writes need a role, that bulk requests are idempotent
+	// and that the sku routes only answer to /product/sku/:sku.
+	for name, value := range map[string]string{"STORE": "memory", "AUTH": "apikey", "ADMIN_TOKEN": "admin-secret"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	a, err := app.Initialize()
+	if err != nil {
+		t.Fatalf("Expected clean initialization. Got %v", err)
+	}
+	InitializeRoutes(a)
+	server := httptest.NewServer(a.Server.Handler)
+	defer server.Close()
+
+	do := func(method, path, credential, body string, header ...string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+credential)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return res
+	}
+	check := func(res *http.Response, expected int) []byte {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("%s %s: expected response code %d. Got %d: %s",
+				res.Request.Method, res.Request.URL.Path, expected, res.StatusCode, body)
+		}
+		return body
+	}
+
+	// a new key can read products but not change them
+	var created struct{ Key string }
+	json.Unmarshal(check(do("POST", "/admin/keys", "admin-secret", `{"name":"ci"}`), http.StatusCreated), &created)
+	key := created.Key
+
+	product := `{"sku":"A-1","name":"test product","price":11.22}`
+	check(do("POST", "/product", "", product), http.StatusUnauthorized)
+	check(do("GET", "/products", key, ""), http.StatusOK)
+	check(do("POST", "/product", key, product), http.StatusForbidden)
+
+	check(do("PUT", "/admin/subjects/apikey:ci/roles/editor", "admin-secret", ""), http.StatusOK)
+	check(do("POST", "/product", key, product), http.StatusCreated)
+
+	// a bulk request is only run once for an Idempotency-Key
+	ops := `[{"op":"create","product":{"name":"bulk product","price":1}}]`
+	first := check(do("POST", "/products/bulk", key, ops, "Idempotency-Key", "bulk-1"), http.StatusOK)
+	res := do("POST", "/products/bulk", key, ops, "Idempotency-Key", "bulk-1")
+	if replayed := res.Header.Get("Idempotent-Replayed"); replayed != "true" {
+		t.Errorf("Expected the bulk response to be replayed. Got %q", replayed)
+	}
+	if again := check(res, http.StatusOK); string(again) != string(first) {
+		t.Errorf("Expected the same response. Got %s and %s", first, again)
+	}
+	if res := do("GET", "/products", key, ""); res.Header.Get("X-Total-Count") != "2" {
+		t.Errorf("Expected 2 products. Got %s", res.Header.Get("X-Total-Count"))
+	}
+
+	// the sku routes share their pattern with /product/:id/restore
+	check(do("GET", "/product/sku/A-1", key, ""), http.StatusOK)
+	check(do("GET", "/product/sku/B-2", key, ""), http.StatusNotFound)
+	check(do("GET", "/product/1/foo", key, ""), http.StatusNotFound)
+	check(do("PUT", "/product/1/A-1", key, product), http.StatusNotFound)
+}